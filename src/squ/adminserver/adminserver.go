@@ -0,0 +1,221 @@
+package adminserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	common "squ/commonserver"
+	"squ/logger"
+	"squ/scheduler"
+	"squ/stats"
+	"squ/transport"
+)
+
+// Methods of admin socket, changes of server (log level and recurring jobs)
+// are accepted on unix sockets only: access is limited by mode and owner of socket file
+const (
+	StatusMethod      = "status"
+	StatsMethod       = "stats"
+	SetLogLevelMethod = "set_log_level"
+	// recurring jobs
+	CronJobsMethod      = "cron_jobs"
+	AddCronJobMethod    = "add_cron_job"
+	RemoveCronJobMethod = "remove_cron_job"
+	// metrics in Prometheus format for admin socket over http
+	MetricsUrl = "/metrics"
+)
+
+// Result of last settings reload
+type ReloadStatus struct {
+	Time    string   `json:"time"`
+	Ok      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Changes []string `json:"changes"`
+}
+
+type Status struct {
+	Name      string            `json:"name"`
+	LogLevel  string            `json:"log_level"`
+	LogFormat string            `json:"log_format"`
+	LogLevels map[string]string `json:"log_levels"`
+	Sockets   []string          `json:"sockets"`
+	Queue     int               `json:"queue"`
+	Executing int               `json:"executing"`
+	Spilled   int               `json:"spilled"`
+	Delayed   int               `json:"delayed"`
+	Results   int               `json:"results"`
+	Reload    *ReloadStatus     `json:"reload,omitempty"`
+}
+
+// Params of set_log_level, without package it's common level
+type LogLevelParams struct {
+	Level   string `json:"level"`
+	Package string `json:"package,omitempty"`
+}
+
+// Params of remove_cron_job
+type JobNameParams struct {
+	Name string `json:"name"`
+}
+
+type StatusProvider interface {
+	GetStatus() *Status
+	GetStats() []stats.MethodStats
+}
+
+// Management of recurring jobs
+type CronProvider interface {
+	GetCronJobs() []scheduler.JobStatus
+	AddCronJob(job scheduler.Job) error
+	RemoveCronJob(name string) error
+}
+
+// Server state for admin socket
+type ServerProvider interface {
+	StatusProvider
+	CronProvider
+}
+
+// answer with value in JSON string
+func NewJsonAnswer(id int, value interface{}) *transport.Answer {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logger.Error("Admin answer encode error: %s", err)
+		return transport.NewErrorAnswer(
+			id, common.AnswerInternalError, fmt.Sprintf("%s", err))
+	}
+	return transport.NewAnswer(id, string(data))
+}
+
+// change log level in runtime, until next settings reload
+func setLogLevel(about string, cmd *transport.Command) *transport.Answer {
+	params := LogLevelParams{}
+	if err := json.Unmarshal([]byte(cmd.Params), &params); err != nil {
+		return transport.NewErrorAnswer(
+			cmd.Id, common.AnswerCodeFormatError, fmt.Sprintf("Incorrect params: %s", err))
+	}
+	if !logger.IsLevelName(params.Level) {
+		return transport.NewErrorAnswer(
+			cmd.Id, common.AnswerCodeFormatError, fmt.Sprintf("Unknown level '%s'.", params.Level))
+	}
+	newLevel := logger.ParseLevel(params.Level)
+	if params.Package == "" {
+		logger.SetLevel(newLevel)
+	} else {
+		logger.SetPackageLevel(params.Package, newLevel)
+	}
+	logger.With(logger.Fields{logger.FieldConnection: about, logger.FieldPackage: params.Package}).Info(
+		"Log level changed to %s", logger.GetLevelName(newLevel))
+	return NewJsonAnswer(cmd.Id, params)
+}
+
+// change of recurring jobs, answer is list of jobs
+func changeCronJobs(about string, cmd *transport.Command, provider CronProvider) *transport.Answer {
+	var err error
+	if cmd.Method == AddCronJobMethod {
+		job := scheduler.Job{}
+		if err = json.Unmarshal([]byte(cmd.Params), &job); err == nil {
+			err = provider.AddCronJob(job)
+		}
+	} else {
+		params := JobNameParams{}
+		if err = json.Unmarshal([]byte(cmd.Params), &params); err == nil {
+			err = provider.RemoveCronJob(params.Name)
+		}
+	}
+	if err != nil {
+		logger.With(logger.Fields{logger.FieldConnection: about}).Warn("Cron change error: %s", err)
+		return transport.NewErrorAnswer(
+			cmd.Id, common.AnswerCodeFormatError, fmt.Sprintf("Incorrect params: %s", err))
+	}
+	return NewJsonAnswer(cmd.Id, provider.GetCronJobs())
+}
+
+// Method changes state of server
+func isChange(method string) bool {
+	return method == SetLogLevelMethod || method == AddCronJobMethod || method == RemoveCronJobMethod
+}
+
+// Handler of admin socket with access to server state, changes are rejected if they aren't allowed
+func NewCommandHandler(provider ServerProvider, changesAllowed bool) common.CmdHandler {
+	return func(
+		about string,
+		cmd *transport.Command,
+		dataStreamManager *common.DataStreamManager) (
+		*transport.Answer, common.StateUpdater, bool) {
+		//
+		if isChange(cmd.Method) && !changesAllowed {
+			logger.Warn("Admin method %s from %s is rejected, changes over unix socket only", cmd.Method, about)
+			answer := transport.NewErrorAnswer(
+				cmd.Id, common.AnswerAccessError, "Changes are allowed over unix socket only.")
+			return answer, nil, false
+		}
+		switch cmd.Method {
+		case StatusMethod:
+			return NewJsonAnswer(cmd.Id, provider.GetStatus()), nil, false
+		case StatsMethod:
+			return NewJsonAnswer(cmd.Id, provider.GetStats()), nil, false
+		case SetLogLevelMethod:
+			return setLogLevel(about, cmd), nil, false
+		case CronJobsMethod:
+			return NewJsonAnswer(cmd.Id, provider.GetCronJobs()), nil, false
+		case AddCronJobMethod, RemoveCronJobMethod:
+			return changeCronJobs(about, cmd, provider), nil, false
+		default:
+			logger.Warn("Unknown admin method %s from %s", cmd.Method, about)
+			answer := transport.NewErrorAnswer(
+				cmd.Id, transport.ErrCodeUnknown, "Unknown method.")
+			return answer, nil, false
+		}
+	}
+}
+
+// Metrics of methods in Prometheus text format
+func NewMetricsHandler(provider StatusProvider) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodGet {
+			writer.Header().Set("Allow", http.MethodGet)
+			http.Error(writer, "Only GET is supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.WritePrometheus(writer, provider.GetStats())
+	}
+}
+
+// Admin commands over http: JSON-RPC request in POST body
+func NewHttpHandler(
+	about string,
+	dataStreamManager *common.DataStreamManager,
+	handler common.CmdHandler,
+	maxBodySize int) http.HandlerFunc {
+	//
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			http.Error(writer, "Only POST is supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(request.Body, int64(maxBodySize)+1))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxBodySize {
+			http.Error(writer, "Request is too big.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		var answer *transport.Answer
+		if cmd, err := transport.ParseCommand(&body); err == nil {
+			answer, _, _ = handler(about, cmd, dataStreamManager)
+		} else {
+			answer = transport.NewErrorAnswer(0, common.AnswerCodeFormatError, err.Error())
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		if data := answer.DataDump(); data != nil {
+			writer.Write(*data)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// Package client has Executer for handling of commands from executer socket
+// and Caller for commands to receiver socket, both use line protocol.
+// Executer receives commands by long poll ("execute" waits for command),
+// push of commands isn't supported by server.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"squ/logger"
+	"squ/tracing"
+	"squ/transport"
+	"sync"
+	"time"
+)
+
+// service methods of executer socket
+const (
+	RegMethodName      = "registration"
+	ResultMethodReturn = "result"
+	GetExecute         = "execute"
+)
+
+const (
+	DefaultReconnectDelay    = 500  // ms
+	DefaultMaxReconnectDelay = 5000 // ms
+	DefaultMaxIdle           = 4
+	DefaultDialTimeout       = 10 // sec.
+	// error code for handler errors without own code
+	DefaultErrorCode = transport.ErrCodeUnknown
+)
+
+var (
+	ErrNoHandler = errors.New("no handlers for executer")
+	ErrNoAnswer  = errors.New("empty answer")
+)
+
+// Error with code, handler can return it for own error code in result
+type Error struct {
+	Code    int
+	Message string
+	// task of command which is not done in time, for "get_result" and "task_status"
+	Task string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("squ error %d: %s", err.Code, err.Message)
+}
+
+func NewError(code int, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+// line protocol connection
+type lineConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	nextId int
+}
+
+func dial(ctx context.Context, network, addr string) (*lineConn, error) {
+	dialer := net.Dialer{Timeout: DefaultDialTimeout * time.Second}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &lineConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// Option of command for Caller
+type CallOption func(cmd *transport.Command)
+
+// Command is routed to the same executer for the same key
+func WithRoutingKey(key string) CallOption {
+	return func(cmd *transport.Command) {
+		cmd.RoutingKey = key
+	}
+}
+
+// Command is executed by executer with all labels of selector
+func WithSelector(selector map[string]string) CallOption {
+	return func(cmd *transport.Command) {
+		cmd.Selector = selector
+	}
+}
+
+// Send command and read answer, cancel of context breaks connection
+func (connection *lineConn) call(
+	ctx context.Context, method string, params string, options ...CallOption) (*transport.Answer, error) {
+	//
+	connection.nextId++
+	cmd := transport.NewCommand(method)
+	cmd.Id = connection.nextId
+	cmd.Params = params
+	for _, option := range options {
+		option(cmd)
+	}
+	if traceContext, ok := tracing.FromContext(ctx); ok {
+		cmd.Traceparent = traceContext.String()
+	}
+	data := cmd.DataDump()
+	if data == nil {
+		return nil, fmt.Errorf("can't encode command %s", cmd)
+	}
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	if _, err := connection.conn.Write(append(*data, byte('\n'))); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	line, err := connection.reader.ReadBytes('\n')
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	answer, err := transport.ParseAnswer(&line)
+	if err != nil {
+		return nil, err
+	}
+	if answer.Id != cmd.Id {
+		return nil, fmt.Errorf("answer id %d for command %d", answer.Id, cmd.Id)
+	}
+	return answer, nil
+}
+
+func (connection *lineConn) close() {
+	connection.conn.Close()
+}
+
+func answerError(answer *transport.Answer) error {
+	if answer.Error.Exists() {
+		err := NewError(answer.Error.Code, answer.Error.Message)
+		if answer.Error.Data != nil {
+			err.Task = answer.Error.Data.Task
+		}
+		return err
+	}
+	return nil
+}
+
+func encodeParams(params interface{}) (string, error) {
+	switch value := params.(type) {
+	case nil:
+		return "{}", nil
+	case string:
+		return value, nil
+	case []byte:
+		return string(value), nil
+	default:
+		data, err := json.Marshal(value)
+		return string(data), err
+	}
+}
+
+// Handler of command for method, params and result are JSON strings
+type HandlerFunc func(ctx context.Context, params string) (string, error)
+
+// Executer: registration of handlers and loop of command execution
+type Executer struct {
+	network  string
+	addr     string
+	handlers map[string]HandlerFunc
+	Workers  int
+	// labels for commands with selector
+	Labels            map[string]string
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+}
+
+func NewExecuter(network, addr string) *Executer {
+	executer := Executer{
+		network:           network,
+		addr:              addr,
+		handlers:          make(map[string]HandlerFunc),
+		Workers:           1,
+		ReconnectDelay:    DefaultReconnectDelay * time.Millisecond,
+		MaxReconnectDelay: DefaultMaxReconnectDelay * time.Millisecond}
+	return &executer
+}
+
+// Add handler for method, must be called before Run
+func (executer *Executer) Handle(method string, handler HandlerFunc) {
+	executer.handlers[method] = handler
+}
+
+func (executer *Executer) methods() []string {
+	result := make([]string, 0, len(executer.handlers))
+	for method := range executer.handlers {
+		result = append(result, method)
+	}
+	return result
+}
+
+// Run workers (each with own connection) until context will be canceled
+func (executer *Executer) Run(ctx context.Context) error {
+	if len(executer.handlers) == 0 {
+		return ErrNoHandler
+	}
+	workers := executer.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	wait := new(sync.WaitGroup)
+	for index := 0; index < workers; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			executer.worker(ctx, index)
+		}(index)
+	}
+	wait.Wait()
+	return nil
+}
+
+// connect and execute with reconnect
+func (executer *Executer) worker(ctx context.Context, index int) {
+	delay := executer.ReconnectDelay
+	for ctx.Err() == nil {
+		connection, err := dial(ctx, executer.network, executer.addr)
+		if err == nil {
+			delay = executer.ReconnectDelay
+			err = executer.session(ctx, connection)
+			connection.close()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		logger.Warn("Executer worker %d connection problem: %s", index, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > executer.MaxReconnectDelay {
+			delay = executer.MaxReconnectDelay
+		}
+	}
+}
+
+// registration and poll loop in one connection
+func (executer *Executer) session(ctx context.Context, connection *lineConn) error {
+	regParams, _ := encodeParams(map[string]interface{}{
+		"Methods": executer.methods(),
+		"Labels":  executer.Labels})
+	answer, err := connection.call(ctx, RegMethodName, regParams)
+	if err != nil {
+		return err
+	}
+	if err = answerError(answer); err != nil {
+		return err
+	}
+	for ctx.Err() == nil {
+		answer, err = connection.call(ctx, GetExecute, "{}")
+		if err != nil {
+			return err
+		}
+		if err = answerError(answer); err != nil {
+			return err
+		}
+		task := transport.TaskCommand{}
+		if json.Unmarshal([]byte(answer.Result), &task) != nil || task.Task == "" {
+			// no command
+			continue
+		}
+		result := executer.execute(ctx, &task)
+		params, err := encodeParams(result)
+		if err != nil {
+			return err
+		}
+		answer, err = connection.call(ctx, ResultMethodReturn, params)
+		if err != nil {
+			return err
+		}
+		if err = answerError(answer); err != nil {
+			logger.Warn("Result of task %s was not accepted: %s", task.Task, err)
+		}
+	}
+	return nil
+}
+
+func (executer *Executer) execute(ctx context.Context, task *transport.TaskCommand) *transport.TaskResult {
+	result := transport.TaskResult{Task: task.Task}
+	handler, exists := executer.handlers[task.Method]
+	if !exists {
+		result.Error = &transport.ErrorDescription{
+			Code:    DefaultErrorCode,
+			Message: fmt.Sprintf("Unknown method %s.", task.Method)}
+		return &result
+	}
+	if traceContext, err := tracing.ParseTraceparent(task.Traceparent); err == nil {
+		ctx = tracing.NewContext(ctx, traceContext)
+	}
+	value, err := handler(ctx, task.Params)
+	if err != nil {
+		code := DefaultErrorCode
+		if handlerErr, ok := err.(*Error); ok {
+			code = handlerErr.Code
+		}
+		result.Error = &transport.ErrorDescription{Code: code, Message: err.Error()}
+	} else {
+		result.Result = value
+	}
+	return &result
+}
+
+// Caller: send commands to receiver socket and wait results
+type Caller struct {
+	network string
+	addr    string
+	idle    chan *lineConn
+}
+
+func NewCaller(network, addr string) *Caller {
+	caller := Caller{
+		network: network,
+		addr:    addr,
+		idle:    make(chan *lineConn, DefaultMaxIdle)}
+	return &caller
+}
+
+func (caller *Caller) getConn(ctx context.Context) (*lineConn, error) {
+	select {
+	case connection := <-caller.idle:
+		return connection, nil
+	default:
+		return dial(ctx, caller.network, caller.addr)
+	}
+}
+
+func (caller *Caller) putConn(connection *lineConn) {
+	select {
+	case caller.idle <- connection:
+	default:
+		connection.close()
+	}
+}
+
+// Call method and return result as JSON string,
+// params can be string or []byte (JSON) or any value for encoding.
+func (caller *Caller) Call(
+	ctx context.Context, method string, params interface{}, options ...CallOption) (string, error) {
+	//
+	encoded, err := encodeParams(params)
+	if err != nil {
+		return "", err
+	}
+	connection, err := caller.getConn(ctx)
+	if err != nil {
+		return "", err
+	}
+	answer, err := connection.call(ctx, method, encoded, options...)
+	if err != nil {
+		// connection state is unknown
+		connection.close()
+		return "", err
+	}
+	caller.putConn(connection)
+	if err = answerError(answer); err != nil {
+		return "", err
+	}
+	return answer.Result, nil
+}
+
+// Call method and decode result to value
+func (caller *Caller) CallJson(
+	ctx context.Context, method string, params interface{}, result interface{}, options ...CallOption) error {
+	//
+	value, err := caller.Call(ctx, method, params, options...)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		return ErrNoAnswer
+	}
+	return json.Unmarshal([]byte(value), result)
+}
+
+// Close idle connections
+func (caller *Caller) Close() {
+	for {
+		select {
+		case connection := <-caller.idle:
+			connection.close()
+		default:
+			return
+		}
+	}
+}
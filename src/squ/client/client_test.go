@@ -0,0 +1,252 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"squ/client"
+	common "squ/commonserver"
+	"squ/netserver"
+	"squ/settings"
+	"squ/tracing"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var receiverSock string
+var executerSock string
+var spansPath string
+
+// settings for in-process server with unix sockets
+func testSettings(executerSock, receiverSock, spansPath string) settings.SettingsProvider {
+	content := fmt.Sprintf(`{
+		"name": "test",
+		"storage_iter_time": 50,
+		"tracing": {"exporter": "file", "path": %q},
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q}
+		]}`,
+		spansPath, common.NetExecuter, executerSock, common.NetRecеiver, receiverSock)
+	result, err := settings.ParseJsonSettings([]byte(content))
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func waitSocket(path string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "squ-client")
+	if err != nil {
+		panic(err)
+	}
+	receiverSock = filepath.Join(dir, "receiver.sock")
+	executerSock = filepath.Join(dir, "executer.sock")
+	spansPath = filepath.Join(dir, "spans.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	server, err := netserver.New(ctx, netserver.Options{
+		Settings: testSettings(executerSock, receiverSock, spansPath)})
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		panic(err)
+	}
+	waitSocket(receiverSock)
+	waitSocket(executerSock)
+	code := m.Run()
+	cancel()
+	server.Stop()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+type sumParams struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func sumHandler(ctx context.Context, params string) (string, error) {
+	p := sumParams{}
+	if err := json.Unmarshal([]byte(params), &p); err != nil {
+		return "", err
+	}
+	if p.A < 0 {
+		return "", client.NewError(100, "negative")
+	}
+	return fmt.Sprintf("%d", p.A+p.B), nil
+}
+
+func TestExecuterAndCaller(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	executer := client.NewExecuter("unix", executerSock)
+	executer.Workers = 2
+	executer.Handle("sum", sumHandler)
+	done := make(chan bool)
+	go func() {
+		executer.Run(ctx)
+		done <- true
+	}()
+
+	caller := client.NewCaller("unix", receiverSock)
+	defer caller.Close()
+	wait := new(sync.WaitGroup)
+	for index := 0; index < 10; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			var result int
+			err := caller.CallJson(ctx, "sum", sumParams{A: index, B: 10}, &result)
+			if err != nil {
+				t.Errorf("call %d error: %s", index, err)
+			} else if result != index+10 {
+				t.Errorf("call %d result %d", index, result)
+			}
+		}(index)
+	}
+	wait.Wait()
+	// error with code from handler
+	_, err := caller.Call(ctx, "sum", sumParams{A: -1})
+	if callErr, ok := err.(*client.Error); !ok || callErr.Code != 100 {
+		t.Errorf("expected handler error, got %v", err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Error("executer is not stopped")
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	// "execute" of stopped executers from other tests must be finished
+	time.Sleep(3 * common.PauseGetCmd * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	executer := client.NewExecuter("unix", executerSock)
+	executer.Handle("trace", func(ctx context.Context, params string) (string, error) {
+		traceContext, _ := tracing.FromContext(ctx)
+		return fmt.Sprintf("%q", traceContext.TraceId), nil
+	})
+	go executer.Run(ctx)
+
+	caller := client.NewCaller("unix", receiverSock)
+	defer caller.Close()
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	callCtx := tracing.NewContext(ctx, tracing.TraceContext{
+		TraceId: traceId, SpanId: "00f067aa0ba902b7"})
+	var result string
+	if err := caller.CallJson(callCtx, "trace", nil, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != traceId {
+		t.Errorf("handler got trace %s", result)
+	}
+	content, _ := ioutil.ReadFile(spansPath)
+	names := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		span := tracing.Span{}
+		if json.Unmarshal([]byte(line), &span) == nil && span.TraceId == traceId {
+			names[span.Name] = true
+		}
+	}
+	for _, name := range []string{
+		tracing.SpanEnqueue, tracing.SpanQueueWait, tracing.SpanDispatch,
+		tracing.SpanProcess, tracing.SpanDeliver, tracing.SpanTask} {
+		//
+		if !names[name] {
+			t.Errorf("no span %s in %s", name, content)
+		}
+	}
+}
+
+func TestCallerContextCancel(t *testing.T) {
+	caller := client.NewCaller("unix", receiverSock)
+	defer caller.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// nobody executes it
+	_, err := caller.Call(ctx, "unknown_method", nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("call is not canceled in time")
+	}
+}
+
+func TestSelectorAndRoutingKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	executer := client.NewExecuter("unix", executerSock)
+	executer.Labels = map[string]string{"zone": "a"}
+	executer.Handle("zone", func(ctx context.Context, params string) (string, error) {
+		return `"a"`, nil
+	})
+	go executer.Run(ctx)
+
+	caller := client.NewCaller("unix", receiverSock)
+	defer caller.Close()
+	var zone string
+	err := caller.CallJson(ctx, "zone", nil, &zone, client.WithSelector(map[string]string{"zone": "a"}))
+	if err != nil || zone != "a" {
+		t.Fatalf("call with selector: %s %v", zone, err)
+	}
+	err = caller.CallJson(ctx, "zone", nil, &zone, client.WithRoutingKey("user-1"))
+	if err != nil || zone != "a" {
+		t.Fatalf("call with routing key: %s %v", zone, err)
+	}
+	// no executers with labels of selector
+	_, err = caller.Call(ctx, "zone", map[string]interface{}{"timeout": 0.1},
+		client.WithSelector(map[string]string{"zone": "b"}))
+	if callErr, ok := err.(*client.Error); !ok || callErr.Code != common.AnswerTimeoutError {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestCallTimeoutTask(t *testing.T) {
+	caller := client.NewCaller("unix", receiverSock)
+	defer caller.Close()
+	// nobody executes it, answer after wait timeout has task
+	_, err := caller.Call(context.Background(), "timeout_method", map[string]interface{}{"timeout": 0.1})
+	callErr, ok := err.(*client.Error)
+	if !ok || callErr.Code != common.AnswerTimeoutError || callErr.Task == "" {
+		t.Fatalf("expected timeout error with task, got %v", err)
+	}
+	if !strings.Contains(callErr.Message, callErr.Task) {
+		t.Errorf("task %s of other command", callErr.Task)
+	}
+}
+
+func TestExecuterReconnect(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-client")
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	executer := client.NewExecuter("unix", filepath.Join(dir, "none.sock"))
+	executer.ReconnectDelay = 10 * time.Millisecond
+	executer.Handle("sum", sumHandler)
+	if err := executer.Run(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := client.NewExecuter("unix", executerSock).Run(ctx); err != client.ErrNoHandler {
+		t.Errorf("expected no handler error, got %v", err)
+	}
+}
@@ -1,13 +1,15 @@
 package cmdexecstorage
 
 import (
+	"container/heap"
 	"math"
-	"os"
+	"squ/helpers"
 	"squ/logger"
 	subsys "squ/subsysmanage"
 	"squ/transport"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,30 +30,29 @@ func simplePosMax(arr *[]int) int {
 
 const (
 	DefaultClearIterTimeout = 250 // ms
+	DefaultShardCount       = 256
+	MaxShardCount           = 65536
 )
 
 // get n char from hash - i's index of target map in array
+// (legacy sharding by hex uid, storage uses ShardIndex)
+//
+// Deprecated: storage isn't sharded by hex uid, use CmdExecStorage.ShardIndex.
 var HashHexPositions []int
 var MapsCount int
 var MinHashSize int
-var ClearIterTimeout int
 
 func init() {
 	HashHexPositions = []int{2, 4}
 	MapsCount = int(math.Pow(16.0, float64(len(HashHexPositions))))
 	MinHashSize = simplePosMax(&HashHexPositions) + 1
-
-	ClearIterTimeout = DefaultClearIterTimeout
-	if val, err := strconv.Atoi(os.Getenv("STORAGE_ITER_TIME")); err == nil {
-		if val > 0 {
-			ClearIterTimeout = val
-		}
-	}
 }
 
 type ReturnCommandHandler func(cmd *transport.Command, task string)
 
 // get hex char from position and create int index value
+//
+// Deprecated: storage isn't sharded by hex uid, use CmdExecStorage.ShardIndex.
 func GetMapIndex(hexStr string) int {
 	var result int
 	if len(hexStr) >= MinHashSize {
@@ -69,132 +70,164 @@ func GetMapIndex(hexStr string) int {
 	return result
 }
 
-//cmd info
+// cmd info
 type cmdInfo struct {
+	hash      string
 	cmd       *transport.Command
-	waitIndex int
-	waitLimit int
+	deadline  int64 // unix ns.
+	heapIndex int
 }
 
-// storage cell
-type cellMap struct {
-	lock    *sync.RWMutex
-	storage map[string]cmdInfo
+// min-heap of commands by deadline (container/heap)
+type deadlineHeap []*cmdInfo
+
+func (items deadlineHeap) Len() int {
+	return len(items)
 }
 
-func (cell *cellMap) push(hash string, cmd *transport.Command, timeLimit int) {
-	cellmap := *cell
-	cellmap.lock.Lock()
-	defer cellmap.lock.Unlock()
-	iterLimit := int(float32(timeLimit) / float32(ClearIterTimeout))
-	cellmap.storage[hash] = cmdInfo{
-		cmd:       cmd,
-		waitLimit: iterLimit}
+func (items deadlineHeap) Less(i, j int) bool {
+	return items[i].deadline < items[j].deadline
 }
 
-func (cell *cellMap) remove(hash string) bool {
-	cellmap := *cell
-	cellmap.lock.Lock()
-	defer cellmap.lock.Unlock()
+func (items deadlineHeap) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+	items[i].heapIndex = i
+	items[j].heapIndex = j
+}
 
-	_, exists := cellmap.storage[hash]
-	if exists {
-		delete(cellmap.storage, hash)
-	}
-	return exists
+func (items *deadlineHeap) Push(value interface{}) {
+	info := value.(*cmdInfo)
+	info.heapIndex = len(*items)
+	*items = append(*items, info)
 }
 
-func (cell *cellMap) size() int {
-	cellmap := *cell
-	cellmap.lock.Lock()
-	defer cellmap.lock.Unlock()
-	return len(cellmap.storage)
+func (items *deadlineHeap) Pop() interface{} {
+	old := *items
+	last := len(old) - 1
+	info := old[last]
+	old[last] = nil
+	*items = old[:last]
+	return info
 }
 
-// Increase wait index.
-func (cell *cellMap) incWaitIndex() {
-	cellmap := *cell
-	cellmap.lock.Lock()
-	defer cellmap.lock.Unlock()
-	for hash, val := range cellmap.storage {
-		val.waitIndex++
-		cellmap.storage[hash] = val
-	}
+// storage cell
+type cellMap struct {
+	lock      *sync.Mutex
+	storage   map[string]*cmdInfo
+	deadlines deadlineHeap
 }
 
-// Get all command, where wait limit extended.
-func (cell *cellMap) getOld() map[string]*transport.Command {
-	cellmap := *cell
-	cellmap.lock.RLock()
-	defer cellmap.lock.RUnlock()
-	result := make(map[string]*transport.Command)
-	for hash, _ := range cellmap.storage {
-		if cellmap.storage[hash].waitIndex > cellmap.storage[hash].waitLimit {
-			result[hash] = cellmap.storage[hash].cmd
-		}
+// add or replace command, result is true if it's first deadline of cell
+func (cell *cellMap) push(hash string, cmd *transport.Command, deadline int64) bool {
+	cell.lock.Lock()
+	defer cell.lock.Unlock()
+	if info, exists := cell.storage[hash]; exists {
+		info.cmd = cmd
+		info.deadline = deadline
+		heap.Fix(&cell.deadlines, info.heapIndex)
+	} else {
+		info = &cmdInfo{hash: hash, cmd: cmd, deadline: deadline}
+		cell.storage[hash] = info
+		heap.Push(&cell.deadlines, info)
 	}
-	return result
+	return cell.deadlines[0].hash == hash
 }
 
-// Free cell for such hash set.
-func (cell *cellMap) free(hashSet ...string) {
-	cellmap := *cell
-	cellmap.lock.Lock()
-	defer cellmap.lock.Unlock()
-	for _, hash := range hashSet {
-		delete(cellmap.storage, hash)
+func (cell *cellMap) remove(hash string) bool {
+	cell.lock.Lock()
+	defer cell.lock.Unlock()
+	info, exists := cell.storage[hash]
+	if exists {
+		delete(cell.storage, hash)
+		heap.Remove(&cell.deadlines, info.heapIndex)
 	}
+	return exists
+}
+
+func (cell *cellMap) size() int {
+	cell.lock.Lock()
+	defer cell.lock.Unlock()
+	return len(cell.storage)
 }
 
-// Iteration for search old command
-func (cell *cellMap) clearIteration() map[string]*transport.Command {
-	cell.incWaitIndex()
-	result := cell.getOld()
-	hashSet := make([]string, len(result))
-	i := 0
-	for h, _ := range result {
-		hashSet[i] = h
-		i++
+// Remove commands with deadline before now (in order of deadlines),
+// next is first deadline of remaining commands (0 if cell is empty).
+func (cell *cellMap) expire(now int64) (expired []*cmdInfo, next int64) {
+	cell.lock.Lock()
+	defer cell.lock.Unlock()
+	for len(cell.deadlines) > 0 && cell.deadlines[0].deadline <= now {
+		info := heap.Pop(&cell.deadlines).(*cmdInfo)
+		delete(cell.storage, info.hash)
+		expired = append(expired, info)
 	}
-	cell.free(hashSet...)
-	return result
+	if len(cell.deadlines) > 0 {
+		next = cell.deadlines[0].deadline
+	}
+	return expired, next
 }
 
 func newCellMap() *cellMap {
 	result := cellMap{
-		storage: make(map[string]cmdInfo),
-		lock:    new(sync.RWMutex)}
+		storage: make(map[string]*cmdInfo),
+		lock:    new(sync.Mutex)}
 	return &result
 }
 
 // Storage for command in clients task
 type CmdExecStorage struct {
-	cells         []*cellMap
-	returnHandler ReturnCommandHandler
-	exitChannel   chan bool
-	active        bool
+	cells            []*cellMap
+	shardCount       int
+	returnHandler    ReturnCommandHandler
+	exitChannel      chan bool
+	active           int32 // atomic
+	clearIterTimeout int
+	// wake of expiry loop for deadline before planned one
+	wakeChannel  chan bool
+	nextDeadline int64 // unix ns., atomic
+}
+
+// Shard of key (task id of any form) with consistent hash
+func (storage *CmdExecStorage) ShardIndex(key string) int {
+	return helpers.KeyBucket(key, storage.shardCount)
+}
+
+func (storage *CmdExecStorage) ShardCount() int {
+	return storage.shardCount
+}
+
+// Expiry loop is running
+func (storage *CmdExecStorage) IsActive() bool {
+	return atomic.LoadInt32(&storage.active) == 1
 }
 
 // add command to store for saving at >= timeLimit
 func (storage *CmdExecStorage) Push(hash string, cmd *transport.Command, timeLimit int) bool {
-	if !(*storage).active {
+	if !storage.IsActive() {
 		return false
 	}
-	mapIndex := GetMapIndex(hash)
+	mapIndex := storage.ShardIndex(hash)
 	cellRef := (*storage).cells[mapIndex]
-	cellRef.push(hash, cmd, timeLimit)
+	deadline := time.Now().Add(time.Duration(timeLimit) * time.Millisecond).UnixNano()
+	if cellRef.push(hash, cmd, deadline) {
+		if next := atomic.LoadInt64(&storage.nextDeadline); next == 0 || deadline < next {
+			select {
+			case storage.wakeChannel <- true:
+			default:
+			}
+		}
+	}
 	return true
 }
 
 // Stop all activity and close channel
 func (storage *CmdExecStorage) ForceStop() {
 	(*storage).exitChannel <- true
-	time.Sleep(time.Millisecond * time.Duration(ClearIterTimeout))
+	time.Sleep(time.Millisecond * time.Duration((*storage).clearIterTimeout))
 }
 
 // Free cell in storage
 func (storage *CmdExecStorage) Free(hash string) bool {
-	mapIndex := GetMapIndex(hash)
+	mapIndex := storage.ShardIndex(hash)
 	cellRef := (*storage).cells[mapIndex]
 	return cellRef.remove(hash)
 }
@@ -202,76 +235,111 @@ func (storage *CmdExecStorage) Free(hash string) bool {
 // Volume of storage
 func (storage *CmdExecStorage) Volume() int {
 	var result int
-	for index := 0; index < MapsCount; index++ {
-		result += (*storage).cells[index].size()
+	for _, cell := range storage.cells {
+		result += cell.size()
 	}
 	return result
 }
 
-// run watching and periodic clearing
+// Return commands after deadline to handler, result is first deadline of remaining
+func (storage *CmdExecStorage) expire(now time.Time) int64 {
+	var next int64
+	nowNs := now.UnixNano()
+	for _, cell := range storage.cells {
+		expired, cellNext := cell.expire(nowNs)
+		for _, info := range expired {
+			storage.returnHandler(info.cmd, info.hash)
+		}
+		if cellNext > 0 && (next == 0 || cellNext < next) {
+			next = cellNext
+		}
+	}
+	return next
+}
+
+// run watching: wait for first deadline (but not longer than clearIterTimeout)
 func (storage *CmdExecStorage) run() {
-	(*storage).active = true
+	atomic.StoreInt32(&storage.active, 1)
 	active := true
-	index := 0
+	maxWait := time.Millisecond * time.Duration(storage.clearIterTimeout)
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
 	logger.Debug("Storage at %p started.", storage)
 	for active {
 		select {
 		case <-(*storage).exitChannel:
-			{
-				active = false
-			}
-		case <-time.After(time.Millisecond * time.Duration(ClearIterTimeout)):
-			{
-				for index = 0; index < MapsCount; index++ {
-					cmdMap := (*storage).cells[index].clearIteration()
-					if len(cmdMap) > 0 {
-						// big delay will be here?
-						for hash, cmdRef := range cmdMap {
-							(*storage).returnHandler(cmdRef, hash)
-						}
-					}
-				}
+			active = false
+		case <-storage.wakeChannel:
+		case <-timer.C:
+		}
+		if !active {
+			break
+		}
+		now := time.Now()
+		next := storage.expire(now)
+		atomic.StoreInt64(&storage.nextDeadline, next)
+		wait := maxWait
+		if next > 0 && time.Duration(next-now.UnixNano()) < wait {
+			wait = time.Duration(next - now.UnixNano())
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
 		}
+		timer.Reset(wait)
 	}
-	(*storage).active = false
+	atomic.StoreInt32(&storage.active, 0)
 	close((*storage).exitChannel)
 	logger.Debug("Storage at %p stopped.", storage)
 }
 
-var onceStorage *CmdExecStorage
-
 // New storage for command with
 // rhandler - rollback handler (for processing comman after timeout event)
-// refresh - params used for testing, avoid using it
+// clearIterTimeout - max period of expiry check (ms.), DefaultClearIterTimeout if <= 0,
+// commands are returned at their deadlines
 func NewCmdExecStorage(
 	rhandler ReturnCommandHandler,
-	refresh bool) *CmdExecStorage {
+	clearIterTimeout int) *CmdExecStorage {
 	//
-	var store *CmdExecStorage
-	if onceStorage != nil && !refresh {
-		store = onceStorage
-	} else {
-		withProblem := rhandler == nil
-		if withProblem {
-			logger.Error("Empty handler for comand return back!")
-		}
-		result := CmdExecStorage{
-			returnHandler: rhandler,
-			active:        !withProblem,
-			exitChannel:   make(chan bool, 1),
-			cells:         make([]*cellMap, MapsCount)}
-		for index := 0; index < MapsCount; index++ {
-			result.cells[index] = newCellMap()
-		}
-		onceStorage = &result
-		if !withProblem {
-			go result.run()
-		}
-		store = &result
+	return NewShardedCmdExecStorage(rhandler, clearIterTimeout, DefaultShardCount)
+}
+
+// New storage with shardCount cells, DefaultShardCount if <= 0
+func NewShardedCmdExecStorage(
+	rhandler ReturnCommandHandler,
+	clearIterTimeout int,
+	shardCount int) *CmdExecStorage {
+	//
+	withProblem := rhandler == nil
+	if withProblem {
+		logger.Error("Empty handler for comand return back!")
+	}
+	if clearIterTimeout <= 0 {
+		clearIterTimeout = DefaultClearIterTimeout
+	}
+	if shardCount <= 0 {
+		shardCount = DefaultShardCount
+	} else if shardCount > MaxShardCount {
+		shardCount = MaxShardCount
+	}
+	store := CmdExecStorage{
+		returnHandler:    rhandler,
+		exitChannel:      make(chan bool, 1),
+		wakeChannel:      make(chan bool, 1),
+		cells:            make([]*cellMap, shardCount),
+		shardCount:       shardCount,
+		clearIterTimeout: clearIterTimeout}
+	for index := 0; index < shardCount; index++ {
+		store.cells[index] = newCellMap()
+	}
+	if !withProblem {
+		store.active = 1
+		go store.run()
 	}
-	logger.Debug("Store for executed command at %p", store)
-	return store
+	logger.Debug("Store for executed command at %p", &store)
+	return &store
 }
 
 // subsys SubSystemSwitcher
@@ -281,8 +349,8 @@ func (storage *CmdExecStorage) CallCommandService(commandCode int, doneChannel *
 	case subsys.SubSystemCommandCodeStop:
 		{
 			storage.ForceStop()
-			delay := time.Millisecond * time.Duration(ClearIterTimeout)
-			for (*storage).active {
+			delay := time.Millisecond * time.Duration(storage.clearIterTimeout)
+			for storage.IsActive() {
 				time.Sleep(delay)
 			}
 			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStop))
@@ -0,0 +1,88 @@
+package cmdexecstorage_test
+
+import (
+	"fmt"
+	"squ/cmdexecstorage"
+	"squ/transport"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func benchStorage(b *testing.B) *cmdexecstorage.CmdExecStorage {
+	storage := cmdexecstorage.NewCmdExecStorage(func(cmd *transport.Command, task string) {}, 0)
+	b.Cleanup(storage.ForceStop)
+	return storage
+}
+
+func benchKeys(count int) []string {
+	keys := make([]string, count)
+	for index := range keys {
+		keys[index] = fmt.Sprintf("task-%d", index)
+	}
+	return keys
+}
+
+// push and free of in-flight task
+func BenchmarkPushFree(b *testing.B) {
+	storage := benchStorage(b)
+	keys := benchKeys(b.N)
+	cmd := transport.NewCommand("bench")
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		storage.Push(keys[index], cmd, 60000)
+		storage.Free(keys[index])
+	}
+}
+
+func BenchmarkPushFreeParallel(b *testing.B) {
+	storage := benchStorage(b)
+	cmd := transport.NewCommand("bench")
+	var counter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("task-%d", atomic.AddInt64(&counter, 1))
+			storage.Push(key, cmd, 60000)
+			storage.Free(key)
+		}
+	})
+}
+
+// push and free with many tasks in flight
+func BenchmarkPushFreeLoaded(b *testing.B) {
+	for _, inFlight := range []int{10000, 100000, 500000} {
+		b.Run(fmt.Sprint(inFlight), func(b *testing.B) {
+			storage := benchStorage(b)
+			cmd := transport.NewCommand("bench")
+			for _, key := range benchKeys(inFlight) {
+				storage.Push(key, cmd, 60000)
+			}
+			keys := benchKeys(b.N)
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				key := "new-" + keys[index]
+				storage.Push(key, cmd, 60000)
+				storage.Free(key)
+			}
+		})
+	}
+}
+
+// expiry of commands with passed deadline
+func BenchmarkExpire(b *testing.B) {
+	var returned int64
+	storage := cmdexecstorage.NewCmdExecStorage(func(cmd *transport.Command, task string) {
+		atomic.AddInt64(&returned, 1)
+	}, 1)
+	b.Cleanup(storage.ForceStop)
+	cmd := transport.NewCommand("bench")
+	keys := benchKeys(b.N)
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		storage.Push(keys[index], cmd, 0)
+	}
+	for atomic.LoadInt64(&returned) < int64(b.N) {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"squ/transport"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -78,7 +79,7 @@ func TestCmdExecStorageSimpleCmdReturn(t *testing.T) {
 			t.Error("Unknown command returned!")
 		}
 	}
-	storage := cmdexecstorage.NewCmdExecStorage(backHandler, true, 0)
+	storage := cmdexecstorage.NewCmdExecStorage(backHandler, 0)
 	t.Logf("Storage %p run.", storage)
 	time.Sleep(500 * time.Millisecond)
 	cmd := transport.NewCommand("test_1")
@@ -90,10 +91,10 @@ func TestCmdExecStorageSimpleCmdReturn(t *testing.T) {
 }
 
 func TestCmdExecStorageAsyncCmdReturn(t *testing.T) {
-	var returned int
+	var returned int32
 	backHandler := func(cmd *transport.Command, task string) {
 		if fmt.Sprintf("%p", cmd) == (*cmd).Params {
-			returned++
+			atomic.AddInt32(&returned, 1)
 		}
 	}
 	fillMethod := func(timeout int, count int, stor *cmdexecstorage.CmdExecStorage) {
@@ -106,7 +107,7 @@ func TestCmdExecStorageAsyncCmdReturn(t *testing.T) {
 			stor.Push(id, cmd, timeout)
 		}
 	}
-	storage := cmdexecstorage.NewCmdExecStorage(backHandler, true, 0)
+	storage := cmdexecstorage.NewCmdExecStorage(backHandler, 0)
 	groupSize := 100
 	groupCount := 3
 	t.Logf("Storage %p run.", storage)
@@ -117,8 +118,8 @@ func TestCmdExecStorageAsyncCmdReturn(t *testing.T) {
 		time.Sleep(5 * time.Millisecond)
 	}
 	time.Sleep(time.Duration((groupCount+1)*300) * time.Millisecond)
-	t.Logf("Returned: %d", returned)
-	if groupSize*groupCount != returned {
+	t.Logf("Returned: %d", atomic.LoadInt32(&returned))
+	if groupSize*groupCount != int(atomic.LoadInt32(&returned)) {
 		t.Error("Error with returned command.")
 	}
 	if storage.Volume() > 0 {
@@ -128,12 +129,12 @@ func TestCmdExecStorageAsyncCmdReturn(t *testing.T) {
 }
 
 func TestCmdExecStorageAsyncCmdFree(t *testing.T) {
-	var returned int
-	var free int
+	var returned int32
+	var free int32
 
 	backHandler := func(cmd *transport.Command, task string) {
 		if fmt.Sprintf("%p", cmd) == (*cmd).Params {
-			returned++
+			atomic.AddInt32(&returned, 1)
 		}
 	}
 
@@ -165,12 +166,12 @@ func TestCmdExecStorageAsyncCmdFree(t *testing.T) {
 				break
 			} else {
 				if stor.Free(id) {
-					free++
+					atomic.AddInt32(&free, 1)
 				}
 			}
 		}
 	}
-	storage := cmdexecstorage.NewCmdExecStorage(backHandler, true)
+	storage := cmdexecstorage.NewCmdExecStorage(backHandler, 0)
 	groupSize := 100
 	groupCount := 3
 	t.Logf("Storage %p run.", storage)
@@ -183,8 +184,10 @@ func TestCmdExecStorageAsyncCmdFree(t *testing.T) {
 		time.Sleep(5 * time.Millisecond)
 	}
 	time.Sleep(time.Duration((groupCount+1)*300) * time.Millisecond)
-	t.Logf("Returned: %d Free: %d", returned, free)
-	if groupSize*groupCount != returned+free {
+	done := int(atomic.LoadInt32(&returned))
+	freed := int(atomic.LoadInt32(&free))
+	t.Logf("Returned: %d Free: %d", done, freed)
+	if groupSize*groupCount != done+freed {
 		t.Error("Error with returned/free command.")
 	}
 	if storage.Volume() > 0 {
@@ -192,3 +195,60 @@ func TestCmdExecStorageAsyncCmdFree(t *testing.T) {
 	}
 	storage.ForceStop()
 }
+
+func TestShardIndexOfAnyKey(t *testing.T) {
+	storage := cmdexecstorage.NewShardedCmdExecStorage(
+		func(cmd *transport.Command, task string) {}, 0, 16)
+	defer storage.ForceStop()
+	if storage.ShardCount() != 16 {
+		t.Fatalf("incorrect shard count %d", storage.ShardCount())
+	}
+	used := make(map[int]int)
+	for index := 0; index < 1600; index++ {
+		// caller-defined ids, not hex
+		key := fmt.Sprintf("order:%d", index)
+		used[storage.ShardIndex(key)]++
+		if !storage.Push(key, transport.NewCommand("test"), 60000) {
+			t.Fatal("push error")
+		}
+	}
+	if len(used) != 16 {
+		t.Errorf("keys in %d shards only", len(used))
+	}
+	for shard, count := range used {
+		if count < 50 || count > 150 {
+			t.Errorf("shard %d has %d keys", shard, count)
+		}
+	}
+	if storage.Volume() != 1600 || !storage.Free("order:7") || storage.Free("order:7") {
+		t.Errorf("incorrect volume %d or free", storage.Volume())
+	}
+}
+
+func TestDeadlinePrecision(t *testing.T) {
+	returned := make(chan time.Time, 2)
+	// expiry check period is much longer than time limits
+	storage := cmdexecstorage.NewCmdExecStorage(func(cmd *transport.Command, task string) {
+		returned <- time.Now()
+	}, 500)
+	defer storage.ForceStop()
+	start := time.Now()
+	storage.Push("late", transport.NewCommand("test"), 300)
+	storage.Push("early", transport.NewCommand("test"), 30)
+	// replaced deadline
+	storage.Push("late", transport.NewCommand("test"), 100)
+	for _, limit := range []time.Duration{30, 100} {
+		select {
+		case at := <-returned:
+			delay := at.Sub(start)
+			if delay < limit*time.Millisecond || delay > (limit+50)*time.Millisecond {
+				t.Errorf("command with limit %d ms returned after %s", limit, delay)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("command with limit %d ms is not returned", limit)
+		}
+	}
+	if storage.Volume() != 0 {
+		t.Errorf("storage is not empty: %d", storage.Volume())
+	}
+}
@@ -2,19 +2,33 @@ package commonserver
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"os/user"
 	"squ/cmdexecstorage"
+	"squ/helpers"
 	"squ/logger"
+	"squ/resultstore"
+	"squ/scheduler"
+	"squ/spillqueue"
+	"squ/stats"
+	"squ/tracing"
 	"squ/transport"
+	"squ/websocket"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	NetExecuter = iota
 	NetRecеiver
+	NetAdmin
 )
 
 const (
@@ -22,15 +36,60 @@ const (
 	AnswerCodeFormatError = 1
 	AnswerInternalError   = 2
 	AnswerAccessError     = 3
+	AnswerUnknownTask     = 4
+	AnswerTimeoutError    = 5
+	AnswerQueueFull       = 6
+	AnswerTaskNotDone     = 7
+	AnswerNoExecuters     = 8
+	AnswerQuorumError     = 9
 	//
 	PauseGetCmd              = 100 // ms
 	execRequestChannelVolume = 1024 * 10
+	DefaultQueueSize         = execRequestChannelVolume
+	//
+	DefaultBufferSize      = 1024
+	DefaultKeepAlivePeriod = 60 // sec.
+	DefaultMaxMessageSize  = 1024 * 1024 * 16
+	//
+	DefaultUnixSocketMode  = 0660
+	DefaultWebSocketUrl    = "/"
+	DefaultHttpWaitTimeout = 30 // sec.
+)
+
+// socket protocols
+const (
+	ProtocolLine      = "line"
+	ProtocolWebSocket = "websocket"
+	ProtocolHttp      = "http"
+)
+
+// socket networks
+const (
+	NetworkTCP  = "tcp"
+	NetworkUnix = "unix"
 )
 
 type SocketTarget struct {
-	Post int    `json:"port"`
-	Addr string `json:"addr"`
-	Type int    `json:"type"`
+	Post     int    `json:"port"`
+	Addr     string `json:"addr"`
+	Type     int    `json:"type"`
+	Network  string `json:"network"`
+	Protocol string `json:"protocol"`
+	// url path for websocket and http
+	Url string `json:"url"`
+	// http answer wait (sec.)
+	WaitTimeout float64 `json:"wait_timeout"`
+	// origins of browser websocket clients, "*" for any, same host if empty
+	AllowedOrigins []string `json:"allowed_origins"`
+	// unix socket options
+	Path  string `json:"path"`
+	Mode  string `json:"mode"`
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+	// connection options, common values from settings if 0
+	BufferSize      int `json:"buffer_size"`
+	KeepAlivePeriod int `json:"keep_alive_period"`
+	MaxMessageSize  int `json:"max_message_size"`
 }
 
 type ServiceCloser interface {
@@ -38,13 +97,179 @@ type ServiceCloser interface {
 }
 
 type ConnectionOptions struct {
-	BufferSize int
+	BufferSize      int
+	KeepAlivePeriod int // sec.
+	MaxMessageSize  int
+}
+
+// Options with default values for empty fields
+func (options ConnectionOptions) WithDefaults(defaults ConnectionOptions) ConnectionOptions {
+	if options.BufferSize <= 0 {
+		options.BufferSize = defaults.BufferSize
+	}
+	if options.KeepAlivePeriod <= 0 {
+		options.KeepAlivePeriod = defaults.KeepAlivePeriod
+	}
+	if options.MaxMessageSize <= 0 {
+		options.MaxMessageSize = defaults.MaxMessageSize
+	}
+	return options
+}
+
+// Options of socket connections, common values for empty fields
+func (target *SocketTarget) GetConnectionOptions(common ConnectionOptions) ConnectionOptions {
+	options := ConnectionOptions{
+		BufferSize:      target.BufferSize,
+		KeepAlivePeriod: target.KeepAlivePeriod,
+		MaxMessageSize:  target.MaxMessageSize}
+	return options.WithDefaults(common).WithDefaults(ConnectionOptions{
+		BufferSize:      DefaultBufferSize,
+		KeepAlivePeriod: DefaultKeepAlivePeriod,
+		MaxMessageSize:  DefaultMaxMessageSize})
+}
+
+// Network name for net.Listen ("tcp" by default)
+func (target *SocketTarget) GetNetwork() string {
+	if target.Network == "" {
+		return NetworkTCP
+	}
+	return target.Network
+}
+
+// Protocol over socket ("line" by default)
+func (target *SocketTarget) GetProtocol() string {
+	if target.Protocol == "" {
+		return ProtocolLine
+	}
+	return target.Protocol
+}
+
+func (target *SocketTarget) GetUrl() string {
+	if target.Url == "" {
+		return DefaultWebSocketUrl
+	}
+	return target.Url
+}
+
+// Wait of executer answer for http requests
+func (target *SocketTarget) GetWaitTimeout() time.Duration {
+	timeout := target.WaitTimeout
+	if timeout <= 0 {
+		timeout = DefaultHttpWaitTimeout
+	}
+	return time.Duration(timeout * float64(time.Second))
+}
+
+// List of settings problems for socket
+func (target *SocketTarget) Validate() []string {
+	var problems []string
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+	if target.Type != NetExecuter && target.Type != NetRecеiver && target.Type != NetAdmin {
+		add("unknown socket type %d", target.Type)
+	}
+	switch target.GetNetwork() {
+	case NetworkTCP:
+		{
+			if target.Post <= 0 || target.Post > 0xffff {
+				add("incorrect port %d", target.Post)
+			}
+		}
+	case NetworkUnix:
+		{
+			if target.Path == "" {
+				add("empty path of unix socket")
+			}
+			if _, err := target.GetFileMode(); err != nil {
+				add("%s", err)
+			}
+			if _, _, err := target.GetOwnerIds(); err != nil {
+				add("%s", err)
+			}
+		}
+	default:
+		add("unknown network '%s'", target.Network)
+	}
+	switch target.GetProtocol() {
+	case ProtocolLine, ProtocolWebSocket:
+	case ProtocolHttp:
+		{
+			if target.Type == NetExecuter {
+				add("http protocol is not supported for executer")
+			}
+		}
+	default:
+		add("unknown protocol '%s'", target.Protocol)
+	}
+	if len(target.AllowedOrigins) > 0 && target.GetProtocol() != ProtocolWebSocket {
+		add("allowed_origins for websocket protocol only")
+	}
+	if target.WaitTimeout < 0 {
+		add("negative wait_timeout")
+	}
+	if target.BufferSize < 0 || target.KeepAlivePeriod < 0 || target.MaxMessageSize < 0 {
+		add("negative connection option")
+	}
+	return problems
+}
+
+func (target *SocketTarget) IsUnix() bool {
+	return target.GetNetwork() == NetworkUnix
 }
 
 func (target *SocketTarget) GetSocket() string {
+	if target.IsUnix() {
+		return target.Path
+	}
 	return fmt.Sprintf("%s:%d", target.Addr, target.Post)
 }
 
+// File mode for unix socket (octal string in settings, "0660" by default)
+func (target *SocketTarget) GetFileMode() (os.FileMode, error) {
+	if target.Mode == "" {
+		return os.FileMode(DefaultUnixSocketMode), nil
+	}
+	var mode uint32
+	if _, err := fmt.Sscanf(target.Mode, "%o", &mode); err != nil {
+		return 0, fmt.Errorf("incorrect socket mode '%s': %s", target.Mode, err)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Owner uid and group gid for unix socket, -1 if not changed
+func (target *SocketTarget) GetOwnerIds() (int, int, error) {
+	uid, gid := -1, -1
+	if target.Owner != "" {
+		owner, err := user.Lookup(target.Owner)
+		if err != nil {
+			if owner, err = user.LookupId(target.Owner); err != nil {
+				return uid, gid, fmt.Errorf("unknown socket owner '%s'", target.Owner)
+			}
+		}
+		if uid, err = strconv.Atoi(owner.Uid); err != nil {
+			return -1, gid, fmt.Errorf("incorrect uid '%s' of socket owner '%s'", owner.Uid, target.Owner)
+		}
+	}
+	if target.Group != "" {
+		group, err := user.LookupGroup(target.Group)
+		if err != nil {
+			if group, err = user.LookupGroupId(target.Group); err != nil {
+				return uid, gid, fmt.Errorf("unknown socket group '%s'", target.Group)
+			}
+		}
+		if gid, err = strconv.Atoi(group.Gid); err != nil {
+			return uid, -1, fmt.Errorf("incorrect gid '%s' of socket group '%s'", group.Gid, target.Group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// Network and address, the same for one socket with different options
+func (target *SocketTarget) GetAddress() string {
+	return fmt.Sprintf("%s %s", target.GetNetwork(), target.GetSocket())
+}
+
 func (target SocketTarget) String() string {
 	return target.GetSocket()
 }
@@ -55,6 +280,8 @@ func (target *SocketTarget) GetTypeName() string {
 		return "receiver"
 	case NetExecuter:
 		return "executer"
+	case NetAdmin:
+		return "admin"
 	default:
 		return fmt.Sprintf("unknown type %d", target.Type)
 	}
@@ -66,8 +293,6 @@ type MethodMap struct {
 	changeLock *sync.RWMutex
 }
 
-var onceMethodMap *MethodMap
-
 func (methods *MethodMap) Exists(method string) bool {
 	methods.changeLock.RLock()
 	defer methods.changeLock.RUnlock()
@@ -108,56 +333,592 @@ func (methods *MethodMap) Delete(method string) {
 }
 
 func NewMethodMap() *MethodMap {
-	if onceMethodMap == nil {
-		methods := MethodMap{
-			storage:    make(map[string]int),
-			changeLock: new(sync.RWMutex)}
-		onceMethodMap = &methods
-	}
-	return onceMethodMap
+	methods := MethodMap{
+		storage:    make(map[string]int),
+		changeLock: new(sync.RWMutex)}
+	return &methods
 }
 
 type DataStreamManager struct {
-	execRequestChannel *chan transport.Command
-	returnedCmdChannel *chan transport.Command
+	execRequestChannel *chan transport.TaskCommand
+	// puts to queue are stopped while "drop_oldest" reorders it
+	queueLock          sync.RWMutex
+	returnedCmdChannel *chan transport.TaskCommand
 	PutBackHandler     cmdexecstorage.ReturnCommandHandler
+	waiters            map[string][]chan transport.Answer
+	waitersLock        *sync.Mutex
+	rand               *helpers.SysRandom
+	storage            *cmdexecstorage.CmdExecStorage
+	pauseGetCmd        int64 // ns, atomic
+	tracer             *tracing.Tracer
+	stats              *stats.Collector
+	scheduler          *scheduler.Scheduler
+	dedup              *dedupWindow
+	results            *resultstore.Store
+	fanout             *fanoutState
+	// commands over queue size for "spill" policy
+	overflow        *overflowQueue
+	overflowOptions atomic.Value
+	// debug methods are available
+	Debug bool
 }
 
-func (manager DataStreamManager) AddCommand(cmd *transport.Command) {
-	*(manager.execRequestChannel) <- *cmd
+// Tracer of task stages, nil if tracing is off
+func (manager *DataStreamManager) SetTracer(tracer *tracing.Tracer) {
+	manager.tracer = tracer
 }
 
-func (manager *DataStreamManager) GetExecCmd() (bool, *transport.Command) {
-	// TODO: priority and suppotred methods
+func (manager *DataStreamManager) Tracer() *tracing.Tracer {
+	return manager.tracer
+}
+
+// Statistics of methods
+func (manager *DataStreamManager) Stats() *stats.Collector {
+	return manager.stats
+}
+
+// Statuses and results of tasks for queries of receivers, nil if it's off
+func (manager *DataStreamManager) SetResultStore(store *resultstore.Store) {
+	manager.results = store
+}
+
+func (manager *DataStreamManager) ResultStore() *resultstore.Store {
+	return manager.results
+}
+
+// Change overflow policies of methods
+func (manager *DataStreamManager) SetOverflowOptions(options OverflowOptions) {
+	manager.overflowOptions.Store(options.clone())
+}
+
+func (manager *DataStreamManager) OverflowOptions() OverflowOptions {
+	return manager.overflowOptions.Load().(OverflowOptions).clone()
+}
+
+// put command to queue without wait, "false" if queue is full
+func (manager *DataStreamManager) tryPut(cmd transport.TaskCommand) bool {
+	manager.queueLock.RLock()
+	defer manager.queueLock.RUnlock()
+	return manager.putLocked(cmd)
+}
+
+// lock of queue must be taken
+func (manager *DataStreamManager) putLocked(cmd transport.TaskCommand) bool {
+	select {
+	case *(manager.execRequestChannel) <- cmd:
+		return true
+	default:
+		return false
+	}
+}
+
+// remove oldest command of the same method from full queue and put new one,
+// "false" if there is no command of method in queue
+func (manager *DataStreamManager) dropOldest(cmd transport.TaskCommand) bool {
+	manager.queueLock.Lock()
+	if manager.putLocked(cmd) {
+		manager.queueLock.Unlock()
+		return true
+	}
+	queue := *(manager.execRequestChannel)
+	count := len(queue)
+	kept := make([]transport.TaskCommand, 0, count)
+	var old *transport.TaskCommand
+	// commands can be taken by executers at the same time
+	for taken := true; taken && len(kept) < count; {
+		select {
+		case item := <-queue:
+			if old == nil && item.Method == cmd.Method {
+				old = &item
+				count--
+			} else {
+				kept = append(kept, item)
+			}
+		default:
+			taken = false
+		}
+	}
+	// other puts are stopped, place of taken commands is free
+	for _, item := range kept {
+		queue <- item
+	}
+	queued := old != nil
+	if queued {
+		queue <- cmd
+	} else {
+		queued = manager.putLocked(cmd)
+	}
+	manager.queueLock.Unlock()
+	if old == nil {
+		return queued
+	}
+	manager.stats.TaskDropped(old.Task)
+	manager.tracer.TaskResult(old.Task, "dropped from full queue")
+	TaskLog(old.Task, &old.Command).Warn("Task dropped from full queue")
+	manager.deadLetter(old.Task, transport.NewErrorAnswer(
+		old.Id, AnswerQueueFull, "Task dropped from full queue."))
+	return true
+}
+
+// put command to overflow queue, "false" if disk part isn't available
+func (manager *DataStreamManager) spill(cmd transport.TaskCommand) bool {
+	if err := manager.overflow.push(cmd, false); err != nil {
+		TaskLog(cmd.Task, &cmd.Command).Error("Can't spill task: %s", err)
+		return false
+	}
+	manager.stats.TaskSpilled(cmd.Task)
+	return true
+}
+
+// end of task rejected by full queue
+func (manager *DataStreamManager) reject(cmd *transport.Command, task string, reason string) error {
+	manager.stats.TaskRejected(task)
+	manager.tracer.TaskResult(task, ErrQueueFull.Error())
+	manager.tracer.TaskDone(task, false)
+	TaskLog(task, cmd).Warn("Task rejected by full queue (%s)", reason)
+	return ErrQueueFull
+}
+
+// put command to queue with trace of enqueue, full queue is processed by overflow policy,
+// routed and selected commands are put to queues of executers without overflow policies
+func (manager *DataStreamManager) enqueue(cmd *transport.Command, task string) error {
+	if cmd.IsFanout() {
+		return manager.broadcast(cmd, task)
+	} else if cmd.RoutingKey != "" {
+		return manager.route(cmd, task)
+	} else if len(cmd.Selector) > 0 {
+		return manager.queueSelected(cmd, task)
+	}
+	taskCmd := transport.TaskCommand{Command: *cmd, Task: task}
+	policy := manager.overflowOptions.Load().(OverflowOptions).GetPolicy(cmd.Method)
+	manager.tracer.TaskEnqueue(task, cmd.Method, cmd.Traceparent)
+	manager.stats.TaskEnqueued(task, cmd.Method)
+	// spilled commands are before new ones
+	queued := policy == OverflowSpill && manager.overflow.length() > 0
+	if queued {
+		queued = manager.spill(taskCmd)
+	} else if queued = manager.tryPut(taskCmd); !queued {
+		manager.stats.QueueFull(cmd.Method)
+		switch policy {
+		case OverflowDropOldest:
+			queued = manager.dropOldest(taskCmd)
+		case OverflowSpill:
+			queued = manager.spill(taskCmd)
+		}
+	}
+	if !queued {
+		return manager.reject(cmd, task, fmt.Sprintf("policy %s", policy))
+	}
+	manager.tracer.TaskEnqueued(task)
+	return nil
+}
+
+// Holder of delayed commands, they are put to queue without it
+func (manager *DataStreamManager) SetScheduler(scheduler *scheduler.Scheduler) {
+	manager.scheduler = scheduler
+}
+
+func (manager *DataStreamManager) Scheduler() *scheduler.Scheduler {
+	return manager.scheduler
+}
+
+// Put delayed command to queue at due time, it's ReleaseHandler of scheduler
+func (manager *DataStreamManager) Release(cmd *transport.Command, task string) {
+	TaskLog(task, cmd).Debug("Delayed task is released")
+	if err := manager.enqueue(cmd, task); err != nil {
+		manager.deadLetter(task, NewEnqueueErrorAnswer(cmd.Id, err))
+	}
+}
+
+// Delayed command without active scheduler, it isn't executed before due time
+var ErrNotScheduled = errors.New("scheduler is stopped")
+
+// put command to queue or to scheduler if it's delayed
+func (manager *DataStreamManager) submit(cmd *transport.Command, task string) error {
+	due, err := cmd.GetNotBefore(time.Now())
+	if err != nil {
+		return err
+	}
+	ready := *cmd
+	ready.Delay, ready.NotBefore = 0, ""
+	manager.results.Queued(task, cmd.Method)
+	if due.IsZero() {
+		return manager.enqueue(&ready, task)
+	}
+	// delayed command is never executed before due time
+	if manager.scheduler == nil || !manager.scheduler.Schedule(&ready, task, due) {
+		return ErrNotScheduled
+	}
+	TaskLog(task, cmd).Debug("Task is delayed until %s", due.Format(time.RFC3339Nano))
+	return nil
+}
+
+// Segment files for commands of overflow queue over memory limits
+func (manager *DataStreamManager) SetSpillQueue(
+	queue *spillqueue.SegmentQueue, options spillqueue.Options) error {
+	//
+	return manager.overflow.setDisk(queue, options)
+}
+
+// Remove segment files, spilled commands are lost
+func (manager *DataStreamManager) CloseSpillQueue() error {
+	return manager.overflow.setDisk(nil, spillqueue.Options{})
+}
+
+// Count of commands in segment files
+func (manager *DataStreamManager) SpilledLength() int {
+	return manager.overflow.diskLength()
+}
+
+// dead letters for spilled commands which can't be read from segment files
+func (manager *DataStreamManager) spillLost(tasks []spilledTask) {
+	for _, lost := range tasks {
+		TaskLog(lost.task, nil).Error("Spilled task is lost")
+		manager.deadLetter(lost.task, transport.NewErrorAnswer(
+			lost.id, AnswerInternalError, "Spilled task is lost."))
+	}
+}
+
+// Storage of executed commands, it's created by server with PutBackHandler
+func (manager *DataStreamManager) SetStorage(storage *cmdexecstorage.CmdExecStorage) {
+	manager.storage = storage
+}
+
+func (manager *DataStreamManager) Storage() *cmdexecstorage.CmdExecStorage {
+	return manager.storage
+}
+
+// New task uid
+func (manager *DataStreamManager) Uid() string {
+	return manager.rand.Uid()
+}
+
+// Change window of idempotency keys (sec.)
+func (manager *DataStreamManager) SetDedupWindow(window int) {
+	manager.dedup.setWindow(window)
+}
+
+// lock of waiters must be taken
+func (manager *DataStreamManager) removeWaiter(task string, resultChannel chan transport.Answer) {
+	channels := manager.waiters[task]
+	for index, value := range channels {
+		if value == resultChannel {
+			channels = append(channels[:index], channels[index+1:]...)
+			break
+		}
+	}
+	if len(channels) == 0 {
+		delete(manager.waiters, task)
+	} else {
+		manager.waiters[task] = channels
+	}
+}
+
+func (manager *DataStreamManager) logDuplicate(cmd *transport.Command, task string) {
+	manager.stats.TaskDuplicate(cmd.Method)
+	TaskLog(task, cmd).Info("Duplicate of task with idempotency key %s", cmd.IdempotencyKey)
+}
+
+// key of failed task is free, waiters of duplicates get error
+func (manager *DataStreamManager) failSubmit(cmd *transport.Command, task string, err error) {
+	manager.dedup.forget(task)
+	manager.results.Remove(task)
+	manager.waitersLock.Lock()
+	_, exists := manager.waiters[task]
+	manager.waitersLock.Unlock()
+	if exists {
+		manager.PutResult(task, NewEnqueueErrorAnswer(cmd.Id, err))
+	}
+}
+
+// Answer for command which isn't added to queue, code by error of enqueue
+func NewEnqueueErrorAnswer(id int, err error) *transport.Answer {
+	switch err {
+	case ErrQueueFull:
+		return transport.NewErrorAnswer(id, AnswerQueueFull, "Queue full.")
+	case ErrNoExecuters:
+		return transport.NewErrorAnswer(id, AnswerNoExecuters, "No executers for method.")
+	case ErrNotScheduled:
+		return transport.NewErrorAnswer(id, AnswerInternalError, "Delayed command is not accepted, scheduler is stopped.")
+	default:
+		return transport.NewErrorAnswer(id, AnswerCodeFormatError, fmt.Sprintf("Incorrect command: %s.", err))
+	}
+}
+
+// Add command to queue (or to scheduler) with new task id,
+// ErrQueueFull if it's rejected, ErrNoExecuters for broadcast or error of delay format.
+// Task of the same idempotency key in window is returned without enqueue.
+func (manager *DataStreamManager) AddCommand(cmd *transport.Command) (string, error) {
+	task, _, duplicate := manager.dedup.claim(cmd.IdempotencyKey, manager.Uid(), time.Now())
+	if duplicate {
+		manager.logDuplicate(cmd, task)
+		return task, nil
+	}
+	err := manager.submit(cmd, task)
+	if err != nil {
+		manager.failSubmit(cmd, task, err)
+	}
+	return task, err
+}
+
+// Add command to queue (or to scheduler) and wait result in channel, errors as AddCommand.
+// Duplicate of idempotency key waits result of first task (or gets stored result).
+func (manager *DataStreamManager) AddWaitCommand(
+	cmd *transport.Command) (string, chan transport.Answer, error) {
+	//
+	resultChannel := make(chan transport.Answer, 1)
+	manager.waitersLock.Lock()
+	task, answer, duplicate := manager.dedup.claim(cmd.IdempotencyKey, manager.Uid(), time.Now())
+	if answer != nil {
+		resultChannel <- *answer
+	} else {
+		manager.waiters[task] = append(manager.waiters[task], resultChannel)
+	}
+	manager.waitersLock.Unlock()
+	if duplicate {
+		manager.logDuplicate(cmd, task)
+		return task, resultChannel, nil
+	}
+	if err := manager.submit(cmd, task); err != nil {
+		manager.waitersLock.Lock()
+		manager.removeWaiter(task, resultChannel)
+		manager.waitersLock.Unlock()
+		manager.failSubmit(cmd, task, err)
+		return task, nil, err
+	}
+	return task, resultChannel, nil
+}
+
+// Wait result of task, "false" if timeout (waiter will be removed)
+func (manager *DataStreamManager) WaitResult(
+	task string,
+	resultChannel chan transport.Answer,
+	timeout time.Duration) (*transport.Answer, bool) {
+	//
+	return manager.WaitResultContext(context.Background(), task, resultChannel, timeout)
+}
+
+// Wait of result until timeout or cancel of context (e.g. disconnect of http client),
+// waiter is removed without result
+func (manager *DataStreamManager) WaitResultContext(
+	ctx context.Context,
+	task string,
+	resultChannel chan transport.Answer,
+	timeout time.Duration) (*transport.Answer, bool) {
+	//
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case answer := <-resultChannel:
+		return &answer, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	manager.waitersLock.Lock()
+	manager.removeWaiter(task, resultChannel)
+	manager.waitersLock.Unlock()
+	// result can be here already
+	select {
+	case answer := <-resultChannel:
+		return &answer, true
+	default:
+		return nil, false
+	}
+}
+
+// final status of task by answer of executer
+func resultStatus(answer *transport.Answer) string {
+	if answer.Error.Exists() {
+		return resultstore.StatusFailed
+	}
+	return resultstore.StatusDone
+}
+
+// Send result to waiters of task, "false" if nobody waits.
+// Result is kept for duplicates of idempotency key and in result store with final status.
+func (manager *DataStreamManager) PutResult(task string, answer *transport.Answer) bool {
+	return manager.putResult(task, answer, false)
+}
+
+// task isn't executed because of full queue, it's dead letter without result for duplicates
+func (manager *DataStreamManager) deadLetter(task string, answer *transport.Answer) bool {
+	return manager.putResult(task, answer, true)
+}
+
+func (manager *DataStreamManager) putResult(task string, answer *transport.Answer, deadLettered bool) bool {
+	if manager.putSubResult(task, answer) {
+		return true
+	}
+	manager.waitersLock.Lock()
+	channels, exists := manager.waiters[task]
+	if exists {
+		delete(manager.waiters, task)
+	}
+	status := resultstore.StatusDeadLettered
+	if deadLettered {
+		manager.dedup.forget(task)
+	} else {
+		manager.dedup.setResult(task, answer)
+		status = resultStatus(answer)
+	}
+	manager.waitersLock.Unlock()
+	manager.results.Finish(task, status, answer)
+	for _, resultChannel := range channels {
+		resultChannel <- *answer
+	}
+	manager.tracer.TaskDone(task, exists)
+	return exists
+}
+
+// Change wait of "execute" without commands (ms.)
+func (manager *DataStreamManager) SetPauseGetCmd(pause int) {
+	if pause <= 0 {
+		pause = PauseGetCmd
+	}
+	atomic.StoreInt64(&manager.pauseGetCmd, int64(time.Millisecond*time.Duration(pause)))
+}
+
+// Count of commands in queues
+func (manager *DataStreamManager) QueueLength() int {
+	return len(*manager.execRequestChannel) + len(*manager.returnedCmdChannel) +
+		manager.overflow.length()
+}
+
+func (manager *DataStreamManager) dequeued(cmd *transport.TaskCommand) *transport.TaskCommand {
+	manager.tracer.TaskDequeued(cmd.Task)
+	manager.stats.TaskDispatched(cmd.Task)
+	manager.results.Dispatched(cmd.Task)
+	return cmd
+}
+
+// command without wait: returned, then queue, then overflow (it's newer than queue)
+func (manager *DataStreamManager) takeCmd() (*transport.TaskCommand, bool) {
 	select {
 	case cmd := <-*(manager.returnedCmdChannel):
-		return false, &cmd
+		return &cmd, true
+	default:
+	}
+	select {
 	case cmd := <-*(manager.execRequestChannel):
-		return false, &cmd
-	case <-time.After(time.Millisecond * PauseGetCmd):
-		return true, nil
+		return &cmd, true
+	default:
+	}
+	return manager.overflow.pop()
+}
+
+func (manager *DataStreamManager) GetExecCmd() (bool, *transport.TaskCommand) {
+	return manager.GetNodeExecCmd("")
+}
+
+// Command for executer connection: own fan-out commands first, then common queue
+func (manager *DataStreamManager) GetNodeExecCmd(node string) (bool, *transport.TaskCommand) {
+	// TODO: priority and suppotred methods
+	if cmd, ok := manager.takeNodeCmd(node); ok {
+		return false, cmd
+	}
+	if cmd, ok := manager.takeCmd(); ok {
+		return false, manager.dequeued(cmd)
 	}
+	// nil channel for connection without methods
+	notify := manager.nodeNotify(node)
+	timer := time.NewTimer(time.Duration(atomic.LoadInt64(&manager.pauseGetCmd)))
+	defer timer.Stop()
+	for {
+		select {
+		case cmd := <-*(manager.returnedCmdChannel):
+			return false, manager.dequeued(&cmd)
+		case cmd := <-*(manager.execRequestChannel):
+			return false, manager.dequeued(&cmd)
+		case <-manager.overflow.notify:
+			if cmd, ok := manager.overflow.pop(); ok {
+				return false, manager.dequeued(cmd)
+			}
+		case <-notify:
+			if cmd, ok := manager.takeNodeCmd(node); ok {
+				return false, cmd
+			}
+		case <-timer.C:
+			return true, nil
+		}
+	}
+}
+
+// Options of command streams, defaults for empty values
+type StreamOptions struct {
+	// debug methods are available
+	Debug       bool
+	QueueSize   int
+	PauseGetCmd int // ms
+	Overflow    OverflowOptions
+	// window of idempotency keys (sec.)
+	DedupWindow int
 }
 
-func NewDataStreamManager() *DataStreamManager {
-	backChannel := make(chan transport.Command, execRequestChannelVolume)
+// Log entry with task uid and command fields, for correlation of task records
+func TaskLog(task string, cmd *transport.Command) *logger.Entry {
+	fields := logger.Fields{logger.FieldTask: task}
+	if cmd != nil {
+		fields[logger.FieldMethod] = cmd.Method
+		fields[logger.FieldCommand] = cmd.Id
+	}
+	return logger.With(fields)
+}
 
+func NewDataStreamManager(options StreamOptions) *DataStreamManager {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultQueueSize
+	}
+	if options.PauseGetCmd <= 0 {
+		options.PauseGetCmd = PauseGetCmd
+	}
+	backChannel := make(chan transport.TaskCommand, options.QueueSize)
+	var manager *DataStreamManager
+	// it's called by storage goroutine and never blocks
 	backHandler := func(cmd *transport.Command, task string) {
-		backChannel <- (*cmd)
-		logger.Warn("Task %s returned with timeout, cmd: %s", task, cmd.String())
+		if manager.returnSubTask(cmd, task) {
+			TaskLog(task, cmd).Warn("Sub-task returned with timeout to executer queue")
+			return
+		}
+		manager.tracer.TaskReturned(task)
+		manager.stats.TaskReturned(task)
+		manager.results.TimedOut(task)
+		taskCmd := transport.TaskCommand{Command: *cmd, Task: task}
+		if cmd.RoutingKey != "" || len(cmd.Selector) > 0 {
+			// to current owner of key or to matching executers
+			manager.fanout.routeReturned(taskCmd)
+		} else {
+			select {
+			case backChannel <- taskCmd:
+			default:
+				manager.stats.QueueFull(cmd.Method)
+				manager.stats.TaskSpilled(task)
+				manager.overflow.push(taskCmd, true)
+			}
+		}
+		TaskLog(task, cmd).Warn("Task returned with timeout, cmd: %s", cmd.String())
 	}
 
-	ch1 := make(chan transport.Command, execRequestChannelVolume)
-	manager := DataStreamManager{
+	ch1 := make(chan transport.TaskCommand, options.QueueSize)
+	manager = &DataStreamManager{
 		execRequestChannel: &ch1,
 		returnedCmdChannel: &backChannel,
-		PutBackHandler:     backHandler}
-	return &manager
+		PutBackHandler:     backHandler,
+		waiters:            make(map[string][]chan transport.Answer),
+		waitersLock:        new(sync.Mutex),
+		rand:               helpers.NewSysRandom(),
+		stats:              stats.NewCollector(),
+		overflow:           newOverflowQueue(options.QueueSize, func(tasks []spilledTask) { manager.spillLost(tasks) }),
+		dedup:              newDedupWindow(options.DedupWindow),
+		fanout:             newFanoutState(),
+		pauseGetCmd:        int64(time.Millisecond * time.Duration(options.PauseGetCmd)),
+		Debug:              options.Debug}
+	manager.SetOverflowOptions(options.Overflow)
+	return manager
 }
 
 // state manage
 type StateProvider struct {
-	updateCount     int
+	updateCount     int64 // atomic
 	availableMethod *MethodMap
 }
 
@@ -169,13 +930,13 @@ type StateUpdater interface {
 
 func (provider *StateProvider) UpdateStateForward(updater StateUpdater) {
 	if updater.Execute(provider) {
-		provider.updateCount++
+		atomic.AddInt64(&provider.updateCount, 1)
 	}
 }
 
 func (provider *StateProvider) UpdateStateBack(updater StateUpdater) {
 	if updater.Rollback(provider) {
-		provider.updateCount++
+		atomic.AddInt64(&provider.updateCount, 1)
 	}
 }
 
@@ -211,43 +972,113 @@ type CmdHandler func(
 	dataStreamManager *DataStreamManager) (
 	*transport.Answer, StateUpdater, bool)
 
+// count of sessions, number makes description of connection unique
+var sessionCount uint64
+
+// connection session: command processing and state changes of one client
+type Session struct {
+	about             string
+	stateProvider     *StateProvider
+	dataStreamManager *DataStreamManager
+	cmdHandler        CmdHandler
+	stateUpdaters     []StateUpdater
+}
+
+func NewSession(
+	about string,
+	stateProvider *StateProvider,
+	dataStreamManager *DataStreamManager,
+	cmdHandler CmdHandler) *Session {
+	//
+	session := Session{
+		about:             fmt.Sprintf("%s #%d", about, atomic.AddUint64(&sessionCount, 1)),
+		stateProvider:     stateProvider,
+		dataStreamManager: dataStreamManager,
+		cmdHandler:        cmdHandler}
+	return &session
+}
+
+// Process one message and return answer data
+func (session *Session) Process(data *[]byte) *[]byte {
+	var sendAnswer *transport.Answer
+	if cmd, err := transport.ParseCommand(data); err == nil {
+		logger.Debug("cmd: %s => %s", session.about, cmd)
+		answer, stateUpdater, hasChanges := session.cmdHandler(
+			session.about, cmd, session.dataStreamManager)
+		sendAnswer = answer
+		if hasChanges {
+			session.stateProvider.UpdateStateForward(stateUpdater)
+			if stateUpdater.HasRollback() {
+				session.stateUpdaters = append(session.stateUpdaters, stateUpdater)
+			}
+		}
+		if sendAnswer == nil {
+			sendAnswer = transport.NewErrorAnswer(
+				cmd.Id, transport.ErrCodeUnknown, "Unsupported method.")
+		}
+	} else {
+		// skip
+		logger.Error("Command parse error: %s", err)
+		sendAnswer = transport.NewErrorAnswer(
+			0, transport.ErrCodeFormat, "Command parse problem.")
+	}
+	return sendAnswer.DataDump()
+}
+
+// Rollback of session state changes
+func (session *Session) Close() {
+	n := len(session.stateUpdaters)
+	if n > 0 {
+		logger.Debug("Back states: %d", n)
+		for i := n - 1; i >= 0; i-- {
+			session.stateProvider.UpdateStateBack(session.stateUpdaters[i])
+		}
+		session.stateUpdaters = nil
+	}
+}
+
+var ErrMessageTooBig = errors.New("message too big")
+
+// read full line (any length up to limit) from buffer
+func readLine(buffer *bufio.Reader, limit int) ([]byte, error) {
+	lineData, isPrefix, err := buffer.ReadLine()
+	if err != nil || !isPrefix {
+		return lineData, err
+	}
+	line := append([]byte(nil), lineData...)
+	for isPrefix {
+		if limit > 0 && len(line) > limit {
+			return nil, ErrMessageTooBig
+		}
+		if lineData, isPrefix, err = buffer.ReadLine(); err != nil {
+			return nil, err
+		}
+		line = append(line, lineData...)
+	}
+	return line, nil
+}
+
 // main net handler
 func NetHandler(
 	about string,
 	stateProvider *StateProvider,
 	dataStreamManager *DataStreamManager,
 	connection net.Conn,
-	cmdHandler CmdHandler) {
+	cmdHandler CmdHandler,
+	options ConnectionOptions) {
 	//
-	buffer := bufio.NewReader(connection)
+	buffer := bufio.NewReaderSize(connection, options.BufferSize)
 	inLoop := true
 	defer connection.Close()
-	var stateUpdaters []StateUpdater
+	session := NewSession(about, stateProvider, dataStreamManager, cmdHandler)
+	defer session.Close()
 	var outVolume uint
 
-	var sendAnswer *transport.Answer
 	for inLoop {
-		lineData, _, err := buffer.ReadLine()
+		lineData, err := readLine(buffer, options.MaxMessageSize)
 		if err == nil {
 			// ok
-			sendAnswer = nil
-			if cmd, err := transport.ParseCommand(&lineData); err == nil {
-				logger.Debug("cmd: %s => %s", about, cmd)
-				answer, stateUpdater, hasChanges := cmdHandler(about, cmd, dataStreamManager)
-				sendAnswer = answer
-				if hasChanges {
-					stateProvider.UpdateStateForward(stateUpdater)
-					if stateUpdater.HasRollback() {
-						stateUpdaters = append(stateUpdaters, stateUpdater)
-					}
-				}
-			} else {
-				// skip
-				logger.Error("Command parse error: %s", err)
-				sendAnswer = transport.NewErrorAnswer(
-					cmd.Id, transport.ErrCodeFormat, "Command parse problem.")
-			}
-			data := sendAnswer.DataDump()
+			data := session.Process(&lineData)
 			line := append(*data, byte('\n'))
 			if writen, err := connection.Write(line); err == nil {
 				outVolume += uint(writen)
@@ -257,15 +1088,46 @@ func NetHandler(
 			if err == io.EOF {
 				// breaken connection
 				logger.Warn("Broken %s", about)
+			} else if err == ErrMessageTooBig {
+				logger.Error("Message from %s is bigger than %d", about, options.MaxMessageSize)
 			}
 		}
 	}
 	logger.Debug("Output data size: %d", outVolume)
-	n := len(stateUpdaters)
-	if n > 0 {
-		logger.Debug("Back states: %d", n)
-		for i := n - 1; i >= 0; i-- {
-			stateProvider.UpdateStateBack(stateUpdaters[i])
+}
+
+// websocket handler, one command per message
+func WebSocketHandler(
+	about string,
+	stateProvider *StateProvider,
+	dataStreamManager *DataStreamManager,
+	connection *websocket.Conn,
+	cmdHandler CmdHandler,
+	options ConnectionOptions) {
+	//
+	connection.MaxSize = options.MaxMessageSize
+	defer connection.Close()
+	session := NewSession(about, stateProvider, dataStreamManager, cmdHandler)
+	defer session.Close()
+	var outVolume uint
+
+	for {
+		messageType, message, err := connection.ReadMessage()
+		if err != nil {
+			if err == io.EOF {
+				logger.Debug("Closed %s", about)
+			} else {
+				logger.Warn("Broken %s: %s", about, err)
+			}
+			break
+		}
+		data := session.Process(&message)
+		if err = connection.WriteMessage(messageType, *data); err == nil {
+			outVolume += uint(len(*data))
+		} else {
+			logger.Warn("Can't send answer to %s: %s", about, err)
+			break
 		}
 	}
+	logger.Debug("Output data size: %d", outVolume)
 }
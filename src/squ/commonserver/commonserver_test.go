@@ -0,0 +1,138 @@
+package commonserver_test
+
+import (
+	"squ/commonserver"
+	"squ/resultstore"
+	"squ/scheduler"
+	"squ/transport"
+	"testing"
+	"time"
+)
+
+func TestDelayedCommand(t *testing.T) {
+	manager := commonserver.NewDataStreamManager(commonserver.StreamOptions{PauseGetCmd: 10})
+	holder := scheduler.NewScheduler(manager.Release)
+	defer holder.Stop()
+	manager.SetScheduler(holder)
+	cmd := transport.Command{Method: "sum", Id: 1, Delay: 0.05}
+	task, resultChannel, err := manager.AddWaitCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout, _ := manager.GetExecCmd(); !timeout || holder.Len() != 1 {
+		t.Fatal("delayed command in queue")
+	}
+	time.Sleep(50 * time.Millisecond)
+	timeout, taskCmd := manager.GetExecCmd()
+	if timeout || taskCmd.Task != task || taskCmd.Delay != 0 {
+		t.Fatalf("no released command")
+	}
+	manager.PutResult(task, transport.NewAnswer(1, "{}"))
+	if _, done := manager.WaitResult(task, resultChannel, time.Millisecond); !done {
+		t.Error("no result of delayed command")
+	}
+	// enqueue error of released command
+	fanout := transport.Command{Method: "sum", Id: 2, Delay: 0.01, Quorum: 1}
+	task, resultChannel, err = manager.AddWaitCommand(&fanout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, done := manager.WaitResult(task, resultChannel, time.Second)
+	if !done || answer.Error.Code != commonserver.AnswerNoExecuters {
+		t.Errorf("no executers error expected, %+v", answer)
+	}
+	cmd.Delay = -1
+	if _, err := manager.AddCommand(&cmd); err != transport.ErrNegativeDelay {
+		t.Errorf("delay error expected, %v", err)
+	}
+	// delayed command isn't executed early without scheduler
+	holder.Stop()
+	cmd.Delay = 10
+	if _, err := manager.AddCommand(&cmd); err != commonserver.ErrNotScheduled {
+		t.Errorf("not scheduled error expected, %v", err)
+	}
+	if timeout, _ := manager.GetExecCmd(); !timeout {
+		t.Error("delayed command in queue")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	cmd := transport.Command{Method: "sum", Id: 1, IdempotencyKey: "order-1"}
+	task, resultChannel, err := manager.AddWaitCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same task without enqueue
+	duplicate, err := manager.AddCommand(&cmd)
+	if err != nil || duplicate != task {
+		t.Fatalf("duplicate has other task %s, %v", duplicate, err)
+	}
+	_, waitChannel, _ := manager.AddWaitCommand(&cmd)
+	if tasks := takeTasks(t, manager, 1); tasks[0] != task {
+		t.Fatalf("incorrect task %s", tasks[0])
+	}
+	checkEmpty(t, manager)
+	manager.PutResult(task, transport.NewAnswer(1, `{"sum": 3}`))
+	for _, channel := range []chan transport.Answer{resultChannel, waitChannel} {
+		if answer, done := manager.WaitResult(task, channel, time.Millisecond); !done || answer.Result != `{"sum": 3}` {
+			t.Fatal("no result for waiter of duplicate")
+		}
+	}
+	// stored result after done
+	if _, storedChannel, _ := manager.AddWaitCommand(&cmd); len(storedChannel) != 1 {
+		t.Error("no stored result")
+	}
+	// key of rejected command is free
+	other := transport.Command{Method: "sum", Id: 2}
+	manager.AddCommand(&other)
+	manager.AddCommand(&other)
+	cmd.IdempotencyKey = "order-2"
+	if _, err := manager.AddCommand(&cmd); err != commonserver.ErrQueueFull {
+		t.Fatalf("queue full expected, %v", err)
+	}
+	takeTasks(t, manager, 1)
+	if next, err := manager.AddCommand(&cmd); err != nil || next == task {
+		t.Errorf("new task expected for free key, %v", err)
+	}
+}
+
+func TestResultStatus(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowDropOldest)
+	results := resultstore.NewStore(10)
+	defer results.Stop()
+	manager.SetResultStore(results)
+	cmd := transport.Command{Method: "sum", Id: 1}
+	first, _ := manager.AddCommand(&cmd)
+	second, _ := manager.AddCommand(&cmd)
+	check := func(task string, expected string) {
+		if status, _ := results.Get(task); status.Status != expected {
+			t.Fatalf("status %s of task %s, expected %s", status.Status, task, expected)
+		}
+	}
+	check(first, resultstore.StatusQueued)
+	// first is dropped
+	third, _ := manager.AddCommand(&cmd)
+	check(first, resultstore.StatusDeadLettered)
+	tasks := takeTasks(t, manager, 2)
+	check(tasks[0], resultstore.StatusDispatched)
+	manager.PutBackHandler(&cmd, second)
+	check(second, resultstore.StatusTimedOut)
+	// error of executer with code of full queue isn't dead letter
+	manager.PutResult(third, transport.NewErrorAnswer(1, commonserver.AnswerQueueFull, "Queue of executer is full."))
+	check(third, resultstore.StatusFailed)
+	takeTasks(t, manager, 1)
+	manager.PutResult(second, transport.NewAnswer(1, "{}"))
+	if status, _ := results.Get(second); status.Status != resultstore.StatusDone || status.Attempts != 2 {
+		t.Errorf("incorrect status %+v", status)
+	}
+	// rejected command isn't kept
+	manager.SetOverflowOptions(commonserver.OverflowOptions{Policy: commonserver.OverflowReject})
+	manager.AddCommand(&cmd)
+	manager.AddCommand(&cmd)
+	if task, err := manager.AddCommand(&cmd); err != commonserver.ErrQueueFull {
+		t.Fatal("queue full expected")
+	} else if _, exists := results.Get(task); exists {
+		t.Error("status of rejected task")
+	}
+}
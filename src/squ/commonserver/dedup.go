@@ -0,0 +1,103 @@
+package commonserver
+
+import (
+	"squ/transport"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDedupWindow = 300 // sec.
+	// header of http requests
+	IdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// submission of command with idempotency key
+type dedupEntry struct {
+	key     string
+	task    string
+	expires time.Time
+	// result of task, nil while it's in progress
+	answer *transport.Answer
+}
+
+// Tasks by idempotency keys, key is kept for window after first submission
+type dedupWindow struct {
+	lock      sync.Mutex
+	keys      map[string]*dedupEntry
+	tasks     map[string]*dedupEntry
+	window    time.Duration
+	lastSweep time.Time
+}
+
+func newDedupWindow(window int) *dedupWindow {
+	dedup := dedupWindow{
+		keys:      make(map[string]*dedupEntry),
+		tasks:     make(map[string]*dedupEntry),
+		lastSweep: time.Now()}
+	dedup.setWindow(window)
+	return &dedup
+}
+
+func (dedup *dedupWindow) setWindow(window int) {
+	if window <= 0 {
+		window = DefaultDedupWindow
+	}
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	dedup.window = time.Duration(window) * time.Second
+}
+
+// expired keys are removed, lock must be taken
+func (dedup *dedupWindow) sweep(now time.Time) {
+	if now.Sub(dedup.lastSweep) < dedup.window/10 {
+		return
+	}
+	dedup.lastSweep = now
+	for key, entry := range dedup.keys {
+		if now.After(entry.expires) {
+			delete(dedup.keys, key)
+			delete(dedup.tasks, entry.task)
+		}
+	}
+}
+
+// Task of key in window (with result if it's done) or new task is registered for key.
+// Result "true" for duplicate.
+func (dedup *dedupWindow) claim(key string, task string, now time.Time) (string, *transport.Answer, bool) {
+	if key == "" {
+		return task, nil, false
+	}
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	dedup.sweep(now)
+	if entry, exists := dedup.keys[key]; exists && !now.After(entry.expires) {
+		return entry.task, entry.answer, true
+	} else if exists {
+		delete(dedup.tasks, entry.task)
+	}
+	entry := dedupEntry{key: key, task: task, expires: now.Add(dedup.window)}
+	dedup.keys[key] = &entry
+	dedup.tasks[task] = &entry
+	return task, nil, false
+}
+
+// Result for next duplicates
+func (dedup *dedupWindow) setResult(task string, answer *transport.Answer) {
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	if entry, exists := dedup.tasks[task]; exists {
+		value := *answer
+		entry.answer = &value
+	}
+}
+
+// Key of task is free for new submission
+func (dedup *dedupWindow) forget(task string) {
+	dedup.lock.Lock()
+	defer dedup.lock.Unlock()
+	if entry, exists := dedup.tasks[task]; exists {
+		delete(dedup.tasks, task)
+		delete(dedup.keys, entry.key)
+	}
+}
@@ -0,0 +1,457 @@
+package commonserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"squ/helpers"
+	"squ/transport"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoExecuters = errors.New("no executers for method")
+
+// executions of sub-task by the same executer, it's failed after last timeout
+const SubTaskAttempts = 3
+
+// statuses of executers in fan-out result
+const (
+	NodeDone    = "done"
+	NodeFailed  = "failed"
+	NodePending = "pending"
+)
+
+// Answer of one executer in fan-out result
+type NodeAnswer struct {
+	Executer string                      `json:"executer"`
+	Status   string                      `json:"status"`
+	Result   string                      `json:"result,omitempty"`
+	Error    *transport.ErrorDescription `json:"error,omitempty"`
+}
+
+// Result of command delivered to several executers
+type FanoutResult struct {
+	Quorum    int          `json:"quorum,omitempty"`
+	Done      int          `json:"done"`
+	Failed    int          `json:"failed"`
+	Executers []NodeAnswer `json:"executers"`
+}
+
+// executer connection with own queue of fan-out commands
+type executerNode struct {
+	name    string
+	methods map[string]int
+	labels  map[string]string
+	queue   []transport.TaskCommand
+	notify  chan bool
+}
+
+// remove commands of tasks from queue
+func (item *executerNode) remove(tasks map[string]bool) {
+	queue := item.queue[:0]
+	for _, cmd := range item.queue {
+		if !tasks[cmd.Task] {
+			queue = append(queue, cmd)
+		}
+	}
+	for index := len(queue); index < len(item.queue); index++ {
+		item.queue[index] = transport.TaskCommand{}
+	}
+	item.queue = queue
+}
+
+// fan-out task, it's done when every sub-task is answered or quorum is known
+type fanoutTask struct {
+	task       string
+	cmdId      int
+	quorum     int
+	timeout    time.Duration
+	pending    int
+	done       int
+	failed     int
+	dispatched bool
+	finished   bool
+	timer      *time.Timer
+	answers    []NodeAnswer
+	subTasks   []string
+}
+
+// "true" when result doesn't depend on pending answers
+func (parent *fanoutTask) isComplete() bool {
+	if parent.quorum == 0 {
+		return parent.pending == 0
+	}
+	return parent.done >= parent.quorum || parent.done+parent.pending < parent.quorum
+}
+
+// answer of finished task
+func (parent *fanoutTask) answer(expired bool) *transport.Answer {
+	result := FanoutResult{
+		Quorum: parent.quorum, Done: parent.done, Failed: parent.failed, Executers: parent.answers}
+	var answered []string
+	for _, answer := range parent.answers {
+		if answer.Status == NodeDone {
+			answered = append(answered, answer.Executer)
+		}
+	}
+	if parent.quorum > 0 && parent.done < parent.quorum {
+		reason := "is not reachable"
+		if expired {
+			reason = fmt.Sprintf("is not reached in %s", parent.timeout)
+		}
+		return transport.NewErrorAnswer(parent.cmdId, AnswerQuorumError, fmt.Sprintf(
+			"Quorum %d %s, answered: %s.", parent.quorum, reason, strings.Join(answered, ", ")))
+	}
+	data, err := json.Marshal(&result)
+	if err != nil {
+		return transport.NewErrorAnswer(parent.cmdId, AnswerInternalError, err.Error())
+	}
+	return transport.NewAnswer(parent.cmdId, string(data))
+}
+
+// command of fan-out task for one executer
+type subTask struct {
+	parent *fanoutTask
+	index  int
+	node   string
+	// timeouts of executions
+	timeouts int
+}
+
+// Executer connections, sub-tasks of fan-out commands and routed commands
+type fanoutState struct {
+	lock     sync.Mutex
+	nodes    map[string]*executerNode
+	subTasks map[string]*subTask
+	// routed commands of methods without executers
+	parked map[string][]transport.TaskCommand
+	// commands with selector for any matching executer
+	selected []transport.TaskCommand
+}
+
+func newFanoutState() *fanoutState {
+	return &fanoutState{
+		nodes:    make(map[string]*executerNode),
+		subTasks: make(map[string]*subTask),
+		parked:   make(map[string][]transport.TaskCommand)}
+}
+
+func newNodeAnswer(node string, answer *transport.Answer) NodeAnswer {
+	if answer.Error.Exists() {
+		description := answer.Error
+		return NodeAnswer{Executer: node, Status: NodeFailed, Error: &description}
+	}
+	return NodeAnswer{Executer: node, Status: NodeDone, Result: answer.Result}
+}
+
+// Methods of executer connection for fan-out, routed and selected commands,
+// labels replace previous ones (nil keeps them)
+func (manager *DataStreamManager) RegisterExecuter(
+	node string, labels map[string]string, methods ...string) {
+	//
+	state := manager.fanout
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	item, exists := state.nodes[node]
+	if !exists {
+		item = &executerNode{name: node, methods: make(map[string]int), notify: make(chan bool, 1)}
+		state.nodes[node] = item
+	}
+	changed := methods
+	if labels != nil && !reflect.DeepEqual(labels, item.labels) {
+		item.labels = make(map[string]string, len(labels))
+		for name, value := range labels {
+			item.labels[name] = value
+		}
+		// routed commands of all methods can move
+		for method := range item.methods {
+			changed = append(changed, method)
+		}
+	}
+	for _, method := range methods {
+		item.methods[method]++
+	}
+	state.rebalanceLocked(changed)
+	state.notifySelectedLocked(item)
+}
+
+// Remove methods of executer connection, sub-tasks of closed connection are failed
+func (manager *DataStreamManager) UnregisterExecuter(node string, methods ...string) {
+	state := manager.fanout
+	state.lock.Lock()
+	item, exists := state.nodes[node]
+	if !exists {
+		state.lock.Unlock()
+		return
+	}
+	for _, method := range methods {
+		if item.methods[method] <= 1 {
+			delete(item.methods, method)
+		} else {
+			item.methods[method]--
+		}
+	}
+	var lost []string
+	if len(item.methods) == 0 {
+		delete(state.nodes, node)
+		for task, sub := range state.subTasks {
+			if sub.node == node {
+				lost = append(lost, task)
+			}
+		}
+		state.parkLocked(item)
+	}
+	state.rebalanceLocked(methods)
+	state.lock.Unlock()
+	manager.freeSubTasks(lost)
+	for _, task := range lost {
+		manager.PutResult(task, transport.NewErrorAnswer(0, AnswerInternalError, "Executer disconnected."))
+	}
+}
+
+// sub-tasks in progress are removed from storage, it doesn't return them
+func (manager *DataStreamManager) freeSubTasks(tasks []string) {
+	if manager.storage == nil {
+		return
+	}
+	for _, task := range tasks {
+		manager.storage.Free(task)
+	}
+}
+
+// put command to queues of executers of method: all or "scatter" with shortest queues
+func (manager *DataStreamManager) broadcast(cmd *transport.Command, task string) error {
+	if err := cmd.ValidateQuorum(); err != nil {
+		return err
+	}
+	state := manager.fanout
+	state.lock.Lock()
+	var nodes []*executerNode
+	for _, item := range state.nodes {
+		if item.accepts(cmd) {
+			nodes = append(nodes, item)
+		}
+	}
+	if len(nodes) == 0 || len(nodes) < cmd.Quorum {
+		state.lock.Unlock()
+		TaskLog(task, cmd).Warn("Executers for fan-out task: %d, quorum %d", len(nodes), cmd.Quorum)
+		return ErrNoExecuters
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if len(nodes[i].queue) != len(nodes[j].queue) {
+			return len(nodes[i].queue) < len(nodes[j].queue)
+		}
+		return nodes[i].name < nodes[j].name
+	})
+	if cmd.Scatter > 0 && cmd.Scatter < len(nodes) {
+		nodes = nodes[:cmd.Scatter]
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+	manager.tracer.TaskEnqueue(task, cmd.Method, cmd.Traceparent)
+	manager.stats.TaskEnqueued(task, cmd.Method)
+	parent := &fanoutTask{
+		task:    task,
+		cmdId:   cmd.Id,
+		quorum:  cmd.Quorum,
+		pending: len(nodes),
+		answers: make([]NodeAnswer, len(nodes))}
+	sub := *cmd
+	sub.Broadcast, sub.Scatter, sub.Quorum, sub.QuorumTimeout, sub.RoutingKey = false, 0, 0, 0, ""
+	sub.Selector = nil
+	var rejected []string
+	limit := cap(*manager.execRequestChannel)
+	for index, item := range nodes {
+		subTaskId := manager.Uid()
+		state.subTasks[subTaskId] = &subTask{parent: parent, index: index, node: item.name}
+		parent.subTasks = append(parent.subTasks, subTaskId)
+		parent.answers[index] = NodeAnswer{Executer: item.name, Status: NodePending}
+		if len(item.queue) >= limit {
+			rejected = append(rejected, subTaskId)
+			continue
+		}
+		item.queue = append(item.queue, transport.TaskCommand{Command: sub, Task: subTaskId})
+		select {
+		case item.notify <- true:
+		default:
+		}
+	}
+	if parent.quorum > 0 {
+		parent.timeout = time.Duration(cmd.QuorumTimeout * float64(time.Second))
+		if parent.timeout <= 0 {
+			parent.timeout = time.Duration(helpers.FindTimeout(&cmd.Params)) * time.Millisecond
+		}
+		parent.timer = time.AfterFunc(parent.timeout, func() { manager.expireFanout(parent) })
+	}
+	state.lock.Unlock()
+	manager.tracer.TaskEnqueued(task)
+	TaskLog(task, cmd).Debug("Fan-out task for executers: %d, quorum %d", len(nodes), cmd.Quorum)
+	for _, subTaskId := range rejected {
+		manager.deadLetter(subTaskId, transport.NewErrorAnswer(cmd.Id, AnswerQueueFull, "Queue full."))
+	}
+	return nil
+}
+
+// first command from queue of executer, then first selected command for it
+func (manager *DataStreamManager) takeNodeCmd(node string) (*transport.TaskCommand, bool) {
+	state := manager.fanout
+	state.lock.Lock()
+	item, exists := state.nodes[node]
+	if !exists {
+		state.lock.Unlock()
+		return nil, false
+	}
+	if len(item.queue) == 0 {
+		cmd, ok := state.takeSelectedLocked(item)
+		state.lock.Unlock()
+		if !ok {
+			return nil, false
+		}
+		return manager.dequeued(&cmd), true
+	}
+	cmd := item.queue[0]
+	item.queue[0] = transport.TaskCommand{}
+	item.queue = item.queue[1:]
+	var parent *fanoutTask
+	sub, isSubTask := state.subTasks[cmd.Task]
+	if isSubTask && !sub.parent.dispatched {
+		sub.parent.dispatched = true
+		parent = sub.parent
+	}
+	state.lock.Unlock()
+	if parent != nil {
+		manager.tracer.TaskDequeued(parent.task)
+		manager.stats.TaskDispatched(parent.task)
+		manager.results.Dispatched(parent.task)
+	}
+	if !isSubTask {
+		// routed command
+		return manager.dequeued(&cmd), true
+	}
+	return &cmd, true
+}
+
+// notify channel of executer queue, nil for unknown executer
+func (manager *DataStreamManager) nodeNotify(node string) chan bool {
+	state := manager.fanout
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if item, exists := state.nodes[node]; exists {
+		return item.notify
+	}
+	return nil
+}
+
+// return sub-task to queue of executer after timeout, it's failed after last attempt,
+// "false" for other tasks
+func (manager *DataStreamManager) returnSubTask(cmd *transport.Command, task string) bool {
+	state := manager.fanout
+	state.lock.Lock()
+	sub, exists := state.subTasks[task]
+	if !exists {
+		state.lock.Unlock()
+		return false
+	}
+	sub.timeouts++
+	if sub.timeouts >= SubTaskAttempts {
+		state.lock.Unlock()
+		TaskLog(task, cmd).Warn("Sub-task is not done in %d attempts", sub.timeouts)
+		manager.PutResult(task, transport.NewErrorAnswer(
+			0, AnswerTimeoutError, fmt.Sprintf("Sub-task is not done in %d attempts.", SubTaskAttempts)))
+		return true
+	}
+	item, connected := state.nodes[sub.node]
+	if connected {
+		item.queue = append([]transport.TaskCommand{{Command: *cmd, Task: task}}, item.queue...)
+		select {
+		case item.notify <- true:
+		default:
+		}
+	}
+	state.lock.Unlock()
+	if !connected {
+		manager.PutResult(task, transport.NewErrorAnswer(0, AnswerInternalError, "Executer disconnected."))
+	}
+	return true
+}
+
+// sub-tasks without answer are cancelled, result is list of them, lock must be taken
+func (manager *DataStreamManager) finishFanoutLocked(parent *fanoutTask) []string {
+	state := manager.fanout
+	parent.finished = true
+	if parent.timer != nil {
+		parent.timer.Stop()
+	}
+	cancelled := make(map[string]bool)
+	var tasks []string
+	for _, task := range parent.subTasks {
+		if sub, exists := state.subTasks[task]; exists {
+			delete(state.subTasks, task)
+			cancelled[task] = true
+			tasks = append(tasks, task)
+			if item, connected := state.nodes[sub.node]; connected {
+				item.remove(cancelled)
+			}
+		}
+	}
+	return tasks
+}
+
+// answer of sub-task is added to fan-out result, "false" for other tasks
+func (manager *DataStreamManager) putSubResult(task string, answer *transport.Answer) bool {
+	state := manager.fanout
+	state.lock.Lock()
+	sub, exists := state.subTasks[task]
+	if !exists {
+		state.lock.Unlock()
+		return false
+	}
+	delete(state.subTasks, task)
+	parent := sub.parent
+	parent.answers[sub.index] = newNodeAnswer(sub.node, answer)
+	parent.pending--
+	if parent.answers[sub.index].Status == NodeDone {
+		parent.done++
+	} else {
+		parent.failed++
+	}
+	var cancelled []string
+	finished := parent.isComplete()
+	if finished {
+		cancelled = manager.finishFanoutLocked(parent)
+	}
+	state.lock.Unlock()
+	if finished {
+		manager.freeSubTasks(cancelled)
+		manager.putFanoutResult(parent, false)
+	}
+	return true
+}
+
+// error of quorum after timeout
+func (manager *DataStreamManager) expireFanout(parent *fanoutTask) {
+	state := manager.fanout
+	state.lock.Lock()
+	if parent.finished {
+		state.lock.Unlock()
+		return
+	}
+	cancelled := manager.finishFanoutLocked(parent)
+	state.lock.Unlock()
+	manager.freeSubTasks(cancelled)
+	manager.putFanoutResult(parent, true)
+}
+
+// result of fan-out task from answers of executers
+func (manager *DataStreamManager) putFanoutResult(parent *fanoutTask, expired bool) {
+	answer := parent.answer(expired)
+	manager.tracer.TaskResult(parent.task, answer.Error.Message)
+	manager.stats.TaskResult(parent.task, answer.Error.Exists() || (parent.quorum == 0 && parent.failed > 0))
+	if parent.failed > 0 {
+		TaskLog(parent.task, nil).Warn("Fan-out task with failed executers: %d", parent.failed)
+	}
+	manager.PutResult(parent.task, answer)
+}
@@ -0,0 +1,164 @@
+package commonserver_test
+
+import (
+	"encoding/json"
+	"squ/commonserver"
+	"squ/transport"
+	"testing"
+	"time"
+)
+
+func TestBroadcast(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	manager.RegisterExecuter("a", nil, "sum")
+	manager.RegisterExecuter("b", nil, "sum", "log")
+	manager.RegisterExecuter("c", nil, "log")
+	cmd := transport.Command{Method: "sum", Id: 1, Params: "{}", Broadcast: true}
+	task, resultChannel, err := manager.AddWaitCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not in common queue and not for other methods
+	checkEmpty(t, manager)
+	if timeout, _ := manager.GetNodeExecCmd("c"); !timeout {
+		t.Fatal("unexpected command for executer of other method")
+	}
+	subTasks := make(map[string]string)
+	for _, node := range []string{"a", "b"} {
+		timeout, subCmd := manager.GetNodeExecCmd(node)
+		if timeout || subCmd.Broadcast || subCmd.Task == task {
+			t.Fatalf("no sub-task for %s", node)
+		}
+		subTasks[node] = subCmd.Task
+	}
+	manager.PutResult(subTasks["a"], transport.NewAnswer(0, `{"ok": true}`))
+	// return after timeout to queue of the same executer
+	manager.PutBackHandler(&cmd, subTasks["b"])
+	if timeout, subCmd := manager.GetNodeExecCmd("b"); timeout || subCmd.Task != subTasks["b"] {
+		t.Fatal("sub-task must be returned to executer")
+	}
+	if len(resultChannel) > 0 {
+		t.Fatal("result before all executers")
+	}
+	manager.UnregisterExecuter("b", "log")
+	manager.UnregisterExecuter("b", "sum")
+	answer, done := manager.WaitResult(task, resultChannel, time.Millisecond)
+	if !done {
+		t.Fatal("no result after disconnect")
+	}
+	result := commonserver.FanoutResult{}
+	if err := json.Unmarshal([]byte(answer.Result), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Done != 1 || result.Failed != 1 || result.Executers[0].Result != `{"ok": true}` ||
+		result.Executers[1].Executer != "b" || result.Executers[1].Status != commonserver.NodeFailed {
+		//
+		t.Errorf("incorrect result %s", answer.Result)
+	}
+	cmd.Method = "unknown"
+	if _, err := manager.AddCommand(&cmd); err != commonserver.ErrNoExecuters {
+		t.Errorf("no executers error expected, %v", err)
+	}
+}
+
+func TestBroadcastAttempts(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	manager.RegisterExecuter("a", nil, "sum")
+	cmd := transport.Command{Method: "sum", Id: 1, Params: "{}", Broadcast: true}
+	task, resultChannel, err := manager.AddWaitCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 0; attempt < commonserver.SubTaskAttempts; attempt++ {
+		timeout, subCmd := manager.GetNodeExecCmd("a")
+		if timeout {
+			t.Fatalf("no sub-task in attempt %d", attempt)
+		}
+		manager.PutBackHandler(&subCmd.Command, subCmd.Task)
+	}
+	// sub-task is failed after last timeout, it isn't returned to queue
+	if timeout, _ := manager.GetNodeExecCmd("a"); !timeout {
+		t.Fatal("sub-task is returned after last attempt")
+	}
+	answer, done := manager.WaitResult(task, resultChannel, time.Millisecond)
+	if !done {
+		t.Fatal("no result after last attempt")
+	}
+	result := commonserver.FanoutResult{}
+	if err := json.Unmarshal([]byte(answer.Result), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Failed != 1 || result.Executers[0].Error == nil ||
+		result.Executers[0].Error.Code != commonserver.AnswerTimeoutError {
+		//
+		t.Errorf("incorrect result %s", answer.Result)
+	}
+}
+
+func TestQuorum(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	for _, node := range []string{"a", "b", "c", "d"} {
+		manager.RegisterExecuter(node, nil, "read")
+	}
+	// "a" has the longest queue after it
+	if _, err := manager.AddCommand(&transport.Command{Method: "read", Id: 1, Scatter: 1}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := transport.Command{Method: "read", Id: 2, Scatter: 3, Quorum: 2, QuorumTimeout: 10}
+	task, resultChannel, err := manager.AddWaitCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subTasks := make(map[string]string)
+	for _, node := range []string{"b", "c", "d"} {
+		timeout, subCmd := manager.GetNodeExecCmd(node)
+		if timeout || subCmd.Quorum != 0 {
+			t.Fatalf("no sub-task for %s", node)
+		}
+		subTasks[node] = subCmd.Task
+	}
+	manager.PutResult(subTasks["b"], transport.NewErrorAnswer(0, 100, "Failed."))
+	manager.PutResult(subTasks["c"], transport.NewAnswer(0, "1"))
+	if len(resultChannel) > 0 {
+		t.Fatal("result before quorum")
+	}
+	manager.PutResult(subTasks["d"], transport.NewAnswer(0, "1"))
+	answer, done := manager.WaitResult(task, resultChannel, time.Millisecond)
+	if !done || answer.Error.Exists() {
+		t.Fatal("result of quorum expected")
+	}
+	result := commonserver.FanoutResult{}
+	json.Unmarshal([]byte(answer.Result), &result)
+	if result.Quorum != 2 || result.Done != 2 || result.Failed != 1 || result.Executers[1].Status != commonserver.NodeDone {
+		t.Errorf("incorrect result %s", answer.Result)
+	}
+	// error after timeout
+	cmd = transport.Command{Method: "read", Id: 3, Quorum: 3, QuorumTimeout: 0.02}
+	task, resultChannel, _ = manager.AddWaitCommand(&cmd)
+	_, subCmd := manager.GetNodeExecCmd("b")
+	manager.PutResult(subCmd.Task, transport.NewAnswer(0, "1"))
+	answer, done = manager.WaitResult(task, resultChannel, time.Second)
+	if !done || answer.Error.Code != commonserver.AnswerQuorumError || answer.Error.Message != "Quorum 3 is not reached in 20ms, answered: b." {
+		t.Errorf("quorum error expected %+v", answer)
+	}
+	// cancelled sub-tasks are removed from queues
+	for _, node := range []string{"c", "d"} {
+		if timeout, _ := manager.GetNodeExecCmd(node); !timeout {
+			t.Errorf("cancelled sub-task in queue of %s", node)
+		}
+	}
+	if timeout, subCmd := manager.GetNodeExecCmd("a"); timeout || subCmd.Id != 1 {
+		t.Error("sub-task of first command expected")
+	}
+	if timeout, _ := manager.GetNodeExecCmd("a"); !timeout {
+		t.Error("cancelled sub-task in queue of a")
+	}
+	cmd.Quorum = 5
+	if _, err := manager.AddCommand(&cmd); err != commonserver.ErrNoExecuters {
+		t.Errorf("no executers error expected, %v", err)
+	}
+	cmd.Scatter = 2
+	if _, err := manager.AddCommand(&cmd); err != transport.ErrQuorum {
+		t.Errorf("quorum error expected, %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package commonserver
+
+import (
+	"squ/transport"
+)
+
+// Labels of executer have every value of selector
+func MatchLabels(labels map[string]string, selector map[string]string) bool {
+	for name, value := range selector {
+		if label, exists := labels[name]; !exists || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// executer has method and labels of command
+func (item *executerNode) accepts(cmd *transport.Command) bool {
+	return item.methods[cmd.Method] > 0 && MatchLabels(item.labels, cmd.Selector)
+}
+
+// wake executers of command, lock must be taken
+func (state *fanoutState) notifyMatchingLocked(cmd *transport.Command) {
+	for _, item := range state.nodes {
+		if item.accepts(cmd) {
+			select {
+			case item.notify <- true:
+			default:
+			}
+		}
+	}
+}
+
+// wake executer if there is selected command for it, lock must be taken
+func (state *fanoutState) notifySelectedLocked(item *executerNode) {
+	for index := range state.selected {
+		if item.accepts(&state.selected[index].Command) {
+			select {
+			case item.notify <- true:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// first selected command for executer, lock must be taken
+func (state *fanoutState) takeSelectedLocked(item *executerNode) (transport.TaskCommand, bool) {
+	for index := range state.selected {
+		if cmd := state.selected[index]; item.accepts(&cmd.Command) {
+			copy(state.selected[index:], state.selected[index+1:])
+			state.selected[len(state.selected)-1] = transport.TaskCommand{}
+			state.selected = state.selected[:len(state.selected)-1]
+			return cmd, true
+		}
+	}
+	return transport.TaskCommand{}, false
+}
+
+// put command with selector to queue of matching executers, ErrQueueFull if it's full
+func (manager *DataStreamManager) queueSelected(cmd *transport.Command, task string) error {
+	state := manager.fanout
+	manager.tracer.TaskEnqueue(task, cmd.Method, cmd.Traceparent)
+	manager.stats.TaskEnqueued(task, cmd.Method)
+	state.lock.Lock()
+	if len(state.selected) >= cap(*manager.execRequestChannel) {
+		state.lock.Unlock()
+		manager.stats.QueueFull(cmd.Method)
+		return manager.reject(cmd, task, "queue of selected executers")
+	}
+	state.selected = append(state.selected, transport.TaskCommand{Command: *cmd, Task: task})
+	state.notifyMatchingLocked(cmd)
+	state.lock.Unlock()
+	manager.tracer.TaskEnqueued(task)
+	return nil
+}
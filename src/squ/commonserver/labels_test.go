@@ -0,0 +1,58 @@
+package commonserver_test
+
+import (
+	"squ/commonserver"
+	"squ/transport"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	manager.RegisterExecuter("a", map[string]string{"region": "eu", "gpu": "true"}, "calc")
+	manager.RegisterExecuter("b", map[string]string{"region": "us", "gpu": "false"}, "calc")
+	cmd := transport.Command{Method: "calc", Id: 1, Selector: map[string]string{"region": "eu"}}
+	task, err := manager.AddCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmpty(t, manager)
+	if timeout, _ := manager.GetNodeExecCmd("b"); !timeout {
+		t.Fatal("command for executer with other labels")
+	}
+	timeout, selected := manager.GetNodeExecCmd("a")
+	if timeout || selected.Task != task {
+		t.Fatal("no selected command")
+	}
+	// returned command is for matching executer only
+	manager.PutBackHandler(&selected.Command, selected.Task)
+	manager.RegisterExecuter("c", map[string]string{"region": "eu"}, "calc")
+	if timeout, selected := manager.GetNodeExecCmd("c"); timeout || selected.Task != task {
+		t.Fatal("returned command for new executer expected")
+	}
+	// fan-out and routing among matching executers only
+	cmd.Selector = map[string]string{"gpu": "true"}
+	cmd.Broadcast = true
+	manager.AddCommand(&cmd)
+	if timeout, _ := manager.GetNodeExecCmd("c"); !timeout {
+		t.Error("broadcast for executer without label")
+	}
+	if timeout, _ := manager.GetNodeExecCmd("a"); timeout {
+		t.Error("no broadcast command")
+	}
+	cmd.Broadcast = false
+	cmd.RoutingKey = "customer"
+	manager.AddCommand(&cmd)
+	if timeout, _ := manager.GetNodeExecCmd("a"); timeout {
+		t.Error("no routed command")
+	}
+	// new labels move routed commands
+	manager.AddCommand(&cmd)
+	manager.RegisterExecuter("a", map[string]string{"gpu": "false"})
+	manager.RegisterExecuter("b", map[string]string{"gpu": "true"})
+	if timeout, _ := manager.GetNodeExecCmd("b"); timeout {
+		t.Error("routed command must be moved after labels change")
+	}
+	if !commonserver.MatchLabels(map[string]string{"a": "1"}, nil) || commonserver.MatchLabels(nil, map[string]string{"a": "1"}) {
+		t.Error("incorrect match")
+	}
+}
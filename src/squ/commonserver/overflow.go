@@ -0,0 +1,295 @@
+package commonserver
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"squ/logger"
+	"squ/spillqueue"
+	"squ/transport"
+	"sync"
+)
+
+// overflow policies of full queue
+const (
+	OverflowReject     = "reject"
+	OverflowDropOldest = "drop_oldest"
+	OverflowSpill      = "spill"
+	//
+	DefaultOverflowPolicy = OverflowReject
+)
+
+var ErrQueueFull = errors.New("queue full")
+
+func IsOverflowPolicy(name string) bool {
+	switch name {
+	case OverflowReject, OverflowDropOldest, OverflowSpill:
+		return true
+	default:
+		return false
+	}
+}
+
+// Overflow policies in settings, "reject" for empty values
+type OverflowOptions struct {
+	Policy string `json:"policy"`
+	// policy by method name
+	Methods map[string]string `json:"methods"`
+}
+
+// Policy of method
+func (options OverflowOptions) GetPolicy(method string) string {
+	if policy, exists := options.Methods[method]; exists && policy != "" {
+		return policy
+	}
+	if options.Policy == "" {
+		return DefaultOverflowPolicy
+	}
+	return options.Policy
+}
+
+func (options OverflowOptions) Validate() []string {
+	var problems []string
+	if options.Policy != "" && !IsOverflowPolicy(options.Policy) {
+		problems = append(problems, fmt.Sprintf("unknown policy '%s'", options.Policy))
+	}
+	for method, policy := range options.Methods {
+		if !IsOverflowPolicy(policy) {
+			problems = append(problems, fmt.Sprintf("unknown policy '%s' of method %s", policy, method))
+		}
+	}
+	return problems
+}
+
+// Policy is used by default or for any method
+func (options OverflowOptions) Uses(policy string) bool {
+	if options.GetPolicy("") == policy {
+		return true
+	}
+	for _, value := range options.Methods {
+		if value == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Same policies of all methods
+func (options OverflowOptions) Equal(other OverflowOptions) bool {
+	if options.GetPolicy("") != other.GetPolicy("") || len(options.Methods) != len(other.Methods) {
+		return false
+	}
+	for method, policy := range options.Methods {
+		if value, exists := other.Methods[method]; !exists || value != policy {
+			return false
+		}
+	}
+	return true
+}
+
+// copy without shared map
+func (options OverflowOptions) clone() OverflowOptions {
+	result := OverflowOptions{Policy: options.Policy, Methods: make(map[string]string)}
+	for method, policy := range options.Methods {
+		result.Methods[method] = policy
+	}
+	return result
+}
+
+// Task of spilled command, it gets dead letter if record can't be read
+type spilledTask struct {
+	task string
+	id   int
+}
+
+// FIFO of commands over queue size, commands over memory limits go to disk
+type overflowQueue struct {
+	items *list.List
+	// data size of commands in memory
+	size int64
+	// memory part limit without limits in spill settings
+	maxItems int
+	// disk part, nil without spill path in settings
+	disk   *spillqueue.SegmentQueue
+	limits spillqueue.Options
+	// tasks of disk part in the same order
+	spilled *list.List
+	lock    sync.Mutex
+	// signal for waiting "execute"
+	notify chan bool
+	// handler of spilled tasks which are lost, it's called without lock
+	lost func(tasks []spilledTask)
+}
+
+func newOverflowQueue(maxItems int, lost func(tasks []spilledTask)) *overflowQueue {
+	return &overflowQueue{
+		items:    list.New(),
+		maxItems: maxItems,
+		spilled:  list.New(),
+		notify:   make(chan bool, 1),
+		lost:     lost}
+}
+
+// approximate memory size of command
+func commandSize(cmd *transport.TaskCommand) int64 {
+	return int64(len(cmd.Params) + len(cmd.Method) + len(cmd.Task) + len(cmd.Traceparent))
+}
+
+func (queue *overflowQueue) signal() {
+	select {
+	case queue.notify <- true:
+	default:
+	}
+}
+
+// dead letters for lost spilled tasks
+func (queue *overflowQueue) report(lost []spilledTask) {
+	if len(lost) > 0 && queue.lost != nil {
+		queue.lost(lost)
+	}
+}
+
+// lock must be taken, tasks of count oldest spilled commands
+func (queue *overflowQueue) takeSpilled(count int) []spilledTask {
+	var tasks []spilledTask
+	for ; count > 0 && queue.spilled.Len() > 0; count-- {
+		tasks = append(tasks, queue.spilled.Remove(queue.spilled.Front()).(spilledTask))
+	}
+	return tasks
+}
+
+// disk is used for commands over limits, commands of old disk part are lost
+func (queue *overflowQueue) setDisk(disk *spillqueue.SegmentQueue, limits spillqueue.Options) error {
+	queue.lock.Lock()
+	var err error
+	var lost []spilledTask
+	if queue.disk != nil {
+		if count := queue.disk.Len(); count > 0 {
+			logger.Warn("Spilled commands are lost: %d", count)
+			lost = queue.takeSpilled(count)
+		}
+		err = queue.disk.Close()
+	}
+	queue.disk = disk
+	queue.limits = limits
+	queue.lock.Unlock()
+	queue.report(lost)
+	return err
+}
+
+// lock must be taken, memory part is full by spill limits or by size of queue without them
+func (queue *overflowQueue) memoryFull() bool {
+	if queue.limits.MaxCount > 0 || queue.limits.MaxBytes > 0 {
+		return queue.limits.IsOver(queue.items.Len(), queue.size)
+	}
+	return queue.items.Len() >= queue.maxItems
+}
+
+// command to the end, it's placed in memory on disk problem or over memory limit with "force"
+func (queue *overflowQueue) push(cmd transport.TaskCommand, force bool) error {
+	queue.lock.Lock()
+	defer queue.signal()
+	defer queue.lock.Unlock()
+	// memory part is older than disk part
+	if queue.disk != nil && (queue.disk.Len() > 0 || queue.memoryFull()) {
+		data, err := json.Marshal(&cmd)
+		if err == nil {
+			err = queue.disk.Push(data)
+		}
+		if err == nil {
+			queue.spilled.PushBack(spilledTask{task: cmd.Task, id: cmd.Id})
+			return nil
+		}
+		if !force {
+			return err
+		}
+		TaskLog(cmd.Task, &cmd.Command).Error("Can't spill task to disk: %s", err)
+	} else if queue.disk == nil && !force && queue.memoryFull() {
+		return ErrQueueFull
+	}
+	queue.items.PushBack(cmd)
+	queue.size += commandSize(&cmd)
+	return nil
+}
+
+// lock must be taken, tasks of unreadable records are lost
+func (queue *overflowQueue) popDisk() (*transport.TaskCommand, []spilledTask, bool) {
+	if queue.disk == nil {
+		return nil, nil, false
+	}
+	var lost []spilledTask
+	for {
+		data, exists, err := queue.disk.Pop()
+		if !exists {
+			if err != nil {
+				// record isn't read, position in segment is unknown, disk part is cleared
+				count := queue.disk.Len()
+				logger.Error("Spill queue read error, %d commands are lost: %s", count, err)
+				lost = append(lost, queue.takeSpilled(count)...)
+				if err = queue.disk.Close(); err != nil {
+					logger.Warn("Spill queue files are not removed: %s", err)
+				}
+			}
+			return nil, lost, false
+		}
+		if err != nil {
+			logger.Warn("Spill queue files are not removed: %s", err)
+		}
+		tasks := queue.takeSpilled(1)
+		cmd := transport.TaskCommand{}
+		if err = json.Unmarshal(data, &cmd); err == nil {
+			return &cmd, lost, true
+		}
+		// next record is available after bad one
+		logger.Error("Spilled command is skipped, bad record (%d bytes): %s", len(data), err)
+		lost = append(lost, tasks...)
+	}
+}
+
+func (queue *overflowQueue) pop() (*transport.TaskCommand, bool) {
+	queue.lock.Lock()
+	var cmd *transport.TaskCommand
+	var lost []spilledTask
+	exists := false
+	if item := queue.items.Front(); item != nil {
+		queue.items.Remove(item)
+		value := item.Value.(transport.TaskCommand)
+		queue.size -= commandSize(&value)
+		cmd, exists = &value, true
+	} else {
+		cmd, lost, exists = queue.popDisk()
+	}
+	if exists && queue.lengthLocked() > 0 {
+		// next waiter
+		queue.signal()
+	}
+	queue.lock.Unlock()
+	queue.report(lost)
+	return cmd, exists
+}
+
+// lock must be taken
+func (queue *overflowQueue) lengthLocked() int {
+	length := queue.items.Len()
+	if queue.disk != nil {
+		length += queue.disk.Len()
+	}
+	return length
+}
+
+func (queue *overflowQueue) length() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.lengthLocked()
+}
+
+// count of commands on disk
+func (queue *overflowQueue) diskLength() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.disk == nil {
+		return 0
+	}
+	return queue.disk.Len()
+}
@@ -0,0 +1,311 @@
+package commonserver_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"squ/commonserver"
+	"squ/spillqueue"
+	"squ/transport"
+	"testing"
+)
+
+func newTestManager(policy string) *commonserver.DataStreamManager {
+	return commonserver.NewDataStreamManager(commonserver.StreamOptions{
+		QueueSize:   2,
+		PauseGetCmd: 10,
+		Overflow:    commonserver.OverflowOptions{Policy: policy, Methods: map[string]string{"bulk": commonserver.OverflowSpill}}})
+}
+
+func takeTasks(t *testing.T, manager *commonserver.DataStreamManager, count int) []string {
+	var tasks []string
+	for index := 0; index < count; index++ {
+		timeout, cmd := manager.GetExecCmd()
+		if timeout {
+			t.Fatalf("no command %d", index)
+		}
+		tasks = append(tasks, cmd.Task)
+	}
+	return tasks
+}
+
+func checkEmpty(t *testing.T, manager *commonserver.DataStreamManager) {
+	if timeout, cmd := manager.GetExecCmd(); !timeout {
+		t.Fatalf("unexpected command %s", cmd.Task)
+	}
+}
+
+func TestOverflowReject(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	cmd := transport.Command{Method: "sum", Id: 1}
+	for index := 0; index < 2; index++ {
+		if _, err := manager.AddCommand(&cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	task, resultChannel, err := manager.AddWaitCommand(&cmd)
+	if err != commonserver.ErrQueueFull || resultChannel != nil {
+		t.Fatalf("queue full expected, %v", err)
+	}
+	if manager.PutResult(task, transport.NewAnswer(1, "{}")) {
+		t.Error("waiter of rejected task is not removed")
+	}
+	stats := manager.Stats().Snapshot()
+	if len(stats) != 1 || stats[0].QueueFull != 1 || stats[0].Rejected != 1 {
+		t.Errorf("incorrect stats %+v", stats)
+	}
+	takeTasks(t, manager, 2)
+	checkEmpty(t, manager)
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowDropOldest)
+	cmd := transport.Command{Method: "sum", Id: 1}
+	oldest, resultChannel, _ := manager.AddWaitCommand(&cmd)
+	second, _ := manager.AddCommand(&cmd)
+	third, err := manager.AddCommand(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case answer := <-resultChannel:
+		if answer.Error.Code != commonserver.AnswerQueueFull {
+			t.Errorf("incorrect answer of dropped task %s", answer.String())
+		}
+	default:
+		t.Error("no answer for dropped task")
+	}
+	tasks := takeTasks(t, manager, 2)
+	checkEmpty(t, manager)
+	if tasks[0] != second || tasks[1] != third || tasks[0] == oldest {
+		t.Errorf("incorrect tasks %v", tasks)
+	}
+}
+
+func TestOverflowDropOldestOfMethod(t *testing.T) {
+	manager := commonserver.NewDataStreamManager(commonserver.StreamOptions{
+		QueueSize:   2,
+		PauseGetCmd: 10,
+		Overflow:    commonserver.OverflowOptions{Policy: commonserver.OverflowReject, Methods: map[string]string{"sum": commonserver.OverflowDropOldest}}})
+	sum := transport.Command{Method: "sum", Id: 1}
+	mail := transport.Command{Method: "mail", Id: 2}
+	first, _ := manager.AddCommand(&mail)
+	second, _ := manager.AddCommand(&mail)
+	// commands of "reject" method are not dropped for other method
+	if _, err := manager.AddCommand(&sum); err != commonserver.ErrQueueFull {
+		t.Fatalf("queue full expected, %v", err)
+	}
+	if tasks := takeTasks(t, manager, 1); tasks[0] != first {
+		t.Fatalf("incorrect task %v", tasks)
+	}
+	dropped, resultChannel, _ := manager.AddWaitCommand(&sum)
+	last, err := manager.AddCommand(&sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer := <-resultChannel; answer.Error.Code != commonserver.AnswerQueueFull {
+		t.Errorf("incorrect answer of dropped task %s", answer.String())
+	}
+	if _, err := manager.AddCommand(&mail); err != commonserver.ErrQueueFull {
+		t.Errorf("queue full expected, %v", err)
+	}
+	tasks := takeTasks(t, manager, 2)
+	checkEmpty(t, manager)
+	if tasks[0] != second || tasks[1] != last || tasks[1] == dropped {
+		t.Errorf("incorrect tasks %v", tasks)
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	sum := transport.Command{Method: "sum", Id: 1}
+	bulk := transport.Command{Method: "bulk", Id: 2}
+	var expected []string
+	for index := 0; index < 4; index++ {
+		task, err := manager.AddCommand(&bulk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, task)
+	}
+	// memory part is limited by queue size without disk
+	if _, err := manager.AddCommand(&bulk); err != commonserver.ErrQueueFull {
+		t.Errorf("queue full expected, %v", err)
+	}
+	if manager.QueueLength() != 4 {
+		t.Errorf("incorrect queue length %d", manager.QueueLength())
+	}
+	// other methods are rejected
+	if _, err := manager.AddCommand(&sum); err != commonserver.ErrQueueFull {
+		t.Errorf("queue full expected, %v", err)
+	}
+	// FIFO order with free place in queue
+	tasks := takeTasks(t, manager, 3)
+	task, _ := manager.AddCommand(&bulk)
+	expected = append(expected, task)
+	tasks = append(tasks, takeTasks(t, manager, 2)...)
+	checkEmpty(t, manager)
+	for index := range expected {
+		if tasks[index] != expected[index] {
+			t.Fatalf("incorrect order %v, expected %v", tasks, expected)
+		}
+	}
+}
+
+func TestReturnToFullQueue(t *testing.T) {
+	manager := newTestManager(commonserver.OverflowReject)
+	cmd := transport.Command{Method: "sum", Id: 1}
+	for index := 0; index < 3; index++ {
+		// storage goroutine must not be blocked
+		manager.PutBackHandler(&cmd, manager.Uid())
+	}
+	takeTasks(t, manager, 3)
+	checkEmpty(t, manager)
+}
+
+func TestOverflowSpillToDisk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-spill")
+	defer os.RemoveAll(dir)
+	manager := newTestManager(commonserver.OverflowSpill)
+	options := spillqueue.Options{Path: dir, MaxCount: 2, SegmentSize: 256}
+	disk, err := spillqueue.NewSegmentQueue(dir, options.SegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.SetSpillQueue(disk, options)
+	defer manager.CloseSpillQueue()
+	cmd := transport.Command{Method: "sum", Id: 1, Params: `{"a": 1}`}
+	var expected []string
+	for index := 0; index < 10; index++ {
+		task, err := manager.AddCommand(&cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, task)
+	}
+	// 2 in queue, 2 in memory
+	if manager.SpilledLength() != 6 || manager.QueueLength() != 10 {
+		t.Errorf("incorrect spilled %d of %d", manager.SpilledLength(), manager.QueueLength())
+	}
+	tasks := takeTasks(t, manager, 10)
+	checkEmpty(t, manager)
+	for index := range expected {
+		if tasks[index] != expected[index] {
+			t.Fatalf("incorrect order %v, expected %v", tasks, expected)
+		}
+	}
+	if manager.SpilledLength() != 0 {
+		t.Errorf("spilled commands after read %d", manager.SpilledLength())
+	}
+}
+
+// manager with disk part and commands in queue (2), in memory (2) and on disk
+func spillCommands(t *testing.T, dir string, count int) (
+	*commonserver.DataStreamManager, []string, []chan transport.Answer) {
+	//
+	manager := newTestManager(commonserver.OverflowSpill)
+	options := spillqueue.Options{Path: dir, MaxCount: 2, SegmentSize: 256}
+	disk, err := spillqueue.NewSegmentQueue(dir, options.SegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.SetSpillQueue(disk, options)
+	var tasks []string
+	var channels []chan transport.Answer
+	for index := 0; index < count; index++ {
+		cmd := transport.Command{Method: "sum", Id: index}
+		task, resultChannel, err := manager.AddWaitCommand(&cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+		channels = append(channels, resultChannel)
+	}
+	return manager, tasks, channels
+}
+
+// answer of lost spilled task
+func checkLost(t *testing.T, resultChannel chan transport.Answer) {
+	select {
+	case answer := <-resultChannel:
+		if answer.Error.Code != commonserver.AnswerInternalError {
+			t.Errorf("incorrect answer of lost task %s", answer.String())
+		}
+	default:
+		t.Error("no answer for lost task")
+	}
+}
+
+func TestOverflowSpillBadRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-overflow")
+	defer os.RemoveAll(dir)
+	manager, expected, channels := spillCommands(t, dir, 6)
+	defer manager.CloseSpillQueue()
+	// data of first record on disk
+	names, _ := filepath.Glob(filepath.Join(dir, "*.q"))
+	file, err := os.OpenFile(names[0], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("x"), 4)
+	file.Close()
+	// bad record is skipped, commands after it are read
+	tasks := takeTasks(t, manager, 5)
+	checkEmpty(t, manager)
+	expected = append(expected[:4], expected[5])
+	for index := range expected {
+		if tasks[index] != expected[index] {
+			t.Fatalf("incorrect order %v, expected %v", tasks, expected)
+		}
+	}
+	checkLost(t, channels[4])
+	if manager.SpilledLength() != 0 {
+		t.Errorf("spilled commands after read %d", manager.SpilledLength())
+	}
+}
+
+func TestOverflowSpillCorruptedSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-overflow")
+	defer os.RemoveAll(dir)
+	manager, expected, channels := spillCommands(t, dir, 8)
+	defer manager.CloseSpillQueue()
+	// header of first record on disk is incomplete
+	names, _ := filepath.Glob(filepath.Join(dir, "*.q"))
+	if err := os.Truncate(names[0], 2); err != nil {
+		t.Fatal(err)
+	}
+	tasks := takeTasks(t, manager, 4)
+	checkEmpty(t, manager)
+	for index := range tasks {
+		if tasks[index] != expected[index] {
+			t.Fatalf("incorrect order %v, expected %v", tasks, expected)
+		}
+	}
+	// all commands on disk get dead letters
+	for _, resultChannel := range channels[4:] {
+		checkLost(t, resultChannel)
+	}
+	if manager.SpilledLength() != 0 || manager.QueueLength() != 0 {
+		t.Errorf("spilled commands after read error %d", manager.SpilledLength())
+	}
+	// disk part is available for new commands
+	expected = nil
+	cmd := transport.Command{Method: "sum", Id: 1}
+	for index := 0; index < 5; index++ {
+		task, err := manager.AddCommand(&cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, task)
+	}
+	if manager.SpilledLength() != 1 {
+		t.Errorf("incorrect spilled %d", manager.SpilledLength())
+	}
+	tasks = takeTasks(t, manager, 5)
+	checkEmpty(t, manager)
+	for index := range tasks {
+		if tasks[index] != expected[index] {
+			t.Fatalf("incorrect order %v, expected %v", tasks, expected)
+		}
+	}
+}
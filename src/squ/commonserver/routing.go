@@ -0,0 +1,140 @@
+package commonserver
+
+import (
+	"sort"
+	"squ/helpers"
+	"squ/transport"
+)
+
+// routed command is in queue of executer, sub-task of fan-out isn't routed
+func (state *fanoutState) isRoutedLocked(cmd *transport.TaskCommand) bool {
+	if cmd.RoutingKey == "" {
+		return false
+	}
+	_, isSubTask := state.subTasks[cmd.Task]
+	return !isSubTask
+}
+
+// executer of key by consistent hash over executers of method (and selector),
+// nil without executers. Lock must be taken.
+func (state *fanoutState) ownerLocked(cmd *transport.Command) *executerNode {
+	var names []string
+	for name, item := range state.nodes {
+		if item.accepts(cmd) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	return state.nodes[names[helpers.KeyNode(cmd.RoutingKey, names)]]
+}
+
+// put routed command to queue of owner or park it, lock must be taken
+func (state *fanoutState) placeLocked(cmd transport.TaskCommand, front bool) {
+	owner := state.ownerLocked(&cmd.Command)
+	if owner == nil {
+		if front {
+			state.parked[cmd.Method] = append([]transport.TaskCommand{cmd}, state.parked[cmd.Method]...)
+		} else {
+			state.parked[cmd.Method] = append(state.parked[cmd.Method], cmd)
+		}
+		return
+	}
+	if front {
+		owner.queue = append([]transport.TaskCommand{cmd}, owner.queue...)
+	} else {
+		owner.queue = append(owner.queue, cmd)
+	}
+	select {
+	case owner.notify <- true:
+	default:
+	}
+}
+
+// routed commands of removed executer are parked until rebalance, lock must be taken
+func (state *fanoutState) parkLocked(item *executerNode) {
+	for _, cmd := range item.queue {
+		if state.isRoutedLocked(&cmd) {
+			state.parked[cmd.Method] = append(state.parked[cmd.Method], cmd)
+		}
+	}
+	item.queue = nil
+}
+
+// Routed commands of methods are moved to new owners after join or leave of executer,
+// only keys of changed executer move. Lock must be taken.
+func (state *fanoutState) rebalanceLocked(methods []string) {
+	changed := make(map[string]bool)
+	for _, method := range methods {
+		changed[method] = true
+	}
+	names := make([]string, 0, len(state.nodes))
+	for name := range state.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var moved []transport.TaskCommand
+	for method := range changed {
+		moved = append(moved, state.parked[method]...)
+		delete(state.parked, method)
+	}
+	for _, name := range names {
+		item := state.nodes[name]
+		queue := item.queue[:0]
+		for _, cmd := range item.queue {
+			if changed[cmd.Method] && state.isRoutedLocked(&cmd) &&
+				state.ownerLocked(&cmd.Command) != item {
+				//
+				moved = append(moved, cmd)
+			} else {
+				queue = append(queue, cmd)
+			}
+		}
+		for index := len(queue); index < len(item.queue); index++ {
+			item.queue[index] = transport.TaskCommand{}
+		}
+		item.queue = queue
+	}
+	for _, cmd := range moved {
+		state.placeLocked(cmd, false)
+	}
+}
+
+// put command to queue of executer for routing key, ErrQueueFull if it's full
+func (manager *DataStreamManager) route(cmd *transport.Command, task string) error {
+	state := manager.fanout
+	manager.tracer.TaskEnqueue(task, cmd.Method, cmd.Traceparent)
+	manager.stats.TaskEnqueued(task, cmd.Method)
+	state.lock.Lock()
+	queueLength := len(state.parked[cmd.Method])
+	owner := state.ownerLocked(cmd)
+	if owner != nil {
+		queueLength = len(owner.queue)
+	}
+	if queueLength >= cap(*manager.execRequestChannel) {
+		state.lock.Unlock()
+		manager.stats.QueueFull(cmd.Method)
+		return manager.reject(cmd, task, "queue of executer")
+	}
+	state.placeLocked(transport.TaskCommand{Command: *cmd, Task: task}, false)
+	state.lock.Unlock()
+	manager.tracer.TaskEnqueued(task)
+	if owner == nil {
+		TaskLog(task, cmd).Debug("Routed task is parked without executers")
+	}
+	return nil
+}
+
+// routed or selected command after timeout of executer is first in queue
+func (state *fanoutState) routeReturned(cmd transport.TaskCommand) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if cmd.RoutingKey != "" {
+		state.placeLocked(cmd, true)
+	} else {
+		state.selected = append([]transport.TaskCommand{cmd}, state.selected...)
+		state.notifyMatchingLocked(&cmd.Command)
+	}
+}
@@ -0,0 +1,71 @@
+package commonserver_test
+
+import (
+	"fmt"
+	"squ/commonserver"
+	"squ/helpers"
+	"squ/transport"
+	"testing"
+)
+
+// keys of commands from queue of executer
+func takeKeys(t *testing.T, manager *commonserver.DataStreamManager, node string) []string {
+	var keys []string
+	for {
+		timeout, cmd := manager.GetNodeExecCmd(node)
+		if timeout {
+			return keys
+		}
+		keys = append(keys, cmd.RoutingKey)
+	}
+}
+
+func TestRouting(t *testing.T) {
+	manager := commonserver.NewDataStreamManager(commonserver.StreamOptions{QueueSize: 100, PauseGetCmd: 1})
+	// without executers commands are parked
+	for index := 0; index < 20; index++ {
+		cmd := transport.Command{Method: "calc", Id: index, RoutingKey: fmt.Sprintf("key-%d", index%10)}
+		if _, err := manager.AddCommand(&cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkEmpty(t, manager)
+	manager.RegisterExecuter("a", nil, "calc")
+	manager.RegisterExecuter("b", nil, "calc")
+	manager.RegisterExecuter("c", nil, "calc")
+	nodes := []string{"a", "b", "c"}
+	for _, node := range nodes[:2] {
+		for _, key := range takeKeys(t, manager, node) {
+			if owner := nodes[helpers.KeyNode(key, nodes)]; owner != node {
+				t.Errorf("key %s for %s, expected %s", key, node, owner)
+			}
+		}
+	}
+	// "c" leaves with its commands
+	manager.UnregisterExecuter("c", "calc")
+	moved := 0
+	for _, node := range nodes[:2] {
+		for _, key := range takeKeys(t, manager, node) {
+			if owner := nodes[helpers.KeyNode(key, nodes[:2])]; owner != node {
+				t.Errorf("moved key %s for %s, expected %s", key, node, owner)
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("commands of removed executer expected")
+	}
+	// returned command goes to current owner first
+	manager.AddCommand(&transport.Command{Method: "calc", Id: 1, RoutingKey: "other"})
+	timeout, cmd := manager.GetNodeExecCmd(nodes[helpers.KeyNode("other", nodes[:2])])
+	if timeout {
+		t.Fatal("no routed command")
+	}
+	manager.RegisterExecuter("c", nil, "calc")
+	manager.PutBackHandler(&cmd.Command, cmd.Task)
+	if timeout, returned := manager.GetNodeExecCmd(nodes[helpers.KeyNode("other", nodes)]); timeout ||
+		returned.Task != cmd.Task {
+		//
+		t.Error("returned command to owner expected")
+	}
+}
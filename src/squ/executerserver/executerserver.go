@@ -3,13 +3,10 @@ package executerserver
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"squ/cmdexecstorage"
 	common "squ/commonserver"
 	"squ/helpers"
 	"squ/logger"
 	"squ/transport"
-	"strings"
 )
 
 const (
@@ -20,32 +17,33 @@ const (
 	CreateUid          = "uid"  // test create uid
 )
 
-var debugMode bool
-
 // service format types
 type RegParams struct {
 	Methods []string
+	// labels of executer for selectors of commands (region, gpu, version, tenant)
+	Labels map[string]string
 }
 
-// StateUpdater
+// StateUpdater, methods are registered for fan-out commands of connection too
 type MethodRegistrator struct {
-	methodNames []string
-}
-
-func init() {
-	debugMode = strings.ToUpper(os.Getenv("DEBUG")) == "TRUE"
+	methodNames       []string
+	labels            map[string]string
+	about             string
+	dataStreamManager *common.DataStreamManager
 }
 
 func (registrator MethodRegistrator) Execute(provider *common.StateProvider) bool {
 	var result bool
 	if len(registrator.methodNames) > 0 {
 		result = provider.AddSupportedMethod(registrator.methodNames...)
-		if logger.DebugLevel {
+		registrator.dataStreamManager.RegisterExecuter(
+			registrator.about, registrator.labels, registrator.methodNames...)
+		if logger.IsDebug() {
 			msg := "New methods:"
 			for _, method := range registrator.methodNames {
 				msg = fmt.Sprintf("%s\n  %s +1", msg, method)
 			}
-			logger.Debug(msg)
+			logger.Debug("%s", msg)
 		}
 	}
 	return result
@@ -55,12 +53,13 @@ func (registrator MethodRegistrator) Rollback(provider *common.StateProvider) bo
 	var result bool
 	if len(registrator.methodNames) > 0 {
 		result = provider.RemoveSupportedMethod(registrator.methodNames...)
-		if logger.DebugLevel {
+		registrator.dataStreamManager.UnregisterExecuter(registrator.about, registrator.methodNames...)
+		if logger.IsDebug() {
 			msg := "Remove methods:"
 			for _, method := range registrator.methodNames {
 				msg = fmt.Sprintf("%s\n  %s -1", msg, method)
 			}
-			logger.Debug(msg)
+			logger.Debug("%s", msg)
 		}
 	}
 	return result
@@ -103,7 +102,11 @@ func CommandHandler(
 			params := RegParams{}
 			logger.Debug("Registrtion data %s", command.Params)
 			if err := json.Unmarshal([]byte(command.Params), &params); err == nil {
-				registrator := MethodRegistrator{methodNames: params.Methods}
+				registrator := MethodRegistrator{
+					methodNames:       params.Methods,
+					labels:            params.Labels,
+					about:             about,
+					dataStreamManager: dataStreamManager}
 				answer := transport.NewAnswer(command.Id, "{\"ok\": true}")
 				return answer, registrator, true
 			} else {
@@ -115,9 +118,8 @@ func CommandHandler(
 		}
 	case CreateUid:
 		{
-			if debugMode {
-				rand := helpers.NewSystemRandom()
-				answer = transport.NewAnswer(command.Id, rand.Uid())
+			if dataStreamManager.Debug {
+				answer = transport.NewAnswer(command.Id, dataStreamManager.Uid())
 			} else {
 				answer = transport.NewErrorAnswer(
 					command.Id, common.AnswerAccessError, "Supported only for debug mode.")
@@ -127,17 +129,45 @@ func CommandHandler(
 		}
 	case ResultMethodReturn:
 		{
-			//store := cmdexecstorage.NewCmdExecStorage(nil)
-			// free cell
-
+			// free cell and send result to waiter
+			result := transport.TaskResult{}
+			if err := json.Unmarshal([]byte(command.Params), &result); err != nil {
+				logger.Error("Format error for %s from %s", command, about)
+				answer = transport.NewErrorAnswer(
+					command.Id, common.AnswerCodeFormatError, fmt.Sprintf("%s", err))
+				return answer, nil, false
+			}
+			store := dataStreamManager.Storage()
+			taskLog := common.TaskLog(result.Task, nil).With(
+				logger.Fields{logger.FieldConnection: about})
+			if store.Free(result.Task) {
+				taskLog.Debug("Result of task")
+				errMsg := ""
+				failed := result.Error != nil && result.Error.Exists()
+				if failed {
+					errMsg = result.Error.Message
+				}
+				dataStreamManager.Tracer().TaskResult(result.Task, errMsg)
+				dataStreamManager.Stats().TaskResult(result.Task, failed)
+				if !dataStreamManager.PutResult(result.Task, result.Answer(0)) {
+					taskLog.Debug("Nobody waits result of task")
+				}
+				answer = transport.NewAnswer(command.Id, "{\"ok\": true}")
+			} else {
+				taskLog.Warn("Unknown task")
+				answer = transport.NewErrorAnswer(
+					command.Id, common.AnswerUnknownTask, "Unknown or expired task.")
+			}
 		}
 	case SendCommand:
 		{
 			// only for debug
-			if debugMode {
-				rand := helpers.NewSystemRandom()
-				answer = transport.NewAnswer(command.Id, rand.Uid())
-				dataStreamManager.AddCommand(cmd)
+			if dataStreamManager.Debug {
+				if task, err := dataStreamManager.AddCommand(cmd); err == nil {
+					answer = transport.NewAnswer(command.Id, task)
+				} else {
+					answer = common.NewEnqueueErrorAnswer(command.Id, err)
+				}
 			} else {
 				answer = transport.NewErrorAnswer(
 					command.Id, common.AnswerAccessError, "Supported only for debug mode.")
@@ -147,25 +177,30 @@ func CommandHandler(
 		}
 	case GetExecute:
 		{
-			if timeout, cmd := dataStreamManager.GetExecCmd(); timeout {
+			if timeout, cmd := dataStreamManager.GetNodeExecCmd(about); timeout {
 				// no command
 				logger.Debug("no command for %s", about)
 				answer = transport.NewAnswer(command.Id, "{\"ok\": false}")
 				logger.Debug("answer: %s", answer.String())
 			} else {
-				// get command and create task id
-				uid := helpers.NewSystemRandom().Uid()
-				logger.Debug("Execute task in %s for cmd: %s", uid, cmd.Method)
+				// get command with task id
+				uid := cmd.Task
+				common.TaskLog(uid, &cmd.Command).With(
+					logger.Fields{logger.FieldConnection: about}).Debug("Execute task")
 				// timeout can be in cmd
 				timeout := helpers.FindTimeout(&(cmd.Params))
-				// use once ptr to this store
-				store := cmdexecstorage.NewCmdExecStorage(nil, false)
-				if store.Push(uid, cmd, timeout) {
-					answer = transport.PackCmd(cmd, uid)
+				store := dataStreamManager.Storage()
+				if store.Push(uid, &cmd.Command, timeout) {
+					// executer continues trace from process span
+					if traceparent := dataStreamManager.Tracer().TaskDispatched(uid); traceparent != "" {
+						cmd.Command.Traceparent = traceparent
+					}
+					answer = transport.PackCmd(&cmd.Command, uid)
+					answer.Id = command.Id
 				} else {
 					logger.Error("Wrong command store at %p", store)
 					answer = transport.NewErrorAnswer(
-						cmd.Id,
+						command.Id,
 						common.AnswerInternalError,
 						"Problem with command data storage")
 				}
@@ -174,7 +209,3 @@ func CommandHandler(
 	}
 	return answer, nil, false
 }
-
-func init() {
-	// make timer channel for GetExecute reject
-}
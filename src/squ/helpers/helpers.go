@@ -4,6 +4,7 @@ import (
 	sha "crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"sync"
 	"time"
@@ -27,6 +28,7 @@ type SysRandom struct {
 }
 
 var onceRand *SysRandom
+var onceRandLock sync.Mutex
 
 // replace base Intn
 func (sysRand *SysRandom) safeIntn(n int) int {
@@ -73,12 +75,20 @@ func (sysRand *SysRandom) Question() bool {
 	return sysRand.FromRangeInt(0, randIntLimit+1) > randIntLimit/2
 }
 
+// New independent random source
+func NewSysRandom() *SysRandom {
+	newRand := SysRandom{
+		*(rand.New(rand.NewSource(time.Now().UTC().UnixNano()))),
+		new(sync.RWMutex)}
+	return &newRand
+}
+
+// Shared random source of process
 func NewSystemRandom() *SysRandom {
+	onceRandLock.Lock()
+	defer onceRandLock.Unlock()
 	if onceRand == nil {
-		newRand := SysRandom{
-			*(rand.New(rand.NewSource(time.Now().UTC().UnixNano()))),
-			new(sync.RWMutex)}
-		onceRand = &newRand
+		onceRand = NewSysRandom()
 	}
 	return onceRand
 }
@@ -98,3 +108,53 @@ func FindTimeout(param *string) int {
 	}
 	return int(1000 * p.Timeout)
 }
+
+// Hash of any key (FNV-1a 64)
+func HashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
+
+// Jump consistent hash (Lamping, Veach): bucket in [0, buckets),
+// only 1/n of keys move when count of buckets grows to n
+func JumpHash(key uint64, buckets int) int {
+	var bucket, next int64 = -1, 0
+	for next < int64(buckets) {
+		bucket = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(bucket+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(bucket)
+}
+
+// Bucket for key with consistent hash, 0 if buckets <= 1
+func KeyBucket(key string, buckets int) int {
+	if buckets <= 1 {
+		return 0
+	}
+	return JumpHash(HashKey(key), buckets)
+}
+
+// finalizer of splitmix64
+func mixHash(value uint64) uint64 {
+	value ^= value >> 30
+	value *= 0xbf58476d1ce4e5b9
+	value ^= value >> 27
+	value *= 0x94d049bb133111eb
+	value ^= value >> 31
+	return value
+}
+
+// Index of node for key by rendezvous hash (highest random weight),
+// only keys of removed or added node move, -1 without nodes
+func KeyNode(key string, nodes []string) int {
+	best, bestWeight := -1, uint64(0)
+	keyHash := HashKey(key)
+	for index, node := range nodes {
+		if weight := mixHash(keyHash ^ HashKey(node)); best < 0 || weight > bestWeight {
+			best, bestWeight = index, weight
+		}
+	}
+	return best
+}
@@ -1,6 +1,7 @@
 package helpers_test
 
 import (
+	"fmt"
 	"squ/helpers"
 	"testing"
 	"math"
@@ -118,3 +119,60 @@ func TestSimpleFindTimeout(t *testing.T) {
 		t.Error("incorrect result")
 	}
 }
+
+func TestJumpHash(t *testing.T) {
+	const keys = 10000
+	counts := make([]int, 10)
+	moved := 0
+	for index := 0; index < keys; index++ {
+		key := fmt.Sprintf("task-%d", index)
+		bucket := helpers.KeyBucket(key, 10)
+		if bucket < 0 || bucket >= 10 {
+			t.Fatalf("bucket %d out of range", bucket)
+		}
+		counts[bucket]++
+		if helpers.KeyBucket(key, 11) != bucket {
+			moved++
+		}
+	}
+	for bucket, count := range counts {
+		if math.Abs(float64(count)-keys/10) > keys/10*0.15 {
+			t.Errorf("bucket %d has %d keys", bucket, count)
+		}
+	}
+	// about 1/11 of keys moves to new bucket
+	if moved > keys/11*2 {
+		t.Errorf("%d keys moved", moved)
+	}
+	if helpers.KeyBucket("any", 1) != 0 || helpers.KeyBucket("any", 0) != 0 {
+		t.Error("single bucket expected")
+	}
+}
+
+func TestKeyNode(t *testing.T) {
+	const keys = 10000
+	nodes := []string{"a", "b", "c", "d", "e"}
+	counts := make([]int, len(nodes))
+	owners := make(map[string]string)
+	for index := 0; index < keys; index++ {
+		key := fmt.Sprintf("customer-%d", index)
+		node := helpers.KeyNode(key, nodes)
+		counts[node]++
+		owners[key] = nodes[node]
+	}
+	for node, count := range counts {
+		if math.Abs(float64(count)-keys/5) > keys/5*0.15 {
+			t.Errorf("node %s has %d keys", nodes[node], count)
+		}
+	}
+	// only keys of removed node move
+	left := []string{"a", "b", "d", "e"}
+	for key, owner := range owners {
+		if node := left[helpers.KeyNode(key, left)]; owner != "c" && node != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, node)
+		}
+	}
+	if helpers.KeyNode("any", nil) != -1 {
+		t.Error("no node expected")
+	}
+}
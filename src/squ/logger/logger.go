@@ -1,12 +1,16 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -19,18 +23,20 @@ const (
 	LevelTerminate
 )
 
-var level int
+const (
+	// exit code of Terminate
+	TerminateExitCode = 1
+	// time of text records, as in standard log
+	TextTimeFormat = "2006/01/02 15:04:05"
+)
 
-var DebugLevel bool
+var level int32
 
-func logLevel() int {
-	levelEnv := strings.ToUpper(os.Getenv("LOGLEVEL"))
-	switch levelEnv {
+// Level from name (DEBUG, INFO, WARN, ERROR, SILENT), INFO by default
+func ParseLevel(name string) int {
+	switch strings.ToUpper(name) {
 	case "DEBUG":
-		{
-			log.Println("Logger debug level on")
-			return LevelDebug
-		}
+		return LevelDebug
 	case "INFO":
 		return LevelInfo
 	case "WARN":
@@ -44,6 +50,19 @@ func logLevel() int {
 	}
 }
 
+func IsLevelName(name string) bool {
+	switch strings.ToUpper(name) {
+	case "DEBUG", "INFO", "WARN", "ERROR", "SILENT":
+		return true
+	default:
+		return false
+	}
+}
+
+func GetLevelName(logLevel int) string {
+	return getLevelName(logLevel)
+}
+
 func getPath() string {
 	result := ""
 	if pc, file, line, ok := runtime.Caller(DeepCall); ok {
@@ -72,47 +91,268 @@ func getLevelName(logLevel int) string {
 	}
 }
 
-func outLog(logLevel int, msg *string) {
+// Fields of structured record
+type Fields map[string]interface{}
+
+// common field names
+const (
+	FieldConnection = "connection"
+	FieldMethod     = "method"
+	FieldTask       = "task"
+	FieldCommand    = "cmd_id"
+	FieldPackage    = "package"
+	FieldJob        = "job"
+)
+
+// output formats
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+var format int32 // 0 - text, 1 - json
+var packageLevels map[string]int
+var packageLevelsLock sync.RWMutex
+var hasPackageLevels int32
+
+func IsFormatName(name string) bool {
+	switch strings.ToLower(name) {
+	case "", FormatText, FormatJson:
+		return true
+	default:
+		return false
+	}
+}
+
+// Output format: "text" (default) or "json" lines
+func SetFormat(name string) {
+	if strings.ToLower(name) == FormatJson {
+		atomic.StoreInt32(&format, 1)
+	} else {
+		atomic.StoreInt32(&format, 0)
+	}
+}
+
+func GetFormat() string {
+	if atomic.LoadInt32(&format) == 1 {
+		return FormatJson
+	}
+	return FormatText
+}
+
+// Level for package (short name, as "commonserver"), it's over common level
+func SetPackageLevel(pkg string, newLevel int) {
+	packageLevelsLock.Lock()
+	defer packageLevelsLock.Unlock()
+	if packageLevels == nil {
+		packageLevels = make(map[string]int)
+	}
+	packageLevels[pkg] = newLevel
+	atomic.StoreInt32(&hasPackageLevels, 1)
+}
+
+// Replace all package levels
+func SetPackageLevels(levels map[string]int) {
+	packageLevelsLock.Lock()
+	defer packageLevelsLock.Unlock()
+	packageLevels = make(map[string]int, len(levels))
+	for pkg, pkgLevel := range levels {
+		packageLevels[pkg] = pkgLevel
+	}
+	if len(packageLevels) > 0 {
+		atomic.StoreInt32(&hasPackageLevels, 1)
+	} else {
+		atomic.StoreInt32(&hasPackageLevels, 0)
+	}
+}
+
+// Remove all package levels
+func ResetPackageLevels() {
+	packageLevelsLock.Lock()
+	defer packageLevelsLock.Unlock()
+	packageLevels = nil
+	atomic.StoreInt32(&hasPackageLevels, 0)
+}
+
+func GetPackageLevels() map[string]int {
+	packageLevelsLock.RLock()
+	defer packageLevelsLock.RUnlock()
+	result := make(map[string]int, len(packageLevels))
+	for pkg, pkgLevel := range packageLevels {
+		result[pkg] = pkgLevel
+	}
+	return result
+}
+
+// short package name of function in stack
+func callerPackage(skip int) string {
+	if pc, _, _, ok := runtime.Caller(skip + 1); ok {
+		name := filepath.Base(runtime.FuncForPC(pc).Name())
+		if index := strings.Index(name, "."); index > 0 {
+			return name[:index]
+		}
+		return name
+	}
+	return ""
+}
+
+// level check for caller of log function
+func enabled(logLevel int) bool {
+	current := int(atomic.LoadInt32(&level))
+	if atomic.LoadInt32(&hasPackageLevels) == 1 {
+		// out -> Info -> caller
+		pkg := callerPackage(DeepCall - 1)
+		packageLevelsLock.RLock()
+		if pkgLevel, exists := packageLevels[pkg]; exists {
+			current = pkgLevel
+		}
+		packageLevelsLock.RUnlock()
+	}
+	if logLevel == LevelTerminate {
+		return true
+	}
+	return current != LevelSilent && logLevel >= current
+}
+
+func jsonLine(logLevel int, stackInfo string, msg *string, fields Fields) []byte {
+	record := make(map[string]interface{}, len(fields)+4)
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		record[key] = value
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = getLevelName(logLevel)
+	record["msg"] = *msg
+	if stackInfo != "" {
+		record["caller"] = stackInfo
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{
+			"level": getLevelName(logLevel), "msg": *msg, "error": err.Error()})
+	}
+	return append(data, '\n')
+}
+
+func textFields(fields Fields) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for index, key := range keys {
+		parts[index] = fmt.Sprintf("%s=%v", key, fields[key])
+	}
+	return " [" + strings.Join(parts, " ") + "]"
+}
+
+func outLog(logLevel int, msg *string, fields Fields) {
 	stackInfo := ""
 	if logLevel != LevelInfo && logLevel != LevelWarn {
 		stackInfo = getPath()
 	}
-	if logLevel == LevelTerminate {
-		panic(fmt.Sprintf("%s %s", stackInfo, *msg))
+	var line []byte
+	timePrefix := ""
+	if atomic.LoadInt32(&format) == 1 {
+		line = jsonLine(logLevel, stackInfo, msg, fields)
 	} else {
-		log.Printf(
-			"%s-> %s %s\n", getLevelName(logLevel), stackInfo, *msg)
+		timePrefix = time.Now().Format(TextTimeFormat) + " "
+		line = []byte(fmt.Sprintf(
+			"%s-> %s %s%s\n",
+			getLevelName(logLevel), stackInfo, *msg, textFields(fields)))
 	}
+	write(logLevel, timePrefix, line)
 }
 
-func out(logLevel int, format string, a ...interface{}) {
-	if logLevel >= level {
+func out(logLevel int, fields Fields, format string, a ...interface{}) {
+	if enabled(logLevel) {
 		msg := fmt.Sprintf(format, a...)
-		outLog(logLevel, &msg)
+		outLog(logLevel, &msg, fields)
 	}
 }
 
 func Info(format string, a ...interface{}) {
-	out(LevelInfo, format, a...)
+	out(LevelInfo, nil, format, a...)
 }
 
 func Debug(format string, a ...interface{}) {
-	out(LevelDebug, format, a...)
+	out(LevelDebug, nil, format, a...)
 }
 
 func Warn(format string, a ...interface{}) {
-	out(LevelWarn, format, a...)
+	out(LevelWarn, nil, format, a...)
 }
 
 func Error(format string, a ...interface{}) {
-	out(LevelError, format, a...)
+	out(LevelError, nil, format, a...)
 }
 
+// Fatal record and exit of process, only for main package,
+// library code returns errors
 func Terminate(format string, a ...interface{}) {
-	out(LevelTerminate, format, a...)
+	out(LevelTerminate, nil, format, a...)
+	os.Exit(TerminateExitCode)
+}
+
+// Record with fields
+type Entry struct {
+	fields Fields
+}
+
+func With(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// New entry with additional fields
+func (entry *Entry) With(fields Fields) *Entry {
+	result := make(Fields, len(entry.fields)+len(fields))
+	for key, value := range entry.fields {
+		result[key] = value
+	}
+	for key, value := range fields {
+		result[key] = value
+	}
+	return &Entry{fields: result}
+}
+
+func (entry *Entry) Info(format string, a ...interface{}) {
+	out(LevelInfo, entry.fields, format, a...)
+}
+
+func (entry *Entry) Debug(format string, a ...interface{}) {
+	out(LevelDebug, entry.fields, format, a...)
+}
+
+func (entry *Entry) Warn(format string, a ...interface{}) {
+	out(LevelWarn, entry.fields, format, a...)
+}
+
+func (entry *Entry) Error(format string, a ...interface{}) {
+	out(LevelError, entry.fields, format, a...)
+}
+
+func SetLevel(newLevel int) {
+	atomic.StoreInt32(&level, int32(newLevel))
+	if newLevel == LevelDebug {
+		Debug("Logger debug level on")
+	}
+}
+
+func GetLevel() int {
+	return int(atomic.LoadInt32(&level))
+}
+
+// Common level is debug
+func IsDebug() bool {
+	return GetLevel() == LevelDebug
 }
 
 func init() {
-	level = logLevel()
-	DebugLevel = level == LevelDebug
+	SetLevel(LevelInfo)
 }
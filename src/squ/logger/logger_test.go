@@ -0,0 +1,149 @@
+package logger_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"squ/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+func capture(t *testing.T, handler func()) string {
+	buffer := bytes.Buffer{}
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+	handler()
+	return buffer.String()
+}
+
+func TestJsonFields(t *testing.T) {
+	logger.SetFormat(logger.FormatJson)
+	defer logger.SetFormat(logger.FormatText)
+	output := capture(t, func() {
+		logger.With(logger.Fields{logger.FieldTask: "t1", logger.FieldMethod: "sum"}).Info("done %d", 1)
+	})
+	record := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(output), &record); err != nil {
+		t.Fatalf("incorrect json line %s: %s", output, err)
+	}
+	if record["msg"] != "done 1" || record["level"] != "INFO" ||
+		record[logger.FieldTask] != "t1" || record[logger.FieldMethod] != "sum" {
+		t.Fatalf("incorrect record %v", record)
+	}
+}
+
+func TestTextFields(t *testing.T) {
+	output := capture(t, func() {
+		logger.With(logger.Fields{logger.FieldTask: "t1"}).With(logger.Fields{logger.FieldMethod: "sum"}).Warn("done")
+	})
+	if !strings.Contains(output, "done [method=sum task=t1]") {
+		t.Fatalf("incorrect line %s", output)
+	}
+	// time prefix for sink without own time
+	if len(output) < len(logger.TextTimeFormat) {
+		t.Fatalf("short line %s", output)
+	}
+	if _, err := time.Parse(logger.TextTimeFormat, output[:len(logger.TextTimeFormat)]); err != nil {
+		t.Errorf("no time in line %s", output)
+	}
+}
+
+func TestPackageLevel(t *testing.T) {
+	defer logger.SetLevel(logger.LevelInfo)
+	defer logger.ResetPackageLevels()
+	logger.SetLevel(logger.LevelError)
+	if logger.IsDebug() {
+		t.Fatal("debug with error level")
+	}
+	output := capture(t, func() { logger.Info("hidden") })
+	if output != "" {
+		t.Fatalf("info with error level: %s", output)
+	}
+	logger.SetPackageLevel("logger_test", logger.LevelDebug)
+	output = capture(t, func() { logger.Debug("visible") })
+	if !strings.Contains(output, "visible") {
+		t.Fatalf("no debug for package level")
+	}
+	logger.SetPackageLevel("logger_test", logger.LevelSilent)
+	logger.SetLevel(logger.LevelDebug)
+	if !logger.IsDebug() {
+		t.Fatal("no debug with debug level")
+	}
+	output = capture(t, func() { logger.Error("hidden") })
+	if output != "" {
+		t.Fatalf("error with silent package level: %s", output)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "squ.log")
+	options := logger.SinkOptions{Type: logger.SinkFile, Path: path, MaxSize: 100, MaxFiles: 2}
+	if err := logger.SetSink(options); err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	for index := 0; index < 10; index++ {
+		logger.Warn("record %d with some text", index)
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if info, err := os.Stat(name); err != nil || info.Size() > 100 {
+			t.Errorf("incorrect file %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("old file is not removed")
+	}
+	content, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(content), "record 9") {
+		t.Errorf("last record expected in %s", content)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-logger")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = logger.SetSink(logger.SinkOptions{Type: logger.SinkSyslog, Path: path, Facility: "local0", Tag: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+	logger.Error("syslog record")
+	buffer := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	size, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local0 (16) * 8 + error (3)
+	message := string(buffer[:size])
+	// time of syslog header only
+	if !strings.HasPrefix(message, "<131>") || !strings.Contains(message, "test[") ||
+		!strings.Contains(message, "]: ERROR-> ") || !strings.Contains(message, "syslog record") {
+		//
+		t.Errorf("incorrect message %s", message)
+	}
+}
+
+func TestSinkValidation(t *testing.T) {
+	problems := logger.SinkOptions{Type: "kafka", MaxFiles: -1}.Validate()
+	if len(problems) != 2 {
+		t.Errorf("incorrect problems %v", problems)
+	}
+	if err := logger.SetSink(logger.SinkOptions{Type: logger.SinkFile}); err == nil {
+		t.Error("error expected for file without path")
+	}
+}
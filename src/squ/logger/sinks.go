@@ -0,0 +1,379 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sink types
+const (
+	SinkStderr = "stderr"
+	SinkFile   = "file"
+	SinkSyslog = "syslog"
+)
+
+const (
+	DefaultSyslogAddress  = "/dev/log"
+	DefaultSyslogFacility = "daemon"
+	DefaultSyslogTag      = "squ"
+	DefaultMaxFiles       = 5
+	DefaultFileMode       = 0640
+)
+
+// Destination of log records, line is complete record with newline
+type Sink interface {
+	Write(logLevel int, line []byte) error
+	Close() error
+}
+
+// Sink which adds time to its records (e.g. syslog header), text records come without time
+type TimedSink interface {
+	Sink
+	WritesTime() bool
+}
+
+// Sink options in settings
+type SinkOptions struct {
+	Type string `json:"type"`
+	// file: path, rotation by size (bytes) and by interval (sec.), number of old files
+	// syslog: path of unix socket
+	Path           string `json:"path"`
+	MaxSize        int64  `json:"max_size"`
+	RotateInterval int    `json:"rotate_interval"`
+	MaxFiles       int    `json:"max_files"`
+	// syslog only
+	Facility string `json:"facility"`
+	Tag      string `json:"tag"`
+}
+
+func (options SinkOptions) GetType() string {
+	if options.Type == "" {
+		return SinkStderr
+	}
+	return strings.ToLower(options.Type)
+}
+
+// All problems of options
+func (options SinkOptions) Validate() []string {
+	var problems []string
+	switch options.GetType() {
+	case SinkStderr:
+	case SinkFile:
+		if options.Path == "" {
+			problems = append(problems, "file sink without path")
+		}
+	case SinkSyslog:
+		if _, exists := syslogFacilities[strings.ToLower(options.Facility)]; !exists && options.Facility != "" {
+			problems = append(problems, fmt.Sprintf("unknown syslog facility '%s'", options.Facility))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown sink type '%s'", options.Type))
+	}
+	if options.MaxSize < 0 || options.RotateInterval < 0 || options.MaxFiles < 0 {
+		problems = append(problems, "negative rotation value")
+	}
+	return problems
+}
+
+// New sink for options
+func NewSink(options SinkOptions) (Sink, error) {
+	if problems := options.Validate(); len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	switch options.GetType() {
+	case SinkFile:
+		return NewFileSink(options)
+	case SinkSyslog:
+		return NewSyslogSink(options)
+	default:
+		return stderrSink{}, nil
+	}
+}
+
+var sink Sink = stderrSink{}
+var sinkOptions SinkOptions
+var sinkLock sync.Mutex
+
+// time prefix of text record is skipped for sink with own time
+func write(logLevel int, timePrefix string, line []byte) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	if timed, ok := sink.(TimedSink); timePrefix != "" && !(ok && timed.WritesTime()) {
+		line = append([]byte(timePrefix), line...)
+	}
+	if err := sink.Write(logLevel, line); err != nil {
+		// last chance for record
+		fmt.Fprintf(os.Stderr, "log sink error: %s\n%s", err, line)
+	}
+}
+
+// Replace sink of all records, it isn't changed for the same options
+func SetSink(options SinkOptions) error {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	if options == sinkOptions {
+		return nil
+	}
+	newSink, err := NewSink(options)
+	if err != nil {
+		return err
+	}
+	replaceSink(options, newSink)
+	return nil
+}
+
+// Replace sink by already opened one, e.g. when other settings can be rejected after opening
+func UseSink(options SinkOptions, newSink Sink) {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	replaceSink(options, newSink)
+}
+
+// lock must be taken
+func replaceSink(options SinkOptions, newSink Sink) {
+	sink.Close()
+	sink = newSink
+	sinkOptions = options
+}
+
+func GetSinkOptions() SinkOptions {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	return sinkOptions
+}
+
+// Close sink at exit, records go to stderr after it
+func Close() error {
+	sinkLock.Lock()
+	defer sinkLock.Unlock()
+	err := sink.Close()
+	sink = stderrSink{}
+	sinkOptions = SinkOptions{}
+	return err
+}
+
+// output of standard log package
+type stderrSink struct{}
+
+func (stderrSink) Write(logLevel int, line []byte) error {
+	_, err := log.Writer().Write(line)
+	return err
+}
+
+func (stderrSink) Close() error {
+	return nil
+}
+
+// File with rotation by size and time, old files are path.1 (newest) .. path.N
+type FileSink struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	maxFiles int
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func NewFileSink(options SinkOptions) (*FileSink, error) {
+	fileSink := FileSink{
+		path:     options.Path,
+		maxSize:  options.MaxSize,
+		interval: time.Duration(options.RotateInterval) * time.Second,
+		maxFiles: options.MaxFiles}
+	if fileSink.maxFiles <= 0 {
+		fileSink.maxFiles = DefaultMaxFiles
+	}
+	if err := fileSink.open(); err != nil {
+		return nil, err
+	}
+	return &fileSink, nil
+}
+
+func (fileSink *FileSink) open() error {
+	file, err := os.OpenFile(
+		fileSink.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fileSink.file = file
+	fileSink.size = info.Size()
+	fileSink.opened = time.Now()
+	return nil
+}
+
+func (fileSink *FileSink) backupName(index int) string {
+	return fmt.Sprintf("%s.%d", fileSink.path, index)
+}
+
+// shift old files and start new one
+func (fileSink *FileSink) rotate() error {
+	if err := fileSink.file.Close(); err != nil {
+		return err
+	}
+	fileSink.file = nil
+	os.Remove(fileSink.backupName(fileSink.maxFiles))
+	for index := fileSink.maxFiles - 1; index > 0; index-- {
+		os.Rename(fileSink.backupName(index), fileSink.backupName(index+1))
+	}
+	if err := os.Rename(fileSink.path, fileSink.backupName(1)); err != nil {
+		return err
+	}
+	return fileSink.open()
+}
+
+func (fileSink *FileSink) needRotate(size int) bool {
+	if fileSink.size == 0 {
+		return false
+	}
+	if fileSink.maxSize > 0 && fileSink.size+int64(size) > fileSink.maxSize {
+		return true
+	}
+	return fileSink.interval > 0 && time.Since(fileSink.opened) >= fileSink.interval
+}
+
+func (fileSink *FileSink) Write(logLevel int, line []byte) error {
+	if fileSink.file == nil {
+		// reopen after failed rotation
+		if err := fileSink.open(); err != nil {
+			return err
+		}
+	}
+	if fileSink.needRotate(len(line)) {
+		if err := fileSink.rotate(); err != nil {
+			return fmt.Errorf("rotation of %s: %s", fileSink.path, err)
+		}
+	}
+	written, err := fileSink.file.Write(line)
+	fileSink.size += int64(written)
+	return err
+}
+
+func (fileSink *FileSink) Close() error {
+	if fileSink.file == nil {
+		return nil
+	}
+	err := fileSink.file.Close()
+	fileSink.file = nil
+	return err
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23}
+
+// syslog severity of level
+func syslogSeverity(logLevel int) int {
+	switch logLevel {
+	case LevelDebug:
+		return 7
+	case LevelWarn:
+		return 4
+	case LevelError:
+		return 3
+	case LevelTerminate:
+		return 2
+	default:
+		return 6
+	}
+}
+
+// Local syslog over unix socket (datagram or stream), RFC 3164 format
+type SyslogSink struct {
+	address  string
+	facility int
+	tag      string
+	conn     net.Conn
+	// stream socket needs delimiter of messages
+	stream bool
+}
+
+func NewSyslogSink(options SinkOptions) (*SyslogSink, error) {
+	syslogSink := SyslogSink{
+		address:  options.Path,
+		facility: syslogFacilities[DefaultSyslogFacility],
+		tag:      options.Tag}
+	if syslogSink.address == "" {
+		syslogSink.address = DefaultSyslogAddress
+	}
+	if options.Facility != "" {
+		syslogSink.facility = syslogFacilities[strings.ToLower(options.Facility)]
+	}
+	if syslogSink.tag == "" {
+		syslogSink.tag = DefaultSyslogTag
+	}
+	if err := syslogSink.connect(); err != nil {
+		return nil, err
+	}
+	return &syslogSink, nil
+}
+
+func (syslogSink *SyslogSink) connect() error {
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		if syslogSink.conn, err = net.Dial(network, syslogSink.address); err == nil {
+			syslogSink.stream = network == "unix"
+			return nil
+		}
+	}
+	return err
+}
+
+// time is in header of message
+func (syslogSink *SyslogSink) WritesTime() bool {
+	return true
+}
+
+func (syslogSink *SyslogSink) message(logLevel int, line []byte) []byte {
+	delimiter := ""
+	if syslogSink.stream {
+		delimiter = "\n"
+	}
+	return []byte(fmt.Sprintf(
+		"<%d>%s %s[%d]: %s%s",
+		syslogSink.facility*8+syslogSeverity(logLevel),
+		time.Now().Format(time.Stamp),
+		syslogSink.tag,
+		os.Getpid(),
+		strings.TrimRight(string(line), "\n"),
+		delimiter))
+}
+
+func (syslogSink *SyslogSink) Write(logLevel int, line []byte) error {
+	message := syslogSink.message(logLevel, line)
+	if syslogSink.conn != nil {
+		if _, err := syslogSink.conn.Write(message); err == nil {
+			return nil
+		}
+		syslogSink.conn.Close()
+		syslogSink.conn = nil
+	}
+	// syslog daemon can be restarted
+	if err := syslogSink.connect(); err != nil {
+		return err
+	}
+	_, err := syslogSink.conn.Write(message)
+	return err
+}
+
+func (syslogSink *SyslogSink) Close() error {
+	if syslogSink.conn == nil {
+		return nil
+	}
+	err := syslogSink.conn.Close()
+	syslogSink.conn = nil
+	return err
+}
@@ -1,112 +1,676 @@
 package netserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	admin "squ/adminserver"
 	"squ/cmdexecstorage"
 	common "squ/commonserver"
 	executer "squ/executerserver"
 	"squ/logger"
 	receiver "squ/receiverserver"
+	"squ/resultstore"
+	"squ/scheduler"
 	"squ/settings"
+	"squ/spillqueue"
+	"squ/stats"
 	subsys "squ/subsysmanage"
+	"squ/tracing"
+	"squ/websocket"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const (
-	SubSystemStopTimeout = 15
+	SubSystemStopTimeout = settings.DefaultSubSystemStopTimeout
+	// connect to existing unix socket for check of its owner
+	staleSocketTimeout = time.Second
 )
 
+var (
+	ErrNoSettings     = errors.New("settings are not active")
+	ErrAlreadyStarted = errors.New("server can be started once")
+	ErrNotActive      = errors.New("server is not active")
+	ErrSocketInUse    = errors.New("unix socket is in use")
+)
+
+// socket operations in errors
+const (
+	OpListen = "listen"
+	OpServe  = "serve"
+)
+
+// Problem with socket: open at start and reload, or accept of connections
+type SocketError struct {
+	Target common.SocketTarget
+	Op     string
+	Err    error
+}
+
+func (err *SocketError) Error() string {
+	return fmt.Sprintf("%s %s socket %s: %s", err.Op, err.Target.GetTypeName(), err.Target, err.Err)
+}
+
+func (err *SocketError) Unwrap() error {
+	return err.Err
+}
+
+// Options of server instance
+type Options struct {
+	Settings settings.SettingsProvider
+	// debug methods ("send", "uid") for executers
+	Debug bool
+	// period of storage clearing (ms.), value from settings if 0
+	StorageIterTime int
+}
+
+// Listener of socket with its settings, key of listeners is address of socket
+type openedSocket struct {
+	target   common.SocketTarget
+	options  common.ConnectionOptions
+	listener net.Listener
+}
+
 type Server struct {
 	subsys.SubSystemOwner
+	ctx               context.Context
 	sockets           []common.SocketTarget
 	active            bool
-	keepAlivePeriod   int
+	stopped           bool
+	stopTimeout       int
 	connectionOptions common.ConnectionOptions
 	cmdExecStorage    *cmdexecstorage.CmdExecStorage
+	scheduler         *scheduler.Scheduler
+	cron              *scheduler.CronScheduler
+	results           *resultstore.Store
+	provider          *common.StateProvider
+	dataStreamManager *common.DataStreamManager
+	listeners         map[string]*openedSocket
+	lock              *sync.Mutex
+	name              string
+	reloadStatus      *admin.ReloadStatus
+	queueSize         int
+	storageIterTime   int
+	storageShards     int
+	errors            chan error
+	tracingOptions    tracing.Options
+	spillOptions      spillqueue.Options
 }
 
-func NewServer(settings settings.SettingsProvider) *Server {
+// New server with own state, it will be stopped after context cancel
+func New(ctx context.Context, options Options) (*Server, error) {
+	if options.Settings == nil || !options.Settings.IsActive() {
+		return nil, ErrNoSettings
+	}
+	if err := options.Settings.Validate(); err != nil {
+		return nil, err
+	}
+	streamOptions := options.Settings.GetStreamOptions()
+	streamOptions.Debug = options.Debug
 	server := Server{
 		SubSystemOwner:    *(subsys.NewSubSystemOwner()),
-		sockets:           settings.GetSockets(),
-		connectionOptions: settings.GetConnectionsOptions(),
-		keepAlivePeriod:   settings.GetKeepAlivePeriod()}
+		ctx:               ctx,
+		sockets:           options.Settings.GetSockets(),
+		connectionOptions: options.Settings.GetConnectionsOptions(),
+		stopTimeout:       options.Settings.GetSubSystemStopTimeout(),
+		provider:          common.NewStateProvider(),
+		dataStreamManager: common.NewDataStreamManager(streamOptions),
+		listeners:         make(map[string]*openedSocket),
+		lock:              new(sync.Mutex),
+		errors:            make(chan error, 1),
+		name:              options.Settings.GetName()}
 
+	iterTime := options.StorageIterTime
+	if iterTime <= 0 {
+		iterTime = options.Settings.GetStorageIterTime()
+	}
+	server.queueSize = streamOptions.QueueSize
+	server.storageIterTime = options.Settings.GetStorageIterTime()
+	server.storageShards = options.Settings.GetStorageShards()
+	server.cmdExecStorage = cmdexecstorage.NewShardedCmdExecStorage(
+		server.dataStreamManager.PutBackHandler, iterTime, server.storageShards)
+	server.dataStreamManager.SetStorage(server.cmdExecStorage)
+	server.RegSubSystem(server.cmdExecStorage)
+	server.scheduler = scheduler.NewScheduler(server.dataStreamManager.Release)
+	server.dataStreamManager.SetScheduler(server.scheduler)
+	server.RegSubSystem(server.scheduler)
+	server.results = resultstore.NewStore(options.Settings.GetResultTTL())
+	server.dataStreamManager.SetResultStore(server.results)
+	server.RegSubSystem(server.results)
+	server.cron = scheduler.NewCronScheduler(server.dataStreamManager.AddWaitCommand)
+	server.RegSubSystem(server.cron)
+	if err := server.cron.SetSettingsJobs(options.Settings.GetCronJobs()); err != nil {
+		server.stopStarted()
+		return nil, fmt.Errorf("cron: %s", err)
+	}
+	server.tracingOptions = options.Settings.GetTracingOptions()
+	exporter, err := tracing.NewExporter(server.tracingOptions)
+	if err != nil {
+		server.stopStarted()
+		return nil, fmt.Errorf("tracing: %s", err)
+	}
+	if exporter != nil {
+		tracer := tracing.NewTracer(exporter)
+		tracer.OnError = func(err error) {
+			logger.Warn("Span export error: %s", err)
+		}
+		server.dataStreamManager.SetTracer(tracer)
+	}
+	server.spillOptions = options.Settings.GetSpillOptions()
+	if server.spillOptions.IsActive() {
+		spillQueue, err := spillqueue.NewSegmentQueue(
+			server.spillOptions.Path, server.spillOptions.GetSegmentSize())
+		if err != nil {
+			server.stopStarted()
+			return nil, fmt.Errorf("spill: %s", err)
+		}
+		server.dataStreamManager.SetSpillQueue(spillQueue, server.spillOptions)
+	}
 	logger.Debug("Sockets in conf: %d", len(server.sockets))
-	return &server
-}
-
-func socketListen(
-	sock string,
-	sockName string,
-	handler common.CmdHandler,
-	provider *common.StateProvider,
-	dataStreamManager *common.DataStreamManager,
-	keepAlivePeriod time.Duration) {
-	//
-	listener, err := net.Listen("tcp", sock)
+	return &server, nil
+}
+
+// Stop subsystems and tracer of server which isn't created because of error
+func (server *Server) stopStarted() {
+	if !server.SendToSubSystems(subsys.SubSystemCommandCodeStop, 1000*server.stopTimeout) {
+		logger.Warn("Subsystem stoped incorrectly.")
+	}
+	if err := server.dataStreamManager.Tracer().Close(); err != nil {
+		logger.Warn("Tracing exporter close error: %s", err)
+	}
+}
+
+// Create listener for socket target, unix socket file gets mode and owner from settings
+func newListener(target *common.SocketTarget) (net.Listener, error) {
+	sock := target.GetSocket()
+	if !target.IsUnix() {
+		return net.Listen(target.GetNetwork(), sock)
+	}
+	mode, err := target.GetFileMode()
 	if err != nil {
-		logger.Terminate("Can't open connection: %s", err)
-	} else {
-		defer listener.Close()
-		active := true
-		for active {
-			newConnection, err := listener.Accept()
-			if err != nil {
-				logger.Terminate(
-					"Can't create connection to %s error: %s", sock, err)
-			} else {
-				clientAddr := fmt.Sprintf(
-					"connection:%s type: %s", newConnection.RemoteAddr(), sockName)
-				logger.Info("new %s", clientAddr)
-				tcpConnection := newConnection.(*net.TCPConn)
-				tcpConnection.SetKeepAlive(true)
-				tcpConnection.SetKeepAlivePeriod(keepAlivePeriod * time.Second)
-				// ---
-				go common.NetHandler(
-					clientAddr, provider, dataStreamManager, tcpConnection, handler)
+		return nil, err
+	}
+	uid, gid, err := target.GetOwnerIds()
+	if err != nil {
+		return nil, err
+	}
+	// stale socket file from previous run is removed, socket with listener is kept
+	if info, err := os.Stat(sock); err == nil && info.Mode()&os.ModeSocket != 0 {
+		connection, err := net.DialTimeout(common.NetworkUnix, sock, staleSocketTimeout)
+		if err == nil {
+			connection.Close()
+			return nil, ErrSocketInUse
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		logger.Warn("Remove stale socket file %s", sock)
+		if err = os.Remove(sock); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(common.NetworkUnix, sock)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(sock, mode); err == nil && (uid >= 0 || gid >= 0) {
+		err = os.Chown(sock, uid, gid)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// keepalive only for tcp
+func setKeepAlive(connection net.Conn, keepAlivePeriod int) {
+	if tcpConnection, ok := connection.(*net.TCPConn); ok {
+		tcpConnection.SetKeepAlive(true)
+		tcpConnection.SetKeepAlivePeriod(time.Duration(keepAlivePeriod) * time.Second)
+	}
+}
+
+// handler of commands for socket type
+func (server *Server) getHandler(target *common.SocketTarget) (common.CmdHandler, error) {
+	switch target.Type {
+	case common.NetAdmin:
+		return admin.NewCommandHandler(server, target.IsUnix()), nil
+	case common.NetRecеiver:
+		return receiver.CommandHandler, nil
+	case common.NetExecuter:
+		{
+			if target.GetProtocol() == common.ProtocolHttp {
+				return nil, errors.New("http protocol is not supported for executer")
 			}
+			return executer.CommandHandler, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %d server", target.Type)
+	}
+}
+
+func (server *Server) isStopped() bool {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.stopped
+}
+
+// Errors of sockets serving after start, socket is closed after error.
+// Only first error is kept until it's read.
+func (server *Server) Errors() <-chan error {
+	return server.errors
+}
+
+// serve error after Stop, socket removing or restart is normal
+func (server *Server) serveError(socket *openedSocket, err error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	address := socket.target.GetAddress()
+	if server.stopped || server.listeners[address] != socket {
+		return
+	}
+	server.closeSocket(address)
+	socketErr := &SocketError{Target: socket.target, Op: OpServe, Err: err}
+	logger.Error("%s", socketErr)
+	select {
+	case server.errors <- socketErr:
+	default:
+	}
+}
+
+func (server *Server) serveWebSocket(socket *openedSocket, handler common.CmdHandler) {
+	target, options := socket.target, socket.options
+	sockName := target.GetTypeName()
+	mux := http.NewServeMux()
+	mux.HandleFunc(target.GetUrl(), func(writer http.ResponseWriter, request *http.Request) {
+		connection, err := websocket.Upgrade(writer, request, target.AllowedOrigins)
+		if err != nil {
+			logger.Warn("Websocket handshake from %s error: %s", request.RemoteAddr, err)
+			return
+		}
+		clientAddr := fmt.Sprintf(
+			"websocket:%s type: %s", connection.RemoteAddr(), sockName)
+		logger.Info("new %s", clientAddr)
+		setKeepAlive(connection.NetConn(), options.KeepAlivePeriod)
+		common.WebSocketHandler(
+			clientAddr, server.provider, server.dataStreamManager, connection, handler, options)
+	})
+	if err := http.Serve(socket.listener, mux); err != nil {
+		server.serveError(socket, err)
+	}
+}
+
+func (server *Server) serveHttp(socket *openedSocket, handler common.CmdHandler) {
+	target, options := socket.target, socket.options
+	about := fmt.Sprintf("http:%s type: %s", target.GetSocket(), target.GetTypeName())
+	mux := http.NewServeMux()
+	if target.Type == common.NetAdmin {
+		mux.Handle(admin.MetricsUrl, admin.NewMetricsHandler(server))
+		if target.GetUrl() != admin.MetricsUrl {
+			mux.Handle(target.GetUrl(), admin.NewHttpHandler(
+				about, server.dataStreamManager, handler, options.MaxMessageSize))
+		}
+	} else {
+		mux.Handle(target.GetUrl(), receiver.NewHttpHandler(
+			about, server.dataStreamManager, target.GetWaitTimeout(), options.MaxMessageSize))
+	}
+	httpServer := http.Server{Handler: mux}
+	if err := httpServer.Serve(socket.listener); err != nil {
+		server.serveError(socket, err)
+	}
+}
+
+func (server *Server) serveLine(socket *openedSocket, handler common.CmdHandler) {
+	target, options := socket.target, socket.options
+	sockName := target.GetTypeName()
+	for {
+		newConnection, err := socket.listener.Accept()
+		if err != nil {
+			server.serveError(socket, err)
+			return
+		}
+		clientAddr := fmt.Sprintf(
+			"connection:%s type: %s", newConnection.RemoteAddr(), sockName)
+		logger.Info("new %s", clientAddr)
+		setKeepAlive(newConnection, options.KeepAlivePeriod)
+		// ---
+		go common.NetHandler(
+			clientAddr, server.provider, server.dataStreamManager, newConnection, handler, options)
+	}
+}
+
+func (server *Server) closeListeners() {
+	for address, opened := range server.listeners {
+		opened.listener.Close()
+		delete(server.listeners, address)
+	}
+}
+
+// Open socket and serve it, lock must be taken
+func (server *Server) openSocket(socketTarget common.SocketTarget) error {
+	logger.Debug("conf => %s", socketTarget)
+	handler, err := server.getHandler(&socketTarget)
+	if err != nil {
+		return &SocketError{Target: socketTarget, Op: OpListen, Err: err}
+	}
+	var serve func(*openedSocket, common.CmdHandler)
+	switch socketTarget.GetProtocol() {
+	case common.ProtocolLine:
+		serve = server.serveLine
+	case common.ProtocolWebSocket:
+		serve = server.serveWebSocket
+	case common.ProtocolHttp:
+		serve = server.serveHttp
+	default:
+		return &SocketError{
+			Target: socketTarget,
+			Op:     OpListen,
+			Err:    fmt.Errorf("unknown protocol %s", socketTarget.GetProtocol())}
+	}
+	listener, err := newListener(&socketTarget)
+	if err != nil {
+		return &SocketError{Target: socketTarget, Op: OpListen, Err: err}
+	}
+	socket := &openedSocket{
+		target:   socketTarget,
+		options:  socketTarget.GetConnectionOptions(server.connectionOptions),
+		listener: listener}
+	server.listeners[socketTarget.GetAddress()] = socket
+	go serve(socket, handler)
+	return nil
+}
+
+// Close socket by address, lock must be taken
+func (server *Server) closeSocket(address string) {
+	if opened, exists := server.listeners[address]; exists {
+		delete(server.listeners, address)
+		opened.listener.Close()
+	}
+}
+
+// Open all sockets from settings and start subsystems
+func (server *Server) Start() error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.active || server.stopped {
+		return ErrAlreadyStarted
+	}
+	for _, socketTarget := range server.sockets {
+		if err := server.openSocket(socketTarget); err != nil {
+			server.closeListeners()
+			return err
 		}
 	}
+	server.active = true
+	server.SendToSubSystems(
+		subsys.SubSystemCommandCodeStartService, 1000*server.stopTimeout)
+	if server.ctx != nil {
+		go func() {
+			<-server.ctx.Done()
+			for !server.Stop() {
+				logger.Warn("server stopping, wait..")
+			}
+		}()
+	}
+	return nil
 }
 
-func (server *Server) Start() {
-	provider := common.NewStateProvider()
-	dataStreamManager := common.NewDataStreamManager()
-	if (*server).cmdExecStorage == nil {
-		cmdStorage := cmdexecstorage.NewCmdExecStorage(
-			dataStreamManager.PutBackHandler, false)
-		(*server).cmdExecStorage = cmdStorage
-		(*server).RegSubSystem(cmdStorage)
+// Load and apply new settings: sockets, log level and timeouts,
+// invalid settings are rejected and current state is kept.
+// Sockets and log output are opened before any change, so reload
+// is applied completely or isn't applied at all.
+func (server *Server) Reload(load settings.Loader) error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	status := admin.ReloadStatus{Time: time.Now().UTC().Format(time.RFC3339)}
+	server.reloadStatus = &status
+	reject := func(err error) error {
+		status.Error = err.Error()
+		logger.Error("Settings reload rejected: %s", err)
+		return err
+	}
+	newSettings, err := load()
+	if err == nil {
+		if newSettings == nil || !newSettings.IsActive() {
+			err = ErrNoSettings
+		} else {
+			err = newSettings.Validate()
+		}
+	}
+	if err == nil && (!server.active || server.stopped) {
+		err = ErrNotActive
+	}
+	if err != nil {
+		return reject(err)
+	}
+	change := func(format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		status.Changes = append(status.Changes, msg)
+		logger.Info("Reload: %s", msg)
 	}
-	defer (*server).SendToSubSystems(
-		subsys.SubSystemCommandCodeStartService, 1000*SubSystemStopTimeout)
+	// log output is opened, it replaces current one after sockets
+	sinkOptions := newSettings.GetLogOutput()
+	var newSink logger.Sink
+	if sinkOptions != logger.GetSinkOptions() {
+		if newSink, err = logger.NewSink(sinkOptions); err != nil {
+			return reject(fmt.Errorf("log output: %s", err))
+		}
+	}
+	// sockets: new ones are opened and changed ones are restarted on the same address
+	// before closing of removed ones, all changes are rolled back if one socket can't be opened
+	newSockets := newSettings.GetSockets()
+	oldOptions := server.connectionOptions
+	server.connectionOptions = newSettings.GetConnectionsOptions()
+	keep := make(map[string]bool)
+	var opened []string
+	var restarted []common.SocketTarget
+	rollback := func() {
+		for _, address := range opened {
+			server.closeSocket(address)
+		}
+		server.connectionOptions = oldOptions
+		for _, target := range restarted {
+			server.closeSocket(target.GetAddress())
+			if err := server.openSocket(target); err != nil {
+				logger.Error("Reload: socket %s is not restored: %s", target, err)
+			}
+		}
+		if newSink != nil {
+			newSink.Close()
+		}
+	}
+	for _, socketTarget := range newSockets {
+		address := socketTarget.GetAddress()
+		keep[address] = true
+		current, exists := server.listeners[address]
+		if exists && reflect.DeepEqual(current.target, socketTarget) &&
+			current.options == socketTarget.GetConnectionOptions(server.connectionOptions) {
+			continue
+		}
+		if exists {
+			server.closeSocket(address)
+		}
+		if err := server.openSocket(socketTarget); err != nil {
+			if exists {
+				restarted = append(restarted, current.target)
+			}
+			rollback()
+			return reject(err)
+		}
+		if exists {
+			restarted = append(restarted, current.target)
+		} else {
+			opened = append(opened, address)
+		}
+	}
+	for address, current := range server.listeners {
+		if !keep[address] {
+			server.closeSocket(address)
+			change("socket %s (%s) closed", current.target, current.target.GetTypeName())
+		}
+	}
+	for _, target := range restarted {
+		current := server.listeners[target.GetAddress()].target
+		change("socket %s (%s) restarted with new options", current, current.GetTypeName())
+	}
+	for _, address := range opened {
+		current := server.listeners[address].target
+		change("socket %s (%s) opened", current, current.GetTypeName())
+	}
+	server.sockets = newSockets
+	// common values, cron jobs are checked in validation of settings
+	var problems []string
+	oldLevel, oldFormat, oldLevels := logger.GetLevel(), logger.GetFormat(), logger.GetPackageLevels()
+	settings.ApplyLogLevels(newSettings)
+	if newSink != nil {
+		logger.UseSink(sinkOptions, newSink)
+		change("log output %s %s", sinkOptions.GetType(), sinkOptions.Path)
+	}
+	if newLevel := logger.GetLevel(); newLevel != oldLevel {
+		change("log level %s", logger.GetLevelName(newLevel))
+	}
+	if newFormat := logger.GetFormat(); newFormat != oldFormat {
+		change("log format %s", newFormat)
+	}
+	if newLevels := logger.GetPackageLevels(); !reflect.DeepEqual(newLevels, oldLevels) {
+		change("log levels of packages %v", newLevels)
+	}
+	if name := newSettings.GetName(); name != server.name {
+		server.name = name
+		change("name %s", name)
+	}
+	if server.connectionOptions != oldOptions {
+		change("connection options %+v", server.connectionOptions)
+	}
+	if timeout := newSettings.GetSubSystemStopTimeout(); timeout != server.stopTimeout {
+		server.stopTimeout = timeout
+		change("subsystem stop timeout %d sec.", timeout)
+	}
+	streamOptions := newSettings.GetStreamOptions()
+	server.dataStreamManager.SetPauseGetCmd(streamOptions.PauseGetCmd)
+	server.dataStreamManager.SetDedupWindow(streamOptions.DedupWindow)
+	server.results.SetTTL(newSettings.GetResultTTL())
+	jobs, oldJobs := newSettings.GetCronJobs(), server.cron.SettingsJobs()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	if (len(jobs) > 0 || len(oldJobs) > 0) && !reflect.DeepEqual(jobs, oldJobs) {
+		if err := server.cron.SetSettingsJobs(jobs); err != nil {
+			problems = append(problems, fmt.Sprintf("cron: %s", err))
+			logger.Error("Reload: cron: %s", err)
+		} else {
+			change("cron jobs from settings %d", len(jobs))
+		}
+	}
+	if overflow := streamOptions.Overflow; !overflow.Equal(server.dataStreamManager.OverflowOptions()) {
+		server.dataStreamManager.SetOverflowOptions(overflow)
+		change("overflow policies %+v", overflow)
+	}
+	// unsafe changes
+	if streamOptions.QueueSize != server.queueSize {
+		logger.Warn("Reload: queue_size will be changed after restart only")
+	}
+	if newSettings.GetStorageIterTime() != server.storageIterTime {
+		logger.Warn("Reload: storage_iter_time will be changed after restart only")
+	}
+	if newSettings.GetStorageShards() != server.storageShards {
+		logger.Warn("Reload: storage_shards will be changed after restart only")
+	}
+	if newSettings.GetTracingOptions() != server.tracingOptions {
+		logger.Warn("Reload: tracing will be changed after restart only")
+	}
+	if newSettings.GetSpillOptions() != server.spillOptions {
+		logger.Warn("Reload: spill will be changed after restart only")
+	}
+	if len(problems) > 0 {
+		status.Error = strings.Join(problems, "; ")
+		return errors.New(status.Error)
+	}
+	status.Ok = true
+	logger.Info("Settings reloaded, changes: %d", len(status.Changes))
+	return nil
+}
+
+// Recurring jobs for admin socket
+func (server *Server) GetCronJobs() []scheduler.JobStatus {
+	return server.cron.Jobs()
+}
+
+func (server *Server) AddCronJob(job scheduler.Job) error {
+	return server.cron.AddJob(job)
+}
+
+func (server *Server) RemoveCronJob(name string) error {
+	return server.cron.RemoveJob(name)
+}
+
+// Statistics of methods for admin socket
+func (server *Server) GetStats() []stats.MethodStats {
+	return server.dataStreamManager.Stats().Snapshot()
+}
 
+// Status for admin socket
+func (server *Server) GetStatus() *admin.Status {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	status := admin.Status{
+		Name:      server.name,
+		LogLevel:  logger.GetLevelName(logger.GetLevel()),
+		LogFormat: logger.GetFormat(),
+		LogLevels: make(map[string]string),
+		Queue:     server.dataStreamManager.QueueLength(),
+		Executing: server.cmdExecStorage.Volume(),
+		Spilled:   server.dataStreamManager.SpilledLength(),
+		Delayed:   server.scheduler.Len(),
+		Results:   server.results.Len(),
+		Sockets:   make([]string, 0, len(server.sockets))}
+	for pkg, level := range logger.GetPackageLevels() {
+		status.LogLevels[pkg] = logger.GetLevelName(level)
+	}
 	for _, socketTarget := range server.sockets {
-		logger.Debug("conf => %s", socketTarget)
-		var handler common.CmdHandler
-		switch socketTarget.Type {
-		case common.NetRecеiver:
-			handler = receiver.CommandHandler
-		case common.NetExecuter:
-			handler = executer.CommandHandler
-		default:
-			logger.Terminate("Unknown type %d server at %s", socketTarget.Type, socketTarget)
-		}
-		go socketListen(
-			socketTarget.GetSocket(),
-			socketTarget.GetTypeName(),
-			handler,
-			provider,
-			dataStreamManager,
-			time.Duration(server.keepAlivePeriod))
+		if _, exists := server.listeners[socketTarget.GetAddress()]; exists {
+			status.Sockets = append(
+				status.Sockets,
+				fmt.Sprintf("%s %s", socketTarget.GetTypeName(), socketTarget.GetSocket()))
+		}
+	}
+	if server.reloadStatus != nil {
+		reloadStatus := *server.reloadStatus
+		status.Reload = &reloadStatus
 	}
+	return &status
 }
 
+// Close sockets and stop subsystems, "false" if subsystems are not stopped in time
 func (server *Server) Stop() bool {
-	logger.Info("Exit command send to subsystem, wait %d sec.", SubSystemStopTimeout)
-	if server.SendToSubSystems(subsys.SubSystemCommandCodeStop, 1000*SubSystemStopTimeout) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if !server.active {
+		return true
+	}
+	if !server.stopped {
+		server.stopped = true
+		server.closeListeners()
+	}
+	logger.Info("Exit command send to subsystem, wait %d sec.", server.stopTimeout)
+	if server.SendToSubSystems(subsys.SubSystemCommandCodeStop, 1000*server.stopTimeout) {
+		server.active = false
+		if err := server.dataStreamManager.Tracer().Close(); err != nil {
+			logger.Warn("Tracing exporter close error: %s", err)
+		}
+		if count := server.dataStreamManager.SpilledLength(); count > 0 {
+			logger.Warn("Spilled commands are not executed: %d", count)
+		}
+		if err := server.dataStreamManager.CloseSpillQueue(); err != nil {
+			logger.Warn("Spill queue close error: %s", err)
+		}
 		return true
 	} else {
 		logger.Warn("Subsystem stoped incorrectly, timeout extended.")
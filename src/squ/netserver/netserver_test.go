@@ -0,0 +1,492 @@
+package netserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	admin "squ/adminserver"
+	"squ/client"
+	common "squ/commonserver"
+	"squ/netserver"
+	"squ/settings"
+	"squ/stats"
+	"squ/transport"
+	"strings"
+	"testing"
+	"time"
+)
+
+// settings for in-process server with unix sockets
+func testSettings(executerSock, receiverSock string) settings.SettingsProvider {
+	content := fmt.Sprintf(`{
+		"name": "test",
+		"storage_iter_time": 50,
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q}
+		]}`,
+		common.NetExecuter, executerSock, common.NetRecеiver, receiverSock)
+	result, err := settings.ParseJsonSettings([]byte(content))
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// server with executer and receiver unix sockets in dir
+func startServer(t *testing.T, ctx context.Context, dir string) (string, string) {
+	executerSock := filepath.Join(dir, "executer.sock")
+	receiverSock := filepath.Join(dir, "receiver.sock")
+	server, err := netserver.New(ctx, netserver.Options{
+		Settings: testSettings(executerSock, receiverSock)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Start(); err == nil {
+		t.Error("second start must be rejected")
+	}
+	return executerSock, receiverSock
+}
+
+func TestIndependentServers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dirs := make([]string, 2)
+	receivers := make([]string, 2)
+	for index := range dirs {
+		dirs[index], _ = ioutil.TempDir("", "squ-server")
+		defer os.RemoveAll(dirs[index])
+		var executerSock string
+		executerSock, receivers[index] = startServer(t, ctx, dirs[index])
+		answer := string(rune('a' + index))
+		executer := client.NewExecuter("unix", executerSock)
+		executer.Handle("name", func(ctx context.Context, params string) (string, error) {
+			return answer, nil
+		})
+		go executer.Run(ctx)
+	}
+	for index, receiverSock := range receivers {
+		caller := client.NewCaller("unix", receiverSock)
+		result, err := caller.Call(ctx, "name", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != string(rune('a'+index)) {
+			t.Errorf("server %d answered %s", index, result)
+		}
+		caller.Close()
+	}
+	cancel()
+	// sockets are closed after context cancel
+	time.Sleep(200 * time.Millisecond)
+	for _, receiverSock := range receivers {
+		if conn, err := net.Dial("unix", receiverSock); err == nil {
+			conn.Close()
+			t.Errorf("socket %s is still open", receiverSock)
+		}
+	}
+}
+
+func TestStartError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	// socket in not existing directory
+	path := filepath.Join(dir, "none", "executer.sock")
+	server, err := netserver.New(
+		context.Background(),
+		netserver.Options{Settings: testSettings(path, filepath.Join(dir, "receiver.sock"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Start()
+	var socketErr *netserver.SocketError
+	if !errors.As(err, &socketErr) || socketErr.Op != netserver.OpListen || socketErr.Target.Path != path {
+		t.Errorf("socket error expected, got %v", err)
+	}
+	if !server.Stop() {
+		t.Error("stop error")
+	}
+}
+
+func TestUnixSockets(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	executerSock := filepath.Join(dir, "executer.sock")
+	receiverSock := filepath.Join(dir, "receiver.sock")
+	// stale file of executer socket without listener
+	stale, err := net.Listen("unix", executerSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	content := fmt.Sprintf(`{
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q, "mode": "0600"},
+			{"type": %d, "network": "unix", "path": %q}
+		]}`,
+		common.NetExecuter, executerSock, common.NetRecеiver, receiverSock)
+	conf, err := settings.ParseJsonSettings([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := netserver.New(context.Background(), netserver.Options{Settings: conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	conn, err := net.Dial("unix", executerSock)
+	if err != nil {
+		t.Fatalf("executer socket is not open: %s", err)
+	}
+	conn.Close()
+	for path, mode := range map[string]os.FileMode{
+		executerSock: 0600, receiverSock: common.DefaultUnixSocketMode} {
+		//
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != mode {
+			t.Errorf("incorrect mode %s of %s", info.Mode(), path)
+		}
+	}
+	// socket of running server isn't removed
+	other, err := netserver.New(context.Background(), netserver.Options{Settings: conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.Start(); !errors.Is(err, netserver.ErrSocketInUse) {
+		t.Errorf("socket in use error expected, got %v", err)
+	}
+	other.Stop()
+	if conn, err = net.Dial("unix", executerSock); err != nil {
+		t.Fatalf("executer socket is removed by other server: %s", err)
+	}
+	conn.Close()
+}
+
+func TestReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	executerSock := filepath.Join(dir, "executer.sock")
+	receiverSock := filepath.Join(dir, "receiver.sock")
+	adminSock := filepath.Join(dir, "admin.sock")
+	server, err := netserver.New(ctx, netserver.Options{
+		Settings: testSettings(executerSock, receiverSock)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// receiver replaced by admin socket
+	content := fmt.Sprintf(`{
+		"name": "reloaded",
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q}
+		]}`,
+		common.NetExecuter, executerSock, common.NetAdmin, adminSock)
+	err = server.Reload(func() (settings.SettingsProvider, error) {
+		return settings.ParseJsonSettings([]byte(content))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("unix", receiverSock); err == nil {
+		conn.Close()
+		t.Error("receiver socket is still open")
+	}
+	caller := client.NewCaller("unix", adminSock)
+	defer caller.Close()
+	status := admin.Status{}
+	if err = caller.CallJson(ctx, admin.StatusMethod, nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "reloaded" || len(status.Sockets) != 2 || !status.Reload.Ok {
+		t.Errorf("incorrect status %+v", status)
+	}
+	// invalid settings are rejected
+	err = server.Reload(func() (settings.SettingsProvider, error) {
+		return settings.ParseJsonSettings([]byte(`{"sockets": []}`))
+	})
+	if err == nil {
+		t.Error("invalid settings must be rejected")
+	}
+	status = admin.Status{}
+	if err = caller.CallJson(ctx, admin.StatusMethod, nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Reload.Ok || status.Reload.Error == "" || len(status.Sockets) != 2 {
+		t.Errorf("incorrect status after error %+v", status)
+	}
+}
+
+func TestReloadToBusyPort(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	executerSock := filepath.Join(dir, "executer.sock")
+	receiverSock := filepath.Join(dir, "receiver.sock")
+	adminSock := filepath.Join(dir, "admin.sock")
+	server, err := netserver.New(ctx, netserver.Options{
+		Settings: testSettings(executerSock, receiverSock)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	// receiver is moved to busy port, admin socket is new
+	content := fmt.Sprintf(`{
+		"name": "reloaded",
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "tcp", "addr": "127.0.0.1", "port": %d}
+		]}`,
+		common.NetExecuter, executerSock, common.NetAdmin, adminSock,
+		common.NetRecеiver, busy.Addr().(*net.TCPAddr).Port)
+	err = server.Reload(func() (settings.SettingsProvider, error) {
+		return settings.ParseJsonSettings([]byte(content))
+	})
+	var socketErr *netserver.SocketError
+	if !errors.As(err, &socketErr) || socketErr.Target.Type != common.NetRecеiver {
+		t.Fatalf("socket error expected, %v", err)
+	}
+	if conn, err := net.Dial("unix", adminSock); err == nil {
+		conn.Close()
+		t.Error("admin socket of rejected reload is open")
+	}
+	conn, err := net.Dial("unix", receiverSock)
+	if err != nil {
+		t.Fatalf("receiver socket is closed after rejected reload: %s", err)
+	}
+	conn.Close()
+	status := server.GetStatus()
+	if status.Name != "test" || len(status.Sockets) != 2 || status.Reload.Ok {
+		t.Errorf("incorrect status after rejected reload %+v", status)
+	}
+}
+
+func TestReloadSocketOptions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	executerSock := filepath.Join(dir, "executer.sock")
+	receiverSock := filepath.Join(dir, "receiver.sock")
+	content := `{
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q, "protocol": "http", "wait_timeout": %g}
+		]}`
+	load := func(waitTimeout float64) settings.Loader {
+		return func() (settings.SettingsProvider, error) {
+			return settings.ParseJsonSettings([]byte(fmt.Sprintf(
+				content, common.NetExecuter, executerSock, common.NetRecеiver, receiverSock, waitTimeout)))
+		}
+	}
+	conf, _ := load(10)()
+	server, err := netserver.New(ctx, netserver.Options{Settings: conf})
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	executer := client.NewExecuter("unix", executerSock)
+	executer.Handle("slow", func(ctx context.Context, params string) (string, error) {
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+		return "done", nil
+	})
+	go executer.Run(ctx)
+	// the same address with other wait timeout
+	if err = server.Reload(load(0.05)); err != nil {
+		t.Fatal(err)
+	}
+	status := server.GetStatus()
+	if len(status.Sockets) != 2 || len(status.Reload.Changes) != 1 ||
+		!strings.Contains(status.Reload.Changes[0], "restarted") {
+		//
+		t.Errorf("incorrect status %+v", status.Reload)
+	}
+	httpClient := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", receiverSock)
+		}}}
+	var response *http.Response
+	// executer registration
+	for attempt := 0; attempt < 50; attempt++ {
+		response, err = httpClient.Post(
+			"http://receiver/", "application/json",
+			strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "slow"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("accepted status after new wait timeout expected, %d", response.StatusCode)
+	}
+}
+
+func TestAdminChanges(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	adminSock := filepath.Join(dir, "admin.sock")
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	content := fmt.Sprintf(`{
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "addr": "127.0.0.1", "port": %d}
+		]}`,
+		common.NetAdmin, adminSock, common.NetAdmin, port)
+	conf, err := settings.ParseJsonSettings([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := netserver.New(ctx, netserver.Options{Settings: conf})
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	params := admin.LogLevelParams{Level: "info", Package: "netserver_test"}
+	// tcp socket is read only
+	tcpCaller := client.NewCaller("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	defer tcpCaller.Close()
+	status := admin.Status{}
+	if err = tcpCaller.CallJson(ctx, admin.StatusMethod, nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{admin.SetLogLevelMethod, admin.AddCronJobMethod, admin.RemoveCronJobMethod} {
+		var callErr *client.Error
+		if _, err = tcpCaller.Call(ctx, method, params); !errors.As(err, &callErr) ||
+			callErr.Code != common.AnswerAccessError {
+			//
+			t.Errorf("access error expected for %s, %v", method, err)
+		}
+	}
+	caller := client.NewCaller("unix", adminSock)
+	defer caller.Close()
+	if _, err = caller.Call(ctx, admin.SetLogLevelMethod, params); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatsAndMetrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-server")
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	executerSock := filepath.Join(dir, "executer.sock")
+	receiverSock := filepath.Join(dir, "receiver.sock")
+	adminSock := filepath.Join(dir, "admin.sock")
+	content := fmt.Sprintf(`{
+		"sockets": [
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q},
+			{"type": %d, "network": "unix", "path": %q, "protocol": "http"}
+		]}`,
+		common.NetExecuter, executerSock, common.NetRecеiver, receiverSock,
+		common.NetAdmin, adminSock)
+	conf, err := settings.ParseJsonSettings([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := netserver.New(ctx, netserver.Options{Settings: conf})
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	executer := client.NewExecuter("unix", executerSock)
+	executer.Handle("echo", func(ctx context.Context, params string) (string, error) {
+		return params, nil
+	})
+	go executer.Run(ctx)
+	caller := client.NewCaller("unix", receiverSock)
+	defer caller.Close()
+	for index := 0; index < 3; index++ {
+		if _, err = caller.Call(ctx, "echo", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	httpClient := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", adminSock)
+		}}}
+	response, err := httpClient.Post(
+		"http://admin/", "application/json",
+		strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "stats", "params": "{}"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	answer, err := transport.ParseAnswer(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var methods []stats.MethodStats
+	if err = json.Unmarshal([]byte(answer.Result), &methods); err != nil {
+		t.Fatalf("incorrect stats answer %s: %s", body, err)
+	}
+	if len(methods) != 1 || methods[0].Method != "echo" || methods[0].Results != 3 ||
+		methods[0].Execution.Count != 3 || methods[0].QueueWait.Count != 3 {
+		//
+		t.Errorf("incorrect stats %+v", methods)
+	}
+	response, err = httpClient.Get("http://admin" + admin.MetricsUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if !strings.Contains(string(body), `squ_tasks_results_total{method="echo"} 3`) ||
+		!strings.Contains(string(body), `squ_execution_ms_count{method="echo"} 3`) {
+		//
+		t.Errorf("incorrect metrics %s", body)
+	}
+}
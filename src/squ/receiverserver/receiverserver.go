@@ -1,15 +1,264 @@
 package receiverserver
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	common "squ/commonserver"
+	"squ/helpers"
+	"squ/logger"
+	"squ/tracing"
 	"squ/transport"
+	"strings"
+	"time"
 )
 
+// query methods of receivers, they aren't sent to executers
+const (
+	GetResultMethod  = "get_result"
+	TaskStatusMethod = "task_status"
+)
+
+// params of query methods
+type TaskParams struct {
+	Task string `json:"task"`
+}
+
+const (
+	// async call markers
+	AsyncQueryParam  = "async"
+	AsyncPreferValue = "respond-async"
+)
+
+// Status or result of task from result store, "false" for other methods
+func queryAnswer(cmd *transport.Command, dataStreamManager *common.DataStreamManager) (*transport.Answer, bool) {
+	if cmd.Method != GetResultMethod && cmd.Method != TaskStatusMethod {
+		return nil, false
+	}
+	params := TaskParams{}
+	if err := json.Unmarshal([]byte(cmd.Params), &params); err != nil || params.Task == "" {
+		return transport.NewErrorAnswer(cmd.Id, common.AnswerCodeFormatError, "Task uid expected."), true
+	}
+	status, exists := dataStreamManager.ResultStore().Get(params.Task)
+	if !exists {
+		return transport.NewErrorAnswer(cmd.Id, common.AnswerUnknownTask, "Unknown or expired task."), true
+	}
+	if cmd.Method == TaskStatusMethod {
+		data, err := json.Marshal(&status)
+		if err != nil {
+			return transport.NewErrorAnswer(cmd.Id, common.AnswerInternalError, err.Error()), true
+		}
+		return transport.NewAnswer(cmd.Id, string(data)), true
+	}
+	if status.Answer == nil {
+		return transport.NewErrorAnswer(
+			cmd.Id, common.AnswerTaskNotDone, fmt.Sprintf("Task %s is %s.", params.Task, status.Status)), true
+	}
+	answer := status.Answer
+	answer.Id = cmd.Id
+	return answer, true
+}
+
+// Answer with params of query methods for task, result is queried later
+func taskAnswer(id int, task string) *transport.Answer {
+	data, _ := json.Marshal(&TaskParams{Task: task})
+	return transport.NewAnswer(id, string(data))
+}
+
+// Enqueue command and wait executer answer, query methods are answered from result store.
+// Delayed command is answered with its task at once.
 func CommandHandler(
 	about string,
 	cmd *transport.Command,
 	dataStreamManager *common.DataStreamManager) (
 	*transport.Answer, common.StateUpdater, bool) {
 	//
-	return nil, nil, false
+	if cmd.Method == "" {
+		answer := transport.NewErrorAnswer(
+			cmd.Id, common.AnswerCodeFormatError, "Empty method.")
+		return answer, nil, false
+	}
+	if answer, ok := queryAnswer(cmd, dataStreamManager); ok {
+		return answer, nil, false
+	}
+	if due, err := cmd.GetNotBefore(time.Now()); err == nil && !due.IsZero() {
+		// delayed command isn't waited, result is queried by task
+		task, err := dataStreamManager.AddCommand(cmd)
+		if err != nil {
+			return common.NewEnqueueErrorAnswer(cmd.Id, err), nil, false
+		}
+		common.TaskLog(task, cmd).With(logger.Fields{logger.FieldConnection: about}).Debug(
+			"New delayed task, cmd: %s", cmd)
+		return taskAnswer(cmd.Id, task), nil, false
+	}
+	timeout := time.Duration(helpers.FindTimeout(&(cmd.Params))) * time.Millisecond
+	if quorumTimeout := time.Duration(cmd.QuorumTimeout * float64(time.Second)); quorumTimeout > timeout {
+		timeout = quorumTimeout
+	}
+	task, resultChannel, err := dataStreamManager.AddWaitCommand(cmd)
+	if err != nil {
+		return common.NewEnqueueErrorAnswer(cmd.Id, err), nil, false
+	}
+	taskLog := common.TaskLog(task, cmd).With(logger.Fields{logger.FieldConnection: about})
+	taskLog.Debug("New task, cmd: %s", cmd)
+	answer, done := dataStreamManager.WaitResult(task, resultChannel, timeout)
+	if done {
+		answer.Id = cmd.Id
+	} else {
+		taskLog.Warn("Task is not done in %s", timeout)
+		answer = transport.NewTaskErrorAnswer(
+			cmd.Id,
+			common.AnswerTimeoutError,
+			fmt.Sprintf("Task %s is not done.", task),
+			task)
+	}
+	return answer, nil, false
+}
+
+// waiting http call
+type httpCall struct {
+	cmd           *transport.Command
+	task          string
+	resultChannel chan transport.Answer
+	answer        *transport.Answer
+}
+
+func isAsync(request *http.Request) bool {
+	if value := request.URL.Query().Get(AsyncQueryParam); value != "" {
+		return value != "0" && strings.ToLower(value) != "false"
+	}
+	for _, value := range request.Header["Prefer"] {
+		if strings.Contains(strings.ToLower(value), AsyncPreferValue) {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJson(writer http.ResponseWriter, status int, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		logger.Error("Http answer encode error: %s", err)
+		status = http.StatusInternalServerError
+		data = []byte("{}")
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(data)
+}
+
+// answer with error in base or full form
+func answerValue(answer *transport.Answer) interface{} {
+	var value json.RawMessage
+	if data := answer.DataDump(); data != nil {
+		value = *data
+	}
+	return value
+}
+
+// Http gateway: POST body is JSON-RPC request or batch,
+// answer is executer result or 202 with task ids after wait timeout.
+func NewHttpHandler(
+	about string,
+	dataStreamManager *common.DataStreamManager,
+	waitTimeout time.Duration,
+	maxBodySize int) http.HandlerFunc {
+	//
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost {
+			writer.Header().Set("Allow", http.MethodPost)
+			http.Error(writer, "Only POST supported.", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, int64(maxBodySize)))
+		if err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				http.Error(writer, "Request too large.", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(writer, "Can't read request.", http.StatusBadRequest)
+			}
+			return
+		}
+		commands, batch, err := transport.ParseRequest(&body)
+		if err != nil || len(commands) == 0 {
+			logger.Error("Http request parse error from %s: %s", request.RemoteAddr, err)
+			writeJson(writer, http.StatusBadRequest, answerValue(transport.NewErrorAnswer(
+				0, transport.ErrCodeFormat, "Command parse problem.")))
+			return
+		}
+		calls := make([]*httpCall, len(commands))
+		rejected := 0
+		traceparent := request.Header.Get(tracing.TraceparentHeader)
+		// header key is for single command only
+		idempotencyKey := request.Header.Get(common.IdempotencyKeyHeader)
+		for index, cmd := range commands {
+			call := httpCall{cmd: cmd}
+			if cmd.Traceparent == "" {
+				cmd.Traceparent = traceparent
+			}
+			if cmd.IdempotencyKey == "" && !batch {
+				cmd.IdempotencyKey = idempotencyKey
+			}
+			if cmd.Method == "" {
+				call.answer = transport.NewErrorAnswer(
+					cmd.Id, common.AnswerCodeFormatError, "Empty method.")
+			} else if answer, ok := queryAnswer(cmd, dataStreamManager); ok {
+				call.answer = answer
+			} else if task, resultChannel, err := dataStreamManager.AddWaitCommand(cmd); err != nil {
+				call.answer = common.NewEnqueueErrorAnswer(cmd.Id, err)
+				if err == common.ErrQueueFull {
+					rejected++
+				}
+			} else {
+				call.task, call.resultChannel = task, resultChannel
+				common.TaskLog(call.task, cmd).With(
+					logger.Fields{logger.FieldConnection: about}).Debug("New task, cmd: %s", cmd)
+			}
+			calls[index] = &call
+		}
+		async := isAsync(request)
+		deadline := time.Now().Add(waitTimeout)
+		pending := false
+		for _, call := range calls {
+			if call.answer != nil {
+				continue
+			}
+			wait := time.Until(deadline)
+			if async || wait < 0 {
+				wait = 0
+			}
+			// waiters are removed after disconnect of client
+			if answer, done := dataStreamManager.WaitResultContext(
+				request.Context(), call.task, call.resultChannel, wait); done {
+				//
+				answer.Id = call.cmd.Id
+				call.answer = answer
+			} else {
+				pending = true
+			}
+		}
+		status := http.StatusOK
+		if pending {
+			status = http.StatusAccepted
+		} else if rejected == len(calls) {
+			// nothing is queued, client can retry later
+			status = http.StatusServiceUnavailable
+		}
+		values := make([]interface{}, len(calls))
+		for index, call := range calls {
+			if call.answer == nil {
+				values[index] = transport.NewTaskAnswer(call.cmd.Id, call.task)
+			} else {
+				values[index] = answerValue(call.answer)
+			}
+		}
+		if batch {
+			writeJson(writer, status, values)
+		} else {
+			writeJson(writer, status, values[0])
+		}
+	}
 }
@@ -0,0 +1,149 @@
+package receiverserver_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	common "squ/commonserver"
+	receiver "squ/receiverserver"
+	"squ/resultstore"
+	"squ/scheduler"
+	"squ/transport"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelayedCommand(t *testing.T) {
+	manager := common.NewDataStreamManager(common.StreamOptions{PauseGetCmd: 10})
+	holder := scheduler.NewScheduler(manager.Release)
+	defer holder.Stop()
+	manager.SetScheduler(holder)
+	results := resultstore.NewStore(60)
+	defer results.Stop()
+	manager.SetResultStore(results)
+	// answer with task before due time
+	cmd := transport.Command{Method: "sum", Id: 1, Delay: 3600}
+	started := time.Now()
+	answer, _, _ := receiver.CommandHandler("test", &cmd, manager)
+	params := receiver.TaskParams{}
+	if answer.Error.Exists() || json.Unmarshal([]byte(answer.Result), &params) != nil || params.Task == "" {
+		t.Fatalf("task answer expected, %+v", answer)
+	}
+	if time.Since(started) > time.Second || holder.Len() != 1 {
+		t.Errorf("delayed command is waited")
+	}
+	query := transport.Command{Method: receiver.TaskStatusMethod, Id: 2, Params: answer.Result}
+	if answer, _, _ = receiver.CommandHandler("test", &query, manager); answer.Error.Exists() {
+		t.Errorf("unknown task %s", params.Task)
+	}
+	// delayed command isn't executed early after stop of scheduler
+	holder.Stop()
+	answer, _, _ = receiver.CommandHandler("test", &cmd, manager)
+	if answer.Error.Code != common.AnswerInternalError {
+		t.Errorf("error answer expected, %+v", answer)
+	}
+}
+
+// executer answers with method name until context is done
+func execute(ctx context.Context, manager *common.DataStreamManager) {
+	for ctx.Err() == nil {
+		if timeout, cmd := manager.GetExecCmd(); !timeout {
+			manager.PutResult(cmd.Task, transport.NewAnswer(0, cmd.Method))
+		}
+	}
+}
+
+func post(handler http.HandlerFunc, body string, header map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	for key, value := range header {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	return recorder
+}
+
+func TestHttpHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	manager := common.NewDataStreamManager(common.StreamOptions{QueueSize: 2, PauseGetCmd: 10})
+	handler := receiver.NewHttpHandler("test", manager, time.Second, 256)
+	// async call isn't waited
+	response := post(handler, `{"jsonrpc": "2.0", "id": 1, "method": "sum"}`,
+		map[string]string{"Prefer": receiver.AsyncPreferValue})
+	answer := transport.TaskAnswer{}
+	json.Unmarshal(response.Body.Bytes(), &answer)
+	if response.Code != http.StatusAccepted || answer.Task == "" {
+		t.Errorf("task answer expected, %d %s", response.Code, response.Body)
+	}
+	go execute(ctx, manager)
+	response = post(handler, `{"jsonrpc": "2.0", "id": 2, "method": "sum"}`, nil)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"result":"sum"`) {
+		t.Errorf("result expected, %d %s", response.Code, response.Body)
+	}
+	response = post(handler, `[
+		{"jsonrpc": "2.0", "id": 3, "method": "sum"},
+		{"jsonrpc": "2.0", "id": 4, "method": "mul"}]`, nil)
+	var answers []transport.Answer
+	json.Unmarshal(response.Body.Bytes(), &answers)
+	if response.Code != http.StatusOK ||
+		len(answers) != 2 || answers[0].Id != 3 || answers[1].Result != "mul" {
+		//
+		t.Errorf("batch results expected, %d %s", response.Code, response.Body)
+	}
+	// method and size of body
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("method error expected, %d", recorder.Code)
+	}
+	params := strings.Repeat("1", 256)
+	response = post(handler, `{"jsonrpc": "2.0", "id": 5, "method": "sum", "params": "`+params+`"}`, nil)
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large error expected, %d", response.Code)
+	}
+	response = post(handler, `{"jsonrpc": "2.0", "id": 6`, nil)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("parse error expected, %d", response.Code)
+	}
+}
+
+func TestHttpQueueFull(t *testing.T) {
+	manager := common.NewDataStreamManager(common.StreamOptions{QueueSize: 1, PauseGetCmd: 10})
+	handler := receiver.NewHttpHandler("test", manager, time.Second, 1024)
+	cmd := transport.Command{Method: "sum", Id: 1}
+	manager.AddCommand(&cmd)
+	response := post(handler, `[
+		{"jsonrpc": "2.0", "id": 1, "method": "sum"},
+		{"jsonrpc": "2.0", "id": 2, "method": "sum"}]`, nil)
+	var answers []transport.Answer
+	json.Unmarshal(response.Body.Bytes(), &answers)
+	if response.Code != http.StatusServiceUnavailable ||
+		len(answers) != 2 || answers[1].Error.Code != common.AnswerQueueFull {
+		//
+		t.Errorf("queue full expected, %d %s", response.Code, response.Body)
+	}
+}
+
+func TestHttpClientDisconnect(t *testing.T) {
+	manager := common.NewDataStreamManager(common.StreamOptions{PauseGetCmd: 10})
+	handler := receiver.NewHttpHandler("test", manager, time.Minute, 1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request := httptest.NewRequest(
+		http.MethodPost, "/", strings.NewReader(`{"jsonrpc": "2.0", "id": 1, "method": "sum"}`))
+	recorder := httptest.NewRecorder()
+	started := time.Now()
+	handler(recorder, request.WithContext(ctx))
+	if time.Since(started) > 10*time.Second || recorder.Code != http.StatusAccepted {
+		t.Errorf("wait after disconnect, %d", recorder.Code)
+	}
+	// result without waiter
+	_, cmd := manager.GetExecCmd()
+	if manager.PutResult(cmd.Task, transport.NewAnswer(0, "sum")) {
+		t.Error("waiter of disconnected client is not removed")
+	}
+}
@@ -0,0 +1,266 @@
+package resultstore
+
+import (
+	"squ/logger"
+	subsys "squ/subsysmanage"
+	"squ/transport"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTTL = 600 // sec.
+	// task without final status is removed after this time
+	DefaultMaxPendingAge = time.Hour
+	// wait of sweep loop
+	maxSweepWait = time.Minute
+	minSweepWait = time.Second
+)
+
+// statuses of task
+const (
+	StatusQueued     = "queued"
+	StatusDispatched = "dispatched"
+	// executer didn't return result in time, task is in queue again.
+	// It isn't final: next dispatch changes it to "dispatched".
+	StatusTimedOut = "timed-out"
+	// final statuses, result is kept for TTL
+	StatusDone   = "done"
+	StatusFailed = "failed"
+	// task is dropped or rejected by full queue without execution
+	StatusDeadLettered = "dead-lettered"
+)
+
+// Final status has result
+func IsFinal(status string) bool {
+	return status == StatusDone || status == StatusFailed || status == StatusDeadLettered
+}
+
+// Status of task for receivers
+type TaskStatus struct {
+	Task   string `json:"task"`
+	Method string `json:"method"`
+	Status string `json:"status"`
+	// dispatches to executers
+	Attempts int       `json:"attempts"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	// result of final status
+	Answer *transport.Answer `json:"-"`
+}
+
+// Statuses and results of tasks by uid, results are kept for TTL after finish.
+// Nil store does nothing.
+type Store struct {
+	lock        sync.Mutex
+	tasks       map[string]*TaskStatus
+	ttl         time.Duration
+	maxAge      time.Duration
+	active      bool
+	exitChannel chan bool
+	doneChannel chan bool
+}
+
+func NewStore(ttl int) *Store {
+	store := Store{
+		tasks:       make(map[string]*TaskStatus),
+		maxAge:      DefaultMaxPendingAge,
+		active:      true,
+		exitChannel: make(chan bool, 1),
+		doneChannel: make(chan bool)}
+	store.SetTTL(ttl)
+	go store.run()
+	logger.Debug("Result store at %p", &store)
+	return &store
+}
+
+// Change time of results (sec.), default for 0
+func (store *Store) SetTTL(ttl int) {
+	if store == nil {
+		return
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.ttl = time.Duration(ttl) * time.Second
+}
+
+// change status of existing task, final status isn't changed
+func (store *Store) update(task string, status string) *TaskStatus {
+	item, exists := store.tasks[task]
+	if !exists || IsFinal(item.Status) {
+		return nil
+	}
+	item.Status = status
+	item.Updated = time.Now()
+	return item
+}
+
+// New task is accepted to queue or to scheduler
+func (store *Store) Queued(task string, method string) {
+	if store == nil {
+		return
+	}
+	now := time.Now()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.tasks[task] = &TaskStatus{
+		Task: task, Method: method, Status: StatusQueued, Created: now, Updated: now}
+}
+
+// Task is sent to executer
+func (store *Store) Dispatched(task string) {
+	if store == nil {
+		return
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if item := store.update(task, StatusDispatched); item != nil {
+		item.Attempts++
+	}
+}
+
+// Task is returned to queue after timeout of executer
+func (store *Store) TimedOut(task string) {
+	if store == nil {
+		return
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.update(task, StatusTimedOut)
+}
+
+// Final status with result, it's kept for TTL
+func (store *Store) Finish(task string, status string, answer *transport.Answer) {
+	if store == nil {
+		return
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if item := store.update(task, status); item != nil {
+		value := *answer
+		item.Answer = &value
+	}
+}
+
+// Remove task which isn't accepted
+func (store *Store) Remove(task string) {
+	if store == nil {
+		return
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.tasks, task)
+}
+
+// Copy of task status, "false" for unknown or expired task
+func (store *Store) Get(task string) (TaskStatus, bool) {
+	if store == nil {
+		return TaskStatus{}, false
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	item, exists := store.tasks[task]
+	if !exists {
+		return TaskStatus{}, false
+	}
+	result := *item
+	if item.Answer != nil {
+		answer := *item.Answer
+		result.Answer = &answer
+	}
+	return result, true
+}
+
+// Count of known tasks
+func (store *Store) Len() int {
+	if store == nil {
+		return 0
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return len(store.tasks)
+}
+
+// Remove results and lost tasks which are expired at time (sweep loop calls it
+// with current time), result is wait of next sweep
+func (store *Store) Sweep(now time.Time) time.Duration {
+	if store == nil {
+		return maxSweepWait
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for task, item := range store.tasks {
+		age := store.maxAge
+		if IsFinal(item.Status) {
+			age = store.ttl
+		}
+		if now.Sub(item.Updated) > age {
+			delete(store.tasks, task)
+		}
+	}
+	wait := store.ttl / 10
+	if wait < minSweepWait {
+		wait = minSweepWait
+	} else if wait > maxSweepWait {
+		wait = maxSweepWait
+	}
+	return wait
+}
+
+// sweep loop
+func (store *Store) run() {
+	timer := time.NewTimer(minSweepWait)
+	defer timer.Stop()
+	logger.Debug("Result store at %p started.", store)
+	for active := true; active; {
+		select {
+		case <-store.exitChannel:
+			active = false
+		case <-timer.C:
+			timer.Reset(store.Sweep(time.Now()))
+		}
+	}
+	close(store.doneChannel)
+	logger.Debug("Result store at %p stopped.", store)
+}
+
+// Stop sweep loop, results are available after it
+func (store *Store) Stop() {
+	store.lock.Lock()
+	if !store.active {
+		store.lock.Unlock()
+		return
+	}
+	store.active = false
+	store.lock.Unlock()
+	store.exitChannel <- true
+	<-store.doneChannel
+}
+
+// subsys SubSystemSwitcher
+func (store *Store) CallCommandService(commandCode int, doneChannel *chan subsys.SubSystemMsg) {
+	ssCode := store.GetCode()
+	switch commandCode {
+	case subsys.SubSystemCommandCodeStop:
+		{
+			store.Stop()
+			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStop))
+		}
+	case subsys.SubSystemCommandCodeStartService:
+		{
+			logger.Debug("Result store at %p has command for starting.", store)
+			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStartService))
+		}
+	default:
+		{
+			logger.Warn("Result store at %p got unsupported command %d", store, commandCode)
+		}
+	}
+}
+
+func (store *Store) GetCode() int {
+	return subsys.SubSystemResultStore
+}
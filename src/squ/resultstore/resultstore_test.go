@@ -0,0 +1,59 @@
+package resultstore_test
+
+import (
+	"squ/resultstore"
+	"squ/transport"
+	"testing"
+	"time"
+)
+
+func TestStatuses(t *testing.T) {
+	store := resultstore.NewStore(1)
+	defer store.Stop()
+	store.Queued("a", "sum")
+	store.Dispatched("a")
+	store.TimedOut("a")
+	store.Dispatched("a")
+	if status, exists := store.Get("a"); !exists || status.Status != resultstore.StatusDispatched ||
+		status.Attempts != 2 || status.Answer != nil {
+		//
+		t.Fatalf("incorrect status %+v", status)
+	}
+	store.Finish("a", resultstore.StatusDone, transport.NewAnswer(1, "{}"))
+	// final status isn't changed
+	store.Finish("a", resultstore.StatusDeadLettered, transport.NewErrorAnswer(1, 6, "Queue full."))
+	store.Dispatched("a")
+	status, _ := store.Get("a")
+	if status.Status != resultstore.StatusDone || status.Attempts != 2 || status.Answer == nil || status.Answer.Result != "{}" {
+		t.Fatalf("incorrect final status %+v", status)
+	}
+	// unknown task isn't added
+	store.Finish("b", resultstore.StatusFailed, transport.NewAnswer(1, "{}"))
+	store.Queued("c", "sum")
+	store.Queued("d", "sum")
+	store.Remove("d")
+	if store.Len() != 2 {
+		t.Fatalf("incorrect count %d", store.Len())
+	}
+	// result is expired, pending task is kept
+	store.Sweep(time.Now().Add(2 * time.Second))
+	if _, exists := store.Get("a"); exists {
+		t.Error("result must be expired")
+	}
+	if _, exists := store.Get("c"); !exists {
+		t.Error("pending task must be kept")
+	}
+	store.Sweep(time.Now().Add(resultstore.DefaultMaxPendingAge + time.Second))
+	if store.Len() != 0 {
+		t.Error("lost task must be removed")
+	}
+}
+
+func TestNilStore(t *testing.T) {
+	var store *resultstore.Store
+	store.Queued("a", "sum")
+	store.Finish("a", resultstore.StatusDone, transport.NewAnswer(1, "{}"))
+	if _, exists := store.Get("a"); exists || store.Len() != 0 {
+		t.Error("nil store must be empty")
+	}
+}
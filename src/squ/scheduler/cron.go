@@ -0,0 +1,564 @@
+package scheduler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"squ/logger"
+	subsys "squ/subsysmanage"
+	"squ/transport"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// next run is searched in this period
+const cronSearchYears = 5
+
+var (
+	ErrCronFormat  = errors.New("incorrect cron expression")
+	ErrCronNoRuns  = errors.New("cron expression without runs")
+	ErrUnknownJob  = errors.New("unknown job")
+	ErrCronStopped = errors.New("cron is stopped")
+	ErrSettingsJob = errors.New("job from settings can't be changed")
+)
+
+var (
+	cronMacros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *"}
+	monthNames = map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	dayNames = map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+// bounds and names of cron field
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = []cronField{
+	{0, 59, nil},        // minute
+	{0, 23, nil},        // hour
+	{1, 31, nil},        // day of month
+	{1, 12, monthNames}, // month
+	{0, 7, dayNames}}    // day of week, 7 is sunday too
+
+// Standard cron expression: "minute hour day-of-month month day-of-week"
+// with lists, ranges, steps, names of months and days and @macros.
+type CronExpression struct {
+	source string
+	// bit sets of allowed values
+	minutes, hours, days, months, weekdays uint64
+	// day is matched by any of restricted fields
+	anyDay bool
+}
+
+func parseValue(field cronField, value string) (int, error) {
+	if number, exists := field.names[strings.ToLower(value)]; exists {
+		return number, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < field.min || number > field.max {
+		return 0, ErrCronFormat
+	}
+	return number, nil
+}
+
+// bits of field part as "*", "*/5", "1-5", "1-10/2", "mon"
+func parsePart(field cronField, part string) (uint64, error) {
+	step := 1
+	if index := strings.Index(part, "/"); index >= 0 {
+		value, err := strconv.Atoi(part[index+1:])
+		if err != nil || value <= 0 {
+			return 0, ErrCronFormat
+		}
+		step = value
+		part = part[:index]
+	}
+	low, high := field.min, field.max
+	if part != "*" {
+		bounds := strings.SplitN(part, "-", 2)
+		var err error
+		if low, err = parseValue(field, bounds[0]); err != nil {
+			return 0, err
+		}
+		high = low
+		if len(bounds) == 2 {
+			if high, err = parseValue(field, bounds[1]); err != nil || high < low {
+				return 0, ErrCronFormat
+			}
+		} else if step > 1 {
+			// "5/15" is from 5 to max
+			high = field.max
+		}
+	}
+	var bits uint64
+	for value := low; value <= high; value += step {
+		bits |= 1 << uint(value)
+	}
+	return bits, nil
+}
+
+func ParseCron(source string) (*CronExpression, error) {
+	expr := strings.TrimSpace(source)
+	if macro, exists := cronMacros[strings.ToLower(expr)]; exists {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, ErrCronFormat
+	}
+	values := make([]uint64, len(parts))
+	for index, part := range parts {
+		for _, item := range strings.Split(part, ",") {
+			bits, err := parsePart(cronFields[index], item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: field %d '%s'", err, index+1, item)
+			}
+			values[index] |= bits
+		}
+	}
+	result := CronExpression{
+		source:   source,
+		minutes:  values[0],
+		hours:    values[1],
+		days:     values[2],
+		months:   values[3],
+		weekdays: values[4]}
+	// sunday as 7
+	if result.weekdays&(1<<7) != 0 {
+		result.weekdays |= 1
+	}
+	result.anyDay = parts[2] != "*" && parts[4] != "*" &&
+		!strings.HasPrefix(parts[2], "*/") && !strings.HasPrefix(parts[4], "*/")
+	if result.Next(time.Now()).IsZero() {
+		return nil, ErrCronNoRuns
+	}
+	return &result, nil
+}
+
+func hasBit(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+func (expr *CronExpression) dayMatches(moment time.Time) bool {
+	day := hasBit(expr.days, moment.Day())
+	weekday := hasBit(expr.weekdays, int(moment.Weekday()))
+	if expr.anyDay {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// First run after moment (in its location), zero time if there is no run
+func (expr *CronExpression) Next(after time.Time) time.Time {
+	moment := after.Truncate(time.Minute).Add(time.Minute)
+	limit := moment.AddDate(cronSearchYears, 0, 0)
+	location := moment.Location()
+	for moment.Before(limit) {
+		year, month, day := moment.Date()
+		switch {
+		case !hasBit(expr.months, int(month)):
+			moment = time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+		case !expr.dayMatches(moment):
+			moment = time.Date(year, month, day+1, 0, 0, 0, 0, location)
+		case !hasBit(expr.hours, moment.Hour()):
+			moment = time.Date(year, month, day, moment.Hour()+1, 0, 0, 0, location)
+		case !hasBit(expr.minutes, moment.Minute()):
+			moment = moment.Add(time.Minute)
+		default:
+			return moment
+		}
+	}
+	return time.Time{}
+}
+
+func (expr *CronExpression) String() string {
+	return expr.source
+}
+
+// Recurring command in settings or from admin socket
+type Job struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Method   string `json:"method"`
+	// object or string, as params of JSON-RPC request
+	Params json.RawMessage `json:"params,omitempty"`
+	// new run while previous one is in flight
+	AllowOverlap bool `json:"allow_overlap"`
+}
+
+func (job *Job) Validate() []string {
+	var problems []string
+	if job.Name == "" {
+		problems = append(problems, "empty name")
+	}
+	if job.Method == "" {
+		problems = append(problems, "empty method")
+	}
+	if _, err := ParseCron(job.Schedule); err != nil {
+		problems = append(problems, fmt.Sprintf("schedule '%s': %s", job.Schedule, err))
+	}
+	if len(job.Params) > 0 && !json.Valid(job.Params) {
+		problems = append(problems, "incorrect params")
+	}
+	return problems
+}
+
+// Command of one run
+func (job *Job) Command() *transport.Command {
+	cmd := transport.NewCommand(job.Method)
+	params := bytes.TrimSpace(job.Params)
+	if len(params) > 0 && string(params) != "null" {
+		var value string
+		if params[0] == '"' && json.Unmarshal(params, &value) == nil {
+			cmd.Params = value
+		} else {
+			cmd.Params = string(params)
+		}
+	}
+	return cmd
+}
+
+// State of job for admin socket
+type JobStatus struct {
+	Job
+	FromSettings bool   `json:"from_settings"`
+	Next         string `json:"next"`
+	InFlight     bool   `json:"in_flight"`
+	LastTask     string `json:"last_task,omitempty"`
+	LastRun      string `json:"last_run,omitempty"`
+	Runs         int64  `json:"runs"`
+	Skipped      int64  `json:"skipped"`
+	Failed       int64  `json:"failed"`
+}
+
+// Handler of job runs, it adds command to queue and returns channel of result
+type EnqueueHandler func(cmd *transport.Command) (string, chan transport.Answer, error)
+
+type cronJob struct {
+	job          Job
+	expr         *CronExpression
+	fromSettings bool
+	next         time.Time
+	// result of last run, nil if it's received
+	results  chan transport.Answer
+	lastTask string
+	lastRun  time.Time
+	runs     int64
+	skipped  int64
+	failed   int64
+}
+
+// result of last run is checked without wait, "true" if it's in flight
+func (item *cronJob) inFlight() bool {
+	if item.results == nil {
+		return false
+	}
+	select {
+	case answer := <-item.results:
+		item.results = nil
+		jobLog := logger.With(logger.Fields{logger.FieldJob: item.job.Name, logger.FieldTask: item.lastTask})
+		if answer.Error.Exists() {
+			item.failed++
+			jobLog.Warn("Job run failed: %s", answer.Error.Message)
+		} else {
+			jobLog.Debug("Job run is done")
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// Runner of recurring jobs by cron expressions
+type CronScheduler struct {
+	lock           sync.Mutex
+	jobs           map[string]*cronJob
+	enqueueHandler EnqueueHandler
+	active         bool
+	// wake of run loop for changed jobs
+	wakeChannel chan bool
+	exitChannel chan bool
+	doneChannel chan bool
+}
+
+func NewCronScheduler(handler EnqueueHandler) *CronScheduler {
+	cron := CronScheduler{
+		jobs:           make(map[string]*cronJob),
+		enqueueHandler: handler,
+		active:         true,
+		wakeChannel:    make(chan bool, 1),
+		exitChannel:    make(chan bool, 1),
+		doneChannel:    make(chan bool)}
+	go cron.run()
+	logger.Debug("Cron at %p", &cron)
+	return &cron
+}
+
+func (cron *CronScheduler) wake() {
+	select {
+	case cron.wakeChannel <- true:
+	default:
+	}
+}
+
+func newCronJob(job Job, fromSettings bool, now time.Time) (*cronJob, error) {
+	if problems := job.Validate(); len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
+	}
+	expr, _ := ParseCron(job.Schedule)
+	return &cronJob{job: job, expr: expr, fromSettings: fromSettings, next: expr.Next(now)}, nil
+}
+
+// lock must be taken, state of runs is kept for the same job name
+func (cron *CronScheduler) putJob(item *cronJob) {
+	if old, exists := cron.jobs[item.job.Name]; exists {
+		item.results, item.lastTask, item.lastRun = old.results, old.lastTask, old.lastRun
+		item.runs, item.skipped, item.failed = old.runs, old.skipped, old.failed
+	}
+	cron.jobs[item.job.Name] = item
+}
+
+// Add or replace job (not from settings)
+func (cron *CronScheduler) AddJob(job Job) error {
+	item, err := newCronJob(job, false, time.Now())
+	if err != nil {
+		return err
+	}
+	cron.lock.Lock()
+	defer cron.lock.Unlock()
+	if !cron.active {
+		return ErrCronStopped
+	}
+	if old, exists := cron.jobs[job.Name]; exists && old.fromSettings {
+		return ErrSettingsJob
+	}
+	cron.putJob(item)
+	cron.wake()
+	logger.Info("Cron job %s added: %s %s", job.Name, job.Schedule, job.Method)
+	return nil
+}
+
+// Remove job (not from settings)
+func (cron *CronScheduler) RemoveJob(name string) error {
+	cron.lock.Lock()
+	defer cron.lock.Unlock()
+	item, exists := cron.jobs[name]
+	if !exists {
+		return ErrUnknownJob
+	}
+	if item.fromSettings {
+		return ErrSettingsJob
+	}
+	delete(cron.jobs, name)
+	logger.Info("Cron job %s removed", name)
+	return nil
+}
+
+// Replace jobs from settings, jobs from admin socket with the same names are replaced too
+func (cron *CronScheduler) SetSettingsJobs(jobs []Job) error {
+	now := time.Now()
+	items := make([]*cronJob, 0, len(jobs))
+	for _, job := range jobs {
+		item, err := newCronJob(job, true, now)
+		if err != nil {
+			return fmt.Errorf("job %s: %s", job.Name, err)
+		}
+		items = append(items, item)
+	}
+	cron.lock.Lock()
+	defer cron.lock.Unlock()
+	for name, item := range cron.jobs {
+		if item.fromSettings {
+			delete(cron.jobs, name)
+		}
+	}
+	for _, item := range items {
+		cron.putJob(item)
+	}
+	cron.wake()
+	return nil
+}
+
+// Jobs from settings
+func (cron *CronScheduler) SettingsJobs() []Job {
+	cron.lock.Lock()
+	defer cron.lock.Unlock()
+	var result []Job
+	for _, item := range cron.jobs {
+		if item.fromSettings {
+			result = append(result, item.job)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// State of all jobs sorted by name
+func (cron *CronScheduler) Jobs() []JobStatus {
+	cron.lock.Lock()
+	defer cron.lock.Unlock()
+	result := make([]JobStatus, 0, len(cron.jobs))
+	for _, item := range cron.jobs {
+		status := JobStatus{
+			Job:          item.job,
+			FromSettings: item.fromSettings,
+			InFlight:     item.inFlight(),
+			LastTask:     item.lastTask,
+			Runs:         item.runs,
+			Skipped:      item.skipped,
+			Failed:       item.failed}
+		if !item.next.IsZero() {
+			status.Next = item.next.Format(time.RFC3339)
+		}
+		if !item.lastRun.IsZero() {
+			status.LastRun = item.lastRun.Format(time.RFC3339)
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// due run of job, command is enqueued without lock
+type cronRun struct {
+	name string
+	cmd  *transport.Command
+}
+
+// lock must be taken, "false" if run is skipped because of previous one
+func (item *cronJob) startRun() bool {
+	if item.inFlight() && !item.job.AllowOverlap {
+		item.skipped++
+		logger.With(logger.Fields{logger.FieldJob: item.job.Name, logger.FieldMethod: item.job.Method}).Warn(
+			"Job run is skipped, previous task %s is in flight", item.lastTask)
+		return false
+	}
+	return true
+}
+
+// enqueue command of job run, result is saved to job with the same name
+func (cron *CronScheduler) runJob(run cronRun, now time.Time) {
+	task, results, err := cron.enqueueHandler(run.cmd)
+	jobLog := logger.With(logger.Fields{logger.FieldJob: run.name, logger.FieldMethod: run.cmd.Method})
+	cron.lock.Lock()
+	defer cron.lock.Unlock()
+	item, exists := cron.jobs[run.name]
+	if err != nil {
+		if exists {
+			item.failed++
+		}
+		jobLog.Warn("Job run is not enqueued: %s", err)
+		return
+	}
+	if exists {
+		item.results, item.lastTask, item.lastRun = results, task, now
+		item.runs++
+	}
+	jobLog.With(logger.Fields{logger.FieldTask: task}).Debug("Job run is enqueued")
+}
+
+// Run jobs which are due at time (run loop calls it with current time),
+// result is first next run (zero if there are no jobs).
+// Due jobs are collected under lock and enqueued without it.
+func (cron *CronScheduler) RunDue(now time.Time) time.Time {
+	var first time.Time
+	var runs []cronRun
+	cron.lock.Lock()
+	for _, item := range cron.jobs {
+		if !item.next.IsZero() && !item.next.After(now) {
+			if item.startRun() {
+				runs = append(runs, cronRun{name: item.job.Name, cmd: item.job.Command()})
+			}
+			item.next = item.expr.Next(now)
+		}
+		if !item.next.IsZero() && (first.IsZero() || item.next.Before(first)) {
+			first = item.next
+		}
+	}
+	cron.lock.Unlock()
+	for _, run := range runs {
+		cron.runJob(run, now)
+	}
+	return first
+}
+
+func (cron *CronScheduler) run() {
+	timer := time.NewTimer(idleWait)
+	defer timer.Stop()
+	logger.Debug("Cron at %p started.", cron)
+	for active := true; active; {
+		select {
+		case <-cron.exitChannel:
+			active = false
+			continue
+		case <-cron.wakeChannel:
+		case <-timer.C:
+		}
+		now := time.Now()
+		wait := idleWait
+		if first := cron.RunDue(now); !first.IsZero() && first.Sub(now) < wait {
+			wait = first.Sub(now)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+	close(cron.doneChannel)
+	logger.Debug("Cron at %p stopped.", cron)
+}
+
+// Stop run loop
+func (cron *CronScheduler) Stop() {
+	cron.lock.Lock()
+	if !cron.active {
+		cron.lock.Unlock()
+		return
+	}
+	cron.active = false
+	cron.lock.Unlock()
+	cron.exitChannel <- true
+	<-cron.doneChannel
+}
+
+// subsys SubSystemSwitcher
+func (cron *CronScheduler) CallCommandService(commandCode int, doneChannel *chan subsys.SubSystemMsg) {
+	ssCode := cron.GetCode()
+	switch commandCode {
+	case subsys.SubSystemCommandCodeStop:
+		{
+			cron.Stop()
+			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStop))
+		}
+	case subsys.SubSystemCommandCodeStartService:
+		{
+			logger.Debug("Cron at %p has command for starting.", cron)
+			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStartService))
+		}
+	default:
+		{
+			logger.Warn("Cron at %p got unsupported command %d", cron, commandCode)
+		}
+	}
+}
+
+func (cron *CronScheduler) GetCode() int {
+	return subsys.SubSystemCron
+}
@@ -0,0 +1,98 @@
+package scheduler_test
+
+import (
+	"errors"
+	"squ/scheduler"
+	"squ/transport"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2024, 1, 31, 10, 17, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 31, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 31, 10, 30, 0, 0, time.UTC)},
+		{"5 9-17/4 * * *", time.Date(2024, 1, 31, 13, 5, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 8 * * sat,sun", time.Date(2024, 2, 3, 8, 0, 0, 0, time.UTC)},
+		// any of day fields
+		{"0 0 15 * 5", time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 2, 4, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC)}}
+	for _, item := range cases {
+		expr, err := scheduler.ParseCron(item.expr)
+		if err != nil {
+			t.Errorf("%s: %s", item.expr, err)
+			continue
+		}
+		if next := expr.Next(start); !next.Equal(item.next) {
+			t.Errorf("%s: next %s, expected %s", item.expr, next, item.next)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * * mon-", "*/0 * * * *", "0 0 31 2 *"} {
+		if _, err := scheduler.ParseCron(expr); err == nil {
+			t.Errorf("error expected for '%s'", expr)
+		}
+	}
+}
+
+func TestCronOverlap(t *testing.T) {
+	var results []chan transport.Answer
+	var methods []string
+	var cron *scheduler.CronScheduler
+	cron = scheduler.NewCronScheduler(func(cmd *transport.Command) (string, chan transport.Answer, error) {
+		// handler is called without lock of cron
+		if len(cron.SettingsJobs()) != 3 {
+			t.Error("jobs of cron are not available in handler")
+		}
+		if cmd.Method == "full" {
+			return "", nil, errors.New("queue full")
+		}
+		resultChannel := make(chan transport.Answer, 1)
+		results = append(results, resultChannel)
+		methods = append(methods, cmd.Method+" "+cmd.Params)
+		return "task", resultChannel, nil
+	})
+	cron.Stop()
+	jobs := []scheduler.Job{
+		{Name: "single", Schedule: "* * * * *", Method: "sum", Params: []byte(`{"a": 1}`)},
+		{Name: "many", Schedule: "* * * * *", Method: "log", AllowOverlap: true},
+		{Name: "failed", Schedule: "* * * * *", Method: "full"}}
+	if err := cron.SetSettingsJobs(jobs); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Add(time.Minute)
+	for run := 0; run < 3; run++ {
+		cron.RunDue(now)
+		now = now.Add(time.Minute)
+	}
+	// single: 1 run and 2 skipped, many: 3 runs
+	if len(results) != 4 {
+		t.Fatalf("incorrect runs %v", methods)
+	}
+	status := cron.Jobs()
+	if status[0].Name != "failed" || status[0].Failed != 3 ||
+		status[1].Name != "many" || status[1].Runs != 3 ||
+		status[2].Name != "single" || status[2].Runs != 1 || status[2].Skipped != 2 || !status[2].InFlight {
+		//
+		t.Errorf("incorrect status %+v", status)
+	}
+	for _, resultChannel := range results {
+		resultChannel <- *transport.NewAnswer(0, "{}")
+	}
+	cron.RunDue(now)
+	if status = cron.Jobs(); status[2].Runs != 2 || len(results) != 6 {
+		t.Errorf("run expected after result %+v", status[2])
+	}
+	if cron.RemoveJob("single") != scheduler.ErrSettingsJob || cron.RemoveJob("other") != scheduler.ErrUnknownJob {
+		t.Error("incorrect remove")
+	}
+	if cron.AddJob(scheduler.Job{Name: "bad", Schedule: "daily", Method: "sum"}) == nil {
+		t.Error("error expected for incorrect schedule")
+	}
+}
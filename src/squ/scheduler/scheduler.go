@@ -0,0 +1,220 @@
+package scheduler
+
+import (
+	"container/heap"
+	"squ/logger"
+	subsys "squ/subsysmanage"
+	"squ/transport"
+	"sync"
+	"time"
+)
+
+const (
+	// wait of release loop without commands
+	idleWait = time.Minute
+)
+
+// Handler of due commands, it puts command to queue
+type ReleaseHandler func(cmd *transport.Command, task string)
+
+// delayed command
+type delayedCmd struct {
+	task      string
+	cmd       *transport.Command
+	due       int64 // unix ns.
+	heapIndex int
+}
+
+// min-heap of commands by due time (container/heap)
+type dueHeap []*delayedCmd
+
+func (items dueHeap) Len() int {
+	return len(items)
+}
+
+func (items dueHeap) Less(i, j int) bool {
+	return items[i].due < items[j].due
+}
+
+func (items dueHeap) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+	items[i].heapIndex = i
+	items[j].heapIndex = j
+}
+
+func (items *dueHeap) Push(value interface{}) {
+	item := value.(*delayedCmd)
+	item.heapIndex = len(*items)
+	*items = append(*items, item)
+}
+
+func (items *dueHeap) Pop() interface{} {
+	old := *items
+	last := len(old) - 1
+	item := old[last]
+	old[last] = nil
+	*items = old[:last]
+	return item
+}
+
+// Holder of delayed commands in memory, they are released to handler at due time
+type Scheduler struct {
+	lock           sync.Mutex
+	items          dueHeap
+	tasks          map[string]*delayedCmd
+	releaseHandler ReleaseHandler
+	active         bool
+	// wake of release loop for due time before planned one
+	wakeChannel chan bool
+	exitChannel chan bool
+	doneChannel chan bool
+}
+
+func NewScheduler(rhandler ReleaseHandler) *Scheduler {
+	scheduler := Scheduler{
+		tasks:          make(map[string]*delayedCmd),
+		releaseHandler: rhandler,
+		active:         true,
+		wakeChannel:    make(chan bool, 1),
+		exitChannel:    make(chan bool, 1),
+		doneChannel:    make(chan bool)}
+	go scheduler.run()
+	logger.Debug("Scheduler at %p", &scheduler)
+	return &scheduler
+}
+
+// Hold command until due time, "false" if scheduler is stopped
+func (scheduler *Scheduler) Schedule(cmd *transport.Command, task string, due time.Time) bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	if !scheduler.active {
+		return false
+	}
+	if item, exists := scheduler.tasks[task]; exists {
+		item.cmd = cmd
+		item.due = due.UnixNano()
+		heap.Fix(&scheduler.items, item.heapIndex)
+	} else {
+		item = &delayedCmd{task: task, cmd: cmd, due: due.UnixNano()}
+		scheduler.tasks[task] = item
+		heap.Push(&scheduler.items, item)
+	}
+	if scheduler.items[0].task == task {
+		select {
+		case scheduler.wakeChannel <- true:
+		default:
+		}
+	}
+	return true
+}
+
+// Remove command before due time
+func (scheduler *Scheduler) Cancel(task string) bool {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	item, exists := scheduler.tasks[task]
+	if exists {
+		delete(scheduler.tasks, task)
+		heap.Remove(&scheduler.items, item.heapIndex)
+	}
+	return exists
+}
+
+// Count of delayed commands
+func (scheduler *Scheduler) Len() int {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	return len(scheduler.items)
+}
+
+// remove due commands, next is first due time of remaining (0 if empty)
+func (scheduler *Scheduler) takeDue(now int64) (due []*delayedCmd, next int64) {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+	for len(scheduler.items) > 0 && scheduler.items[0].due <= now {
+		item := heap.Pop(&scheduler.items).(*delayedCmd)
+		delete(scheduler.tasks, item.task)
+		due = append(due, item)
+	}
+	if len(scheduler.items) > 0 {
+		next = scheduler.items[0].due
+	}
+	return due, next
+}
+
+// release loop: wait for first due time
+func (scheduler *Scheduler) run() {
+	timer := time.NewTimer(idleWait)
+	defer timer.Stop()
+	logger.Debug("Scheduler at %p started.", scheduler)
+	for active := true; active; {
+		select {
+		case <-scheduler.exitChannel:
+			active = false
+			continue
+		case <-scheduler.wakeChannel:
+		case <-timer.C:
+		}
+		now := time.Now()
+		due, next := scheduler.takeDue(now.UnixNano())
+		for _, item := range due {
+			scheduler.releaseHandler(item.cmd, item.task)
+		}
+		wait := idleWait
+		if next > 0 && time.Duration(next-now.UnixNano()) < wait {
+			wait = time.Duration(next - now.UnixNano())
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+	close(scheduler.doneChannel)
+	logger.Debug("Scheduler at %p stopped.", scheduler)
+}
+
+// Stop release loop, delayed commands are not released after it.
+// Commands are kept in memory only: pending ones are lost on shutdown of server
+// (waiters get timeout), reload of settings doesn't stop scheduler and keeps them.
+func (scheduler *Scheduler) Stop() {
+	scheduler.lock.Lock()
+	if !scheduler.active {
+		scheduler.lock.Unlock()
+		return
+	}
+	scheduler.active = false
+	if count := len(scheduler.items); count > 0 {
+		logger.Warn("Delayed commands are lost: %d", count)
+	}
+	scheduler.lock.Unlock()
+	scheduler.exitChannel <- true
+	<-scheduler.doneChannel
+}
+
+// subsys SubSystemSwitcher
+func (scheduler *Scheduler) CallCommandService(commandCode int, doneChannel *chan subsys.SubSystemMsg) {
+	ssCode := scheduler.GetCode()
+	switch commandCode {
+	case subsys.SubSystemCommandCodeStop:
+		{
+			scheduler.Stop()
+			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStop))
+		}
+	case subsys.SubSystemCommandCodeStartService:
+		{
+			logger.Debug("Scheduler at %p has command for starting.", scheduler)
+			(*doneChannel) <- *(subsys.NewSubSystemMsg(ssCode, subsys.SubSystemCommandCodeStartService))
+		}
+	default:
+		{
+			logger.Warn("Scheduler at %p got unsupported command %d", scheduler, commandCode)
+		}
+	}
+}
+
+func (scheduler *Scheduler) GetCode() int {
+	return subsys.SubSystemScheduler
+}
@@ -0,0 +1,77 @@
+package scheduler_test
+
+import (
+	"squ/scheduler"
+	"squ/transport"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReleaseOrder(t *testing.T) {
+	var lock sync.Mutex
+	var released []string
+	delayed := scheduler.NewScheduler(func(cmd *transport.Command, task string) {
+		lock.Lock()
+		defer lock.Unlock()
+		released = append(released, task)
+	})
+	defer delayed.Stop()
+	cmd := transport.NewCommand("sum")
+	now := time.Now()
+	delayed.Schedule(cmd, "t3", now.Add(60*time.Millisecond))
+	delayed.Schedule(cmd, "t1", now.Add(20*time.Millisecond))
+	delayed.Schedule(cmd, "t2", now.Add(40*time.Millisecond))
+	delayed.Schedule(cmd, "t4", now.Add(50*time.Millisecond))
+	if !delayed.Cancel("t4") || delayed.Cancel("t4") {
+		t.Error("incorrect cancel")
+	}
+	if delayed.Len() != 3 {
+		t.Errorf("incorrect length %d", delayed.Len())
+	}
+	time.Sleep(30 * time.Millisecond)
+	lock.Lock()
+	if len(released) != 1 || released[0] != "t1" {
+		t.Errorf("incorrect released tasks %v", released)
+	}
+	lock.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(released) != 3 || released[1] != "t2" || released[2] != "t3" {
+		t.Errorf("incorrect released tasks %v", released)
+	}
+}
+
+func TestStop(t *testing.T) {
+	delayed := scheduler.NewScheduler(func(cmd *transport.Command, task string) {
+		t.Errorf("task %s released after stop", task)
+	})
+	delayed.Schedule(transport.NewCommand("sum"), "t1", time.Now().Add(20*time.Millisecond))
+	delayed.Stop()
+	if delayed.Schedule(transport.NewCommand("sum"), "t2", time.Now()) {
+		t.Error("stopped scheduler accepts commands")
+	}
+	time.Sleep(30 * time.Millisecond)
+}
+
+func TestNotBefore(t *testing.T) {
+	now := time.Now()
+	cmd := transport.NewCommand("sum")
+	if due, err := cmd.GetNotBefore(now); err != nil || !due.IsZero() {
+		t.Errorf("command without delay %s %v", due, err)
+	}
+	cmd.Delay = 1.5
+	cmd.NotBefore = now.Add(time.Hour).Format(time.RFC3339)
+	if due, _ := cmd.GetNotBefore(now); due.Sub(now) < 59*time.Minute {
+		t.Errorf("later time expected %s", due)
+	}
+	cmd.NotBefore = now.Add(-time.Hour).Format(time.RFC3339)
+	if due, _ := cmd.GetNotBefore(now); due.Sub(now) != 1500*time.Millisecond {
+		t.Errorf("delay expected %s", due)
+	}
+	cmd.NotBefore = "tomorrow"
+	if _, err := cmd.GetNotBefore(now); err != transport.ErrNotBeforeFormat {
+		t.Errorf("format error expected %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	common "squ/commonserver"
+	"strconv"
+	"strings"
+)
+
+const (
+	EnvPrefix  = "SQU_"
+	EnvSockets = EnvPrefix + "SOCKETS"
+)
+
+// settings key -> kind of value, from json tags of settingsSrc
+func settingsKeys() map[string]reflect.Kind {
+	result := make(map[string]reflect.Kind)
+	srcType := reflect.TypeOf(settingsSrc{})
+	for index := 0; index < srcType.NumField(); index++ {
+		field := srcType.Field(index)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag != "" && tag != "-" {
+			result[tag] = field.Type.Kind()
+		}
+	}
+	return result
+}
+
+func socketTypeByName(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "executer":
+		return common.NetExecuter, nil
+	case "receiver":
+		return common.NetRecеiver, nil
+	case "admin":
+		return common.NetAdmin, nil
+	}
+	if value, err := strconv.Atoi(name); err == nil {
+		return value, nil
+	}
+	return 0, fmt.Errorf("unknown socket type '%s'", name)
+}
+
+// Socket in short form: type[+protocol]@tcp://addr:port or type[+protocol]@unix:///path
+func parseShortSocket(value string) (map[string]interface{}, error) {
+	parts := strings.SplitN(value, "@", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("socket '%s' must be in form type@network://address", value)
+	}
+	kind := strings.SplitN(parts[0], "+", 2)
+	socketType, err := socketTypeByName(kind[0])
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{"type": socketType}
+	if len(kind) > 1 {
+		result["protocol"] = kind[1]
+	}
+	address := strings.SplitN(parts[1], "://", 2)
+	if len(address) != 2 {
+		return nil, fmt.Errorf("socket '%s' has no network", value)
+	}
+	result["network"] = address[0]
+	if address[0] == common.NetworkUnix {
+		result["path"] = address[1]
+		return result, nil
+	}
+	index := strings.LastIndex(address[1], ":")
+	if index < 0 {
+		return nil, fmt.Errorf("socket '%s' has no port", value)
+	}
+	port, err := strconv.Atoi(address[1][index+1:])
+	if err != nil {
+		return nil, fmt.Errorf("socket '%s' has incorrect port", value)
+	}
+	result["addr"] = address[1][:index]
+	result["port"] = port
+	return result, nil
+}
+
+// SQU_SOCKETS: JSON list or comma separated short forms
+func parseEnvSockets(value string) (interface{}, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		var result []interface{}
+		err := json.Unmarshal([]byte(value), &result)
+		return result, err
+	}
+	result := make([]interface{}, 0)
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		socket, err := parseShortSocket(part)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, socket)
+	}
+	return result, nil
+}
+
+// Settings values from environment (SQU_<KEY> for every key of settings),
+// environ is in form of os.Environ.
+func EnvValues(environ []string) (map[string]interface{}, error) {
+	env := make(map[string]string)
+	for _, item := range environ {
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	result := make(map[string]interface{})
+	var problems []string
+	for key, kind := range settingsKeys() {
+		value, exists := env[EnvPrefix+strings.ToUpper(key)]
+		if !exists {
+			continue
+		}
+		switch kind {
+		case reflect.String:
+			result[key] = value
+		case reflect.Int:
+			{
+				if number, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+					result[key] = number
+				} else {
+					problems = append(problems, fmt.Sprintf(
+						"%s%s must be integer", EnvPrefix, strings.ToUpper(key)))
+				}
+			}
+		case reflect.Ptr:
+			{
+				// object in JSON
+				var object map[string]interface{}
+				if err := json.Unmarshal([]byte(value), &object); err == nil {
+					result[key] = object
+				} else {
+					problems = append(problems, fmt.Sprintf(
+						"%s%s must be JSON object", EnvPrefix, strings.ToUpper(key)))
+				}
+			}
+		case reflect.Map:
+			{
+				if levels, err := parseEnvMap(value); err == nil {
+					result[key] = levels
+				} else {
+					problems = append(problems, fmt.Sprintf(
+						"%s%s: %s", EnvPrefix, strings.ToUpper(key), err))
+				}
+			}
+		case reflect.Slice:
+			{
+				name := EnvPrefix + strings.ToUpper(key)
+				if name == EnvSockets {
+					if sockets, err := parseEnvSockets(value); err == nil {
+						result[key] = sockets
+					} else {
+						problems = append(problems, fmt.Sprintf("%s: %s", EnvSockets, err))
+					}
+					break
+				}
+				// other lists (cron jobs) in JSON
+				var list []interface{}
+				if err := json.Unmarshal([]byte(value), &list); err == nil {
+					result[key] = list
+				} else {
+					problems = append(problems, fmt.Sprintf("%s must be JSON list", name))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return result, nil
+}
+
+// map in form "key=value,key2=value2"
+func parseEnvMap(value string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("expected key=value, got '%s'", item)
+		}
+		result[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return result, nil
+}
+
+// settings from decoded values
+func fromValues(values interface{}) (*JsonFileSettings, error) {
+	content, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJsonSettings(content)
+}
+
+// settings file formats
+const (
+	FormatJson = ".json"
+	FormatYaml = ".yaml"
+	FormatToml = ".toml"
+)
+
+// decode file content, format by extension if empty
+func decodeFile(filePath string, format string) (map[string]interface{}, error) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, &FileError{Path: filePath, Err: err}
+	}
+	if format == "" {
+		format = strings.ToLower(filepath.Ext(filePath))
+	}
+	var values interface{}
+	switch format {
+	case FormatJson:
+		{
+			var result map[string]interface{}
+			err = json.Unmarshal(content, &result)
+			values = result
+		}
+	case FormatYaml, ".yml":
+		values, err = ParseYaml(content)
+	case FormatToml:
+		values, err = ParseToml(content)
+	default:
+		return nil, &FileError{Path: filePath, Err: ErrUnknownFormat}
+	}
+	if err != nil {
+		return nil, &FileError{Path: filePath, Err: err}
+	}
+	result, ok := values.(map[string]interface{})
+	if !ok {
+		return nil, &FileError{Path: filePath, Err: ErrNotMap}
+	}
+	return result, nil
+}
+
+func loadFile(filePath string, format string) (*JsonFileSettings, error) {
+	values, err := decodeFile(filePath, format)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := fromValues(values)
+	if err != nil {
+		return nil, &FileError{Path: filePath, Err: err}
+	}
+	return settings, nil
+}
+
+// Settings from YAML file with validation
+func LoadYamlSettings(filePath string) (*JsonFileSettings, error) {
+	return loadFile(filePath, FormatYaml)
+}
+
+// Settings from TOML file with validation
+func LoadTomlSettings(filePath string) (*JsonFileSettings, error) {
+	return loadFile(filePath, FormatToml)
+}
+
+// Settings from environment only (for containers)
+func LoadEnvSettings(environ []string) (*JsonFileSettings, error) {
+	values, err := EnvValues(environ)
+	if err != nil {
+		return nil, err
+	}
+	return fromValues(values)
+}
+
+// Layered settings: file (format by extension, can be empty)
+// with environment values over it.
+func LoadSettings(filePath string, environ []string) (*JsonFileSettings, error) {
+	values := make(map[string]interface{})
+	if filePath != "" {
+		fileValues, err := decodeFile(filePath, "")
+		if err != nil {
+			return nil, err
+		}
+		values = fileValues
+	}
+	envValues, err := EnvValues(environ)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range envValues {
+		values[key] = value
+	}
+	settings, err := fromValues(values)
+	if err != nil && filePath != "" {
+		return nil, &FileError{Path: filePath, Err: err}
+	}
+	return settings, err
+}
+
+// Loader of layered settings with process environment
+func FileLoader(filePath string) Loader {
+	return func() (SettingsProvider, error) {
+		settings, err := LoadSettings(filePath, os.Environ())
+		if err != nil {
+			return nil, err
+		}
+		return settings, nil
+	}
+}
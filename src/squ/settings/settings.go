@@ -2,20 +2,93 @@ package settings
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"squ/cmdexecstorage"
 	common "squ/commonserver"
 	"squ/logger"
+	"squ/resultstore"
+	"squ/scheduler"
+	"squ/spillqueue"
+	"squ/tracing"
+	"strings"
 )
 
 const (
-	DefaultKeepAlivePeriod = 60
+	DefaultKeepAlivePeriod      = common.DefaultKeepAlivePeriod
+	DefaultBufferSize           = common.DefaultBufferSize
+	DefaultStorageIterTime      = 250 // ms
+	DefaultSubSystemStopTimeout = 15  // sec.
 )
 
 type settingsSrc struct {
-	Name    string                `json:"name"`
-	Sockets []common.SocketTarget `json:"sockets"`
+	Name     string                `json:"name"`
+	Sockets  []common.SocketTarget `json:"sockets"`
+	LogLevel string                `json:"log_level"`
+	// "text" or "json"
+	LogFormat string `json:"log_format"`
+	// levels by package name
+	LogLevels map[string]string `json:"log_levels"`
+	// destination of log records, stderr by default
+	LogOutput *logger.SinkOptions `json:"log_output"`
+	// spans of tasks, off by default
+	Tracing *tracing.Options `json:"tracing"`
+	// common connection options
+	KeepAlivePeriod int `json:"keep_alive_period"`
+	BufferSize      int `json:"buffer_size"`
+	MaxMessageSize  int `json:"max_message_size"`
+	// commands streams and storage
+	StorageIterTime      int `json:"storage_iter_time"`
+	StorageShards        int `json:"storage_shards"`
+	QueueSize            int `json:"queue_size"`
+	PauseGetCmd          int `json:"pause_get_cmd"`
+	SubSystemStopTimeout int `json:"subsystem_stop_timeout"`
+	// window of idempotency keys (sec.)
+	DedupWindow int `json:"dedup_window"`
+	// time of finished results for queries (sec.)
+	ResultTTL int `json:"result_ttl"`
+	// policies of full queue, "reject" by default
+	Overflow *common.OverflowOptions `json:"overflow"`
+	// segment files for "spill" policy, memory only by default
+	Spill *spillqueue.Options `json:"spill"`
+	// recurring commands by cron expressions
+	Cron []scheduler.Job `json:"cron"`
 }
 
+var (
+	ErrEmptyPath     = errors.New("empty settings file path")
+	ErrUnknownFormat = errors.New("unknown settings format")
+	ErrNotMap        = errors.New("settings must be a map")
+)
+
+// Problem with settings file: read, decode or validation
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (err *FileError) Error() string {
+	return fmt.Sprintf("settings file %s: %s", err.Path, err.Err)
+}
+
+func (err *FileError) Unwrap() error {
+	return err.Err
+}
+
+// All problems of settings
+type ValidationError struct {
+	Problems []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf(
+		"settings have %d problem(s):\n  %s",
+		len(err.Problems),
+		strings.Join(err.Problems, "\n  "))
+}
+
+// Settings in JSON schema, providers of other formats produce it too
 type JsonFileSettings struct {
 	src *settingsSrc
 }
@@ -36,6 +109,87 @@ func (settings JsonFileSettings) IsActive() bool {
 	}
 }
 
+// Log level name, empty if not in settings
+func (settings JsonFileSettings) GetLogLevel() string {
+	if settings.src == nil {
+		return ""
+	}
+	return settings.src.LogLevel
+}
+
+// Log format name, empty if not in settings
+func (settings JsonFileSettings) GetLogFormat() string {
+	if settings.src == nil {
+		return ""
+	}
+	return settings.src.LogFormat
+}
+
+// Log levels of packages, key is short package name (as "commonserver")
+func (settings JsonFileSettings) GetLogLevels() map[string]string {
+	result := make(map[string]string)
+	if settings.src != nil {
+		for pkg, level := range settings.src.LogLevels {
+			result[pkg] = level
+		}
+	}
+	return result
+}
+
+// Log sink options, stderr if not in settings
+func (settings JsonFileSettings) GetLogOutput() logger.SinkOptions {
+	if settings.src == nil || settings.src.LogOutput == nil {
+		return logger.SinkOptions{}
+	}
+	return *settings.src.LogOutput
+}
+
+// Tracing options, without exporter if not in settings
+func (settings JsonFileSettings) GetTracingOptions() tracing.Options {
+	if settings.src == nil || settings.src.Tracing == nil {
+		return tracing.Options{}
+	}
+	return *settings.src.Tracing
+}
+
+// Spill options, memory only if not in settings
+func (settings JsonFileSettings) GetSpillOptions() spillqueue.Options {
+	if settings.src == nil || settings.src.Spill == nil {
+		return spillqueue.Options{}
+	}
+	return *settings.src.Spill
+}
+
+// Recurring jobs
+func (settings JsonFileSettings) GetCronJobs() []scheduler.Job {
+	if settings.src == nil {
+		return make([]scheduler.Job, 0)
+	}
+	return append([]scheduler.Job(nil), settings.src.Cron...)
+}
+
+// Apply log output, level, format and package levels from settings
+func ApplyLogSettings(settings SettingsProvider) error {
+	ApplyLogLevels(settings)
+	if err := logger.SetSink(settings.GetLogOutput()); err != nil {
+		return fmt.Errorf("log output: %s", err)
+	}
+	return nil
+}
+
+// Level and format of logger from settings, without output
+func ApplyLogLevels(settings SettingsProvider) {
+	if level := settings.GetLogLevel(); level != "" {
+		logger.SetLevel(logger.ParseLevel(level))
+	}
+	logger.SetFormat(settings.GetLogFormat())
+	levels := make(map[string]int)
+	for pkg, level := range settings.GetLogLevels() {
+		levels[pkg] = logger.ParseLevel(level)
+	}
+	logger.SetPackageLevels(levels)
+}
+
 func (settings JsonFileSettings) GetSockets() []common.SocketTarget {
 	if settings.src != nil {
 		return settings.src.Sockets
@@ -44,35 +198,235 @@ func (settings JsonFileSettings) GetSockets() []common.SocketTarget {
 	}
 }
 
+// positive value or default
+func valueOr(value, defaultValue int) int {
+	if value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
 func (settings JsonFileSettings) GetConnectionsOptions() common.ConnectionOptions {
-	return common.ConnectionOptions{BufferSize: 1024}
+	options := common.ConnectionOptions{
+		BufferSize:      DefaultBufferSize,
+		KeepAlivePeriod: DefaultKeepAlivePeriod,
+		MaxMessageSize:  common.DefaultMaxMessageSize}
+	if settings.src != nil {
+		options.BufferSize = valueOr(settings.src.BufferSize, options.BufferSize)
+		options.KeepAlivePeriod = valueOr(settings.src.KeepAlivePeriod, options.KeepAlivePeriod)
+		options.MaxMessageSize = valueOr(settings.src.MaxMessageSize, options.MaxMessageSize)
+	}
+	return options
 }
 
 func (settings JsonFileSettings) GetKeepAlivePeriod() int {
-	return DefaultKeepAlivePeriod
+	return settings.GetConnectionsOptions().KeepAlivePeriod
+}
+
+func (settings JsonFileSettings) GetStorageIterTime() int {
+	if settings.src == nil {
+		return DefaultStorageIterTime
+	}
+	return valueOr(settings.src.StorageIterTime, DefaultStorageIterTime)
+}
+
+// Count of storage shards
+func (settings JsonFileSettings) GetStorageShards() int {
+	if settings.src == nil {
+		return cmdexecstorage.DefaultShardCount
+	}
+	return valueOr(settings.src.StorageShards, cmdexecstorage.DefaultShardCount)
+}
+
+func (settings JsonFileSettings) GetStreamOptions() common.StreamOptions {
+	options := common.StreamOptions{
+		QueueSize:   common.DefaultQueueSize,
+		PauseGetCmd: common.PauseGetCmd,
+		DedupWindow: common.DefaultDedupWindow}
+	if settings.src != nil {
+		options.QueueSize = valueOr(settings.src.QueueSize, options.QueueSize)
+		options.PauseGetCmd = valueOr(settings.src.PauseGetCmd, options.PauseGetCmd)
+		options.DedupWindow = valueOr(settings.src.DedupWindow, options.DedupWindow)
+		if settings.src.Overflow != nil {
+			options.Overflow = *settings.src.Overflow
+		}
+	}
+	return options
+}
+
+func (settings JsonFileSettings) GetResultTTL() int {
+	if settings.src == nil {
+		return resultstore.DefaultTTL
+	}
+	return valueOr(settings.src.ResultTTL, resultstore.DefaultTTL)
+}
+
+func (settings JsonFileSettings) GetSubSystemStopTimeout() int {
+	if settings.src == nil {
+		return DefaultSubSystemStopTimeout
+	}
+	return valueOr(settings.src.SubSystemStopTimeout, DefaultSubSystemStopTimeout)
+}
+
+// Check all values, error contains every problem
+func (settings JsonFileSettings) Validate() error {
+	if settings.src == nil {
+		return &ValidationError{Problems: []string{"empty settings"}}
+	}
+	var problems []string
+	src := settings.src
+	if len(src.Sockets) == 0 {
+		problems = append(problems, "no sockets")
+	}
+	if src.LogLevel != "" && !logger.IsLevelName(src.LogLevel) {
+		problems = append(problems, fmt.Sprintf("unknown log_level '%s'", src.LogLevel))
+	}
+	if !logger.IsFormatName(src.LogFormat) {
+		problems = append(problems, fmt.Sprintf("unknown log_format '%s'", src.LogFormat))
+	}
+	for pkg, level := range src.LogLevels {
+		if !logger.IsLevelName(level) {
+			problems = append(problems, fmt.Sprintf("unknown log_levels.%s '%s'", pkg, level))
+		}
+	}
+	if src.LogOutput != nil {
+		for _, problem := range src.LogOutput.Validate() {
+			problems = append(problems, fmt.Sprintf("log_output: %s", problem))
+		}
+	}
+	if src.Tracing != nil {
+		for _, problem := range src.Tracing.Validate() {
+			problems = append(problems, fmt.Sprintf("tracing: %s", problem))
+		}
+	}
+	if src.Overflow != nil {
+		for _, problem := range src.Overflow.Validate() {
+			problems = append(problems, fmt.Sprintf("overflow: %s", problem))
+		}
+		// memory part of overflow queue is limited by queue size
+		if src.Overflow.Uses(common.OverflowSpill) && (src.Spill == nil || !src.Spill.IsActive()) {
+			problems = append(problems, "overflow: spill policy without spill.path")
+		}
+	}
+	if src.Spill != nil {
+		for _, problem := range src.Spill.Validate() {
+			problems = append(problems, fmt.Sprintf("spill: %s", problem))
+		}
+	}
+	jobs := make(map[string]int)
+	for index, job := range src.Cron {
+		for _, problem := range job.Validate() {
+			problems = append(problems, fmt.Sprintf("cron job %d (%s): %s", index, job.Name, problem))
+		}
+		if prev, exists := jobs[job.Name]; exists && job.Name != "" {
+			problems = append(problems, fmt.Sprintf(
+				"cron job %d (%s): name is already used in job %d", index, job.Name, prev))
+		} else {
+			jobs[job.Name] = index
+		}
+	}
+	used := make(map[string]int)
+	for index, target := range src.Sockets {
+		for _, problem := range target.Validate() {
+			problems = append(problems, fmt.Sprintf("socket %d (%s): %s", index, target, problem))
+		}
+		sock := target.GetAddress()
+		if prev, exists := used[sock]; exists {
+			problems = append(problems, fmt.Sprintf(
+				"socket %d (%s): already used in socket %d", index, target, prev))
+		} else {
+			used[sock] = index
+		}
+	}
+	numbers := []struct {
+		name  string
+		value int
+	}{
+		{"keep_alive_period", src.KeepAlivePeriod},
+		{"buffer_size", src.BufferSize},
+		{"max_message_size", src.MaxMessageSize},
+		{"storage_iter_time", src.StorageIterTime},
+		{"storage_shards", src.StorageShards},
+		{"queue_size", src.QueueSize},
+		{"pause_get_cmd", src.PauseGetCmd},
+		{"subsystem_stop_timeout", src.SubSystemStopTimeout},
+		{"dedup_window", src.DedupWindow},
+		{"result_ttl", src.ResultTTL}}
+	for _, number := range numbers {
+		if number.value < 0 {
+			problems = append(problems, fmt.Sprintf("negative %s: %d", number.name, number.value))
+		}
+	}
+	if src.StorageShards > cmdexecstorage.MaxShardCount {
+		problems = append(problems, fmt.Sprintf(
+			"storage_shards %d is over %d", src.StorageShards, cmdexecstorage.MaxShardCount))
+	}
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
 }
 
-func NewJsonSettings(filePath string) *JsonFileSettings {
+// Settings from JSON content with validation
+func ParseJsonSettings(content []byte) (*JsonFileSettings, error) {
+	src := settingsSrc{}
+	if err := json.Unmarshal(content, &src); err != nil {
+		return nil, err
+	}
+	settings := JsonFileSettings{src: &src}
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// Settings from JSON file with validation
+func LoadJsonSettings(filePath string) (*JsonFileSettings, error) {
 	if len(filePath) < 1 {
-		logger.Terminate("Empty JSON file path.")
+		return nil, ErrEmptyPath
 	}
 	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		logger.Terminate("Can't open settings: %s", err)
+		return nil, &FileError{Path: filePath, Err: err}
 	}
-	src := settingsSrc{}
-	err = json.Unmarshal(content, &src)
+	settings, err := ParseJsonSettings(content)
 	if err != nil {
-		logger.Terminate("Json load from file % error: %s", filePath, err)
+		return nil, &FileError{Path: filePath, Err: err}
+	}
+	return settings, nil
+}
+
+// Source of settings for reload
+type Loader func() (SettingsProvider, error)
+
+// Loader of JSON file
+func JsonFileLoader(filePath string) Loader {
+	return func() (SettingsProvider, error) {
+		settings, err := LoadJsonSettings(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return settings, nil
 	}
-	settings := JsonFileSettings{src: &src}
-	return &settings
 }
 
 type SettingsProvider interface {
 	GetName() string
 	IsActive() bool
+	GetLogLevel() string
+	GetLogFormat() string
+	GetLogLevels() map[string]string
+	GetLogOutput() logger.SinkOptions
+	GetTracingOptions() tracing.Options
+	GetSpillOptions() spillqueue.Options
+	GetCronJobs() []scheduler.Job
 	GetSockets() []common.SocketTarget
 	GetKeepAlivePeriod() int
 	GetConnectionsOptions() common.ConnectionOptions
+	GetStorageIterTime() int
+	GetStorageShards() int
+	GetStreamOptions() common.StreamOptions
+	GetResultTTL() int
+	GetSubSystemStopTimeout() int
+	Validate() error
 }
@@ -0,0 +1,283 @@
+package settings_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	common "squ/commonserver"
+	"squ/settings"
+	"strings"
+	"testing"
+)
+
+func TestSettingsValidation(t *testing.T) {
+	content := `{
+		"queue_size": -1,
+		"sockets": [
+			{"type": 42, "port": 7000},
+			{"type": 0, "network": "unix"},
+			{"type": 0, "protocol": "http", "port": 7000}
+		]}`
+	_, err := settings.ParseJsonSettings([]byte(content))
+	validationErr, ok := err.(*settings.ValidationError)
+	if !ok {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	t.Log(validationErr)
+	// type, path, http for executer, port duplicate, queue size
+	if len(validationErr.Problems) != 5 {
+		t.Errorf("expected 5 problems, got %d", len(validationErr.Problems))
+	}
+}
+
+func TestCronValidation(t *testing.T) {
+	content := `{
+		"sockets": [{"type": 1, "port": 7000}],
+		"cron": [
+			{"name": "sum", "schedule": "*/5 * * * *", "method": "sum", "params": {"a": 1}},
+			{"name": "sum", "schedule": "@daily", "method": "sum"},
+			{"name": "bad", "schedule": "61 * * * *"}
+		]}`
+	_, err := settings.ParseJsonSettings([]byte(content))
+	validationErr, ok := err.(*settings.ValidationError)
+	if !ok {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	// name duplicate, empty method, schedule
+	if len(validationErr.Problems) != 3 {
+		t.Errorf("expected 3 problems, got %v", validationErr.Problems)
+	}
+}
+
+func TestSpillValidation(t *testing.T) {
+	content := `{
+		"sockets": [{"type": 1, "port": 7000}],
+		"overflow": {"methods": {"bulk": "spill"}}
+		}`
+	_, err := settings.ParseJsonSettings([]byte(content))
+	validationErr, ok := err.(*settings.ValidationError)
+	if !ok || len(validationErr.Problems) != 1 || !strings.Contains(validationErr.Problems[0], "spill.path") {
+		t.Fatalf("expected spill path problem, got %v", err)
+	}
+	content = strings.Replace(content, `}}`, `}}, "spill": {"path": "/tmp/squ-spill"}`, 1)
+	if _, err = settings.ParseJsonSettings([]byte(content)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSettingsDefaults(t *testing.T) {
+	content := `{
+		"buffer_size": 4096,
+		"sockets": [
+			{"type": 0, "port": 7000, "keep_alive_period": 10},
+			{"type": 1, "port": 7001}
+		]}`
+	conf, err := settings.ParseJsonSettings([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	common := conf.GetConnectionsOptions()
+	sockets := conf.GetSockets()
+	first := sockets[0].GetConnectionOptions(common)
+	second := sockets[1].GetConnectionOptions(common)
+	if first.KeepAlivePeriod != 10 || first.BufferSize != 4096 {
+		t.Errorf("incorrect socket options %+v", first)
+	}
+	if second.KeepAlivePeriod != settings.DefaultKeepAlivePeriod || second.BufferSize != 4096 {
+		t.Errorf("incorrect socket options %+v", second)
+	}
+	if conf.GetStorageIterTime() != settings.DefaultStorageIterTime {
+		t.Error("incorrect storage iter time")
+	}
+}
+
+const (
+	yamlFixture = `
+# settings
+name: "from yaml"
+log_level: debug
+queue_size: 100
+sockets:
+  - type: 0
+    port: 7000
+    addr: 127.0.0.1
+  - type: 1
+    network: unix
+    path: '/tmp/squ.sock'   # comment
+    mode: "0600"
+  -
+    type: 2
+    port: 7002
+`
+	tomlFixture = `
+name = "from toml"
+log_level = 'debug'
+queue_size = 1_00
+
+[[sockets]]
+type = 0
+port = 7000
+addr = "127.0.0.1"
+
+[[sockets]]
+type = 1
+network = "unix"
+path = "/tmp/squ.sock" # comment
+mode = "0600"
+
+[[sockets]]
+type = 2
+port = 7002
+`
+)
+
+func writeFixture(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "squ-settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkFixtureSettings(t *testing.T, conf settings.SettingsProvider, name string) {
+	sockets := conf.GetSockets()
+	if conf.GetName() != name || conf.GetLogLevel() != "debug" || len(sockets) != 3 {
+		t.Fatalf("incorrect settings %s %s %d", conf.GetName(), conf.GetLogLevel(), len(sockets))
+	}
+	if conf.GetStreamOptions().QueueSize != 100 {
+		t.Error("incorrect queue size")
+	}
+	if sockets[0].GetSocket() != "127.0.0.1:7000" ||
+		sockets[1].GetSocket() != "/tmp/squ.sock" ||
+		sockets[2].Type != common.NetAdmin {
+		//
+		t.Errorf("incorrect sockets %+v", sockets)
+	}
+}
+
+func TestYamlSettings(t *testing.T) {
+	path := writeFixture(t, "squ.yml", yamlFixture)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf, err := settings.LoadYamlSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixtureSettings(t, conf, "from yaml")
+	if conf.GetSockets()[1].Mode != "0600" {
+		t.Error("incorrect socket mode")
+	}
+	values, err := settings.ParseYaml([]byte("---\ndecimal: 0660\noctal: 0o660\nhex: 0x1A\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	numbers := values.(map[string]interface{})
+	if numbers["decimal"] != int64(660) || numbers["octal"] != int64(0660) || numbers["hex"] != int64(26) {
+		t.Errorf("incorrect integers %v", numbers)
+	}
+	for _, content := range []string{
+		"sockets:\n  - {type: 1, port: 8081}\n",
+		"socket: {type: 1}\n",
+		"name: |\n  text\n",
+		"name: &name squ\n",
+		"name: *name\n",
+		"methods: [sum, *name]\n",
+		"sockets:\n  - &socket\n    type: 1\n",
+		"&socket type: 1\n",
+		"name: !!str squ\n",
+		"name: a\n---\nname: b\n",
+		"name: a\n...\n",
+		"name: a\nname: b\n",
+		"log_levels:\n  netserver: debug\n  netserver: info\n"} {
+		//
+		if _, err = settings.ParseYaml([]byte(content)); err == nil {
+			t.Errorf("yaml error expected for %q", content)
+		}
+	}
+}
+
+func TestTomlSettings(t *testing.T) {
+	path := writeFixture(t, "squ.toml", tomlFixture)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf, err := settings.LoadTomlSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixtureSettings(t, conf, "from toml")
+	if conf.GetSockets()[1].Mode != "0600" {
+		t.Error("incorrect socket mode")
+	}
+	if _, err = settings.ParseToml([]byte("[[sockets]]\ntype = \n")); err == nil {
+		t.Error("toml error expected")
+	}
+}
+
+func TestEnvSettings(t *testing.T) {
+	environ := []string{
+		"SQU_NAME=from env",
+		"SQU_LOG_LEVEL=debug",
+		"SQU_QUEUE_SIZE=100",
+		"SQU_LOG_FORMAT=json",
+		"SQU_LOG_LEVELS=netserver=warn, commonserver=debug",
+		"SQU_SOCKETS=executer@tcp://127.0.0.1:7000, receiver@unix:///tmp/squ.sock, admin@tcp://:7002"}
+	conf, err := settings.LoadEnvSettings(environ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixtureSettings(t, conf, "from env")
+	levels := conf.GetLogLevels()
+	if conf.GetLogFormat() != "json" || len(levels) != 2 || levels["commonserver"] != "debug" {
+		t.Errorf("incorrect log settings %s %v", conf.GetLogFormat(), levels)
+	}
+	if _, err = settings.LoadEnvSettings([]string{"SQU_QUEUE_SIZE=many"}); err == nil {
+		t.Error("env error expected")
+	}
+	if _, err = settings.LoadEnvSettings(append(environ, "SQU_LOG_LEVELS=netserver=loud")); err == nil {
+		t.Error("log level error expected")
+	}
+	conf, err = settings.LoadEnvSettings(append(environ,
+		`SQU_CRON=[{"name": "report", "schedule": "*/5 * * * *", "method": "report"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs := conf.GetCronJobs(); len(jobs) != 1 || jobs[0].Method != "report" {
+		t.Errorf("incorrect cron jobs from env %v", jobs)
+	}
+	_, err = settings.LoadEnvSettings(append(environ, "SQU_CRON=report@*/5 * * * *"))
+	if err == nil || !strings.Contains(err.Error(), "SQU_CRON") ||
+		strings.Contains(err.Error(), settings.EnvSockets) {
+		//
+		t.Errorf("cron error expected, got %v", err)
+	}
+}
+
+func TestLayeredSettings(t *testing.T) {
+	path := writeFixture(t, "squ.yaml", yamlFixture)
+	defer os.RemoveAll(filepath.Dir(path))
+	conf, err := settings.LoadSettings(path, []string{"SQU_NAME=layered", "SQU_QUEUE_SIZE=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.GetName() != "layered" ||
+		conf.GetStreamOptions().QueueSize != 5 ||
+		len(conf.GetSockets()) != 3 {
+		//
+		t.Errorf("incorrect layered settings")
+	}
+	_, err = settings.LoadSettings(path+".ini", nil)
+	var fileErr *settings.FileError
+	if !errors.As(err, &fileErr) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file error expected, got %v", err)
+	}
+	unknown := path + ".ini"
+	if err = ioutil.WriteFile(unknown, []byte("name=x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = settings.LoadSettings(unknown, nil); !errors.Is(err, settings.ErrUnknownFormat) {
+		t.Errorf("unknown format error expected, got %v", err)
+	}
+}
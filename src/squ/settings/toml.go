@@ -0,0 +1,346 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parser of TOML subset used by settings files:
+// tables, arrays of tables, dotted keys, strings, numbers, booleans,
+// arrays and inline tables. Dates are kept as strings.
+
+type tomlParser struct {
+	data []rune
+	pos  int
+	line int
+}
+
+func (parser *tomlParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("toml line %d: %s", parser.line, fmt.Sprintf(format, a...))
+}
+
+func (parser *tomlParser) eof() bool {
+	return parser.pos >= len(parser.data)
+}
+
+func (parser *tomlParser) peek() rune {
+	if parser.eof() {
+		return 0
+	}
+	return parser.data[parser.pos]
+}
+
+func (parser *tomlParser) next() rune {
+	char := parser.peek()
+	parser.pos++
+	if char == '\n' {
+		parser.line++
+	}
+	return char
+}
+
+// skip spaces and comments, with newlines if multiline
+func (parser *tomlParser) skip(multiline bool) {
+	for !parser.eof() {
+		switch char := parser.peek(); {
+		case char == ' ' || char == '\t' || char == '\r':
+			parser.next()
+		case char == '\n' && multiline:
+			parser.next()
+		case char == '#':
+			for !parser.eof() && parser.peek() != '\n' {
+				parser.next()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (parser *tomlParser) expectLineEnd() error {
+	parser.skip(false)
+	if !parser.eof() && parser.next() != '\n' {
+		return parser.errorf("expected end of line")
+	}
+	return nil
+}
+
+func isBareKeyChar(char rune) bool {
+	return char == '_' || char == '-' ||
+		(char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+}
+
+func (parser *tomlParser) parseKeyPart() (string, error) {
+	parser.skip(false)
+	switch parser.peek() {
+	case '"':
+		return parser.parseBasicString()
+	case '\'':
+		return parser.parseLiteralString()
+	}
+	start := parser.pos
+	for !parser.eof() && isBareKeyChar(parser.peek()) {
+		parser.next()
+	}
+	if start == parser.pos {
+		return "", parser.errorf("expected key")
+	}
+	return string(parser.data[start:parser.pos]), nil
+}
+
+// dotted key
+func (parser *tomlParser) parseKey() ([]string, error) {
+	var result []string
+	for {
+		part, err := parser.parseKeyPart()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, part)
+		parser.skip(false)
+		if parser.peek() != '.' {
+			return result, nil
+		}
+		parser.next()
+	}
+}
+
+func (parser *tomlParser) parseBasicString() (string, error) {
+	parser.next()
+	var builder strings.Builder
+	builder.WriteRune('"')
+	for {
+		if parser.eof() || parser.peek() == '\n' {
+			return "", parser.errorf("unclosed string")
+		}
+		char := parser.next()
+		if char == '\\' {
+			builder.WriteRune(char)
+			char = parser.next()
+		} else if char == '"' {
+			break
+		}
+		builder.WriteRune(char)
+	}
+	builder.WriteRune('"')
+	// escapes of TOML basic strings are the same as JSON ones
+	var result string
+	if err := json.Unmarshal([]byte(builder.String()), &result); err != nil {
+		return "", parser.errorf("incorrect string: %s", err)
+	}
+	return result, nil
+}
+
+func (parser *tomlParser) parseLiteralString() (string, error) {
+	parser.next()
+	start := parser.pos
+	for parser.peek() != '\'' {
+		if parser.eof() || parser.peek() == '\n' {
+			return "", parser.errorf("unclosed string")
+		}
+		parser.next()
+	}
+	result := string(parser.data[start:parser.pos])
+	parser.next()
+	return result, nil
+}
+
+func (parser *tomlParser) parseArray() (interface{}, error) {
+	parser.next()
+	result := make([]interface{}, 0)
+	for {
+		parser.skip(true)
+		if parser.peek() == ']' {
+			parser.next()
+			return result, nil
+		}
+		value, err := parser.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+		parser.skip(true)
+		switch parser.next() {
+		case ',':
+		case ']':
+			return result, nil
+		default:
+			return nil, parser.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (parser *tomlParser) parseInlineTable() (interface{}, error) {
+	parser.next()
+	result := make(map[string]interface{})
+	parser.skip(false)
+	if parser.peek() == '}' {
+		parser.next()
+		return result, nil
+	}
+	for {
+		if err := parser.parseKeyValue(result); err != nil {
+			return nil, err
+		}
+		parser.skip(false)
+		switch parser.next() {
+		case ',':
+		case '}':
+			return result, nil
+		default:
+			return nil, parser.errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
+
+func (parser *tomlParser) parseValue() (interface{}, error) {
+	parser.skip(false)
+	switch parser.peek() {
+	case '"':
+		return parser.parseBasicString()
+	case '\'':
+		return parser.parseLiteralString()
+	case '[':
+		return parser.parseArray()
+	case '{':
+		return parser.parseInlineTable()
+	}
+	start := parser.pos
+	for !parser.eof() && !strings.ContainsRune(" \t\r\n,]}#", parser.peek()) {
+		parser.next()
+	}
+	token := string(parser.data[start:parser.pos])
+	switch token {
+	case "":
+		return nil, parser.errorf("expected value")
+	case "true", "false":
+		return token == "true", nil
+	}
+	number := strings.Replace(token, "_", "", -1)
+	if value, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return value, nil
+	}
+	if value, err := strconv.ParseFloat(number, 64); err == nil {
+		return value, nil
+	}
+	if token[0] >= '0' && token[0] <= '9' {
+		// date and time
+		return token, nil
+	}
+	return nil, parser.errorf("unknown value %s", token)
+}
+
+// table for path, it's created if not exists (last element for arrays of tables)
+func tomlTable(root map[string]interface{}, path []string) (map[string]interface{}, error) {
+	table := root
+	for _, key := range path {
+		switch value := table[key].(type) {
+		case nil:
+			{
+				newTable := make(map[string]interface{})
+				table[key] = newTable
+				table = newTable
+			}
+		case map[string]interface{}:
+			table = value
+		case []interface{}:
+			{
+				last, ok := value[len(value)-1].(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("key %s is not a table", key)
+				}
+				table = last
+			}
+		default:
+			return nil, fmt.Errorf("key %s is not a table", key)
+		}
+	}
+	return table, nil
+}
+
+func (parser *tomlParser) parseKeyValue(table map[string]interface{}) error {
+	key, err := parser.parseKey()
+	if err != nil {
+		return err
+	}
+	parser.skip(false)
+	if parser.next() != '=' {
+		return parser.errorf("expected '='")
+	}
+	value, err := parser.parseValue()
+	if err != nil {
+		return err
+	}
+	target, err := tomlTable(table, key[:len(key)-1])
+	if err != nil {
+		return parser.errorf("%s", err)
+	}
+	name := key[len(key)-1]
+	if _, exists := target[name]; exists {
+		return parser.errorf("duplicate key %s", name)
+	}
+	target[name] = value
+	return nil
+}
+
+// Decode TOML content to maps, lists and scalars
+func ParseToml(content []byte) (map[string]interface{}, error) {
+	parser := tomlParser{data: []rune(string(content)), line: 1}
+	root := make(map[string]interface{})
+	table := root
+	for {
+		parser.skip(true)
+		if parser.eof() {
+			return root, nil
+		}
+		if parser.peek() != '[' {
+			if err := parser.parseKeyValue(table); err != nil {
+				return nil, err
+			}
+			if err := parser.expectLineEnd(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		parser.next()
+		isArray := parser.peek() == '['
+		if isArray {
+			parser.next()
+		}
+		path, err := parser.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		closing := "]"
+		if isArray {
+			closing = "]]"
+		}
+		for _, char := range closing {
+			if parser.next() != char {
+				return nil, parser.errorf("expected '%s'", closing)
+			}
+		}
+		if err = parser.expectLineEnd(); err != nil {
+			return nil, err
+		}
+		parent, err := tomlTable(root, path[:len(path)-1])
+		if err != nil {
+			return nil, parser.errorf("%s", err)
+		}
+		name := path[len(path)-1]
+		if isArray {
+			list, _ := parent[name].([]interface{})
+			if parent[name] != nil && list == nil {
+				return nil, parser.errorf("key %s is not an array", name)
+			}
+			table = make(map[string]interface{})
+			parent[name] = append(list, table)
+		} else {
+			if table, err = tomlTable(parent, []string{name}); err != nil {
+				return nil, parser.errorf("%s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package settings
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parser of YAML subset used by settings files:
+// block maps and lists, scalars, quoted strings, flow lists and comments.
+// Flow maps, anchors, aliases, tags, multi-line scalars, duplicate keys
+// and multiple documents are not supported, they are errors.
+// Integers are in YAML 1.2 form: 10, 0o12 (octal), 0xA.
+
+type yamlLine struct {
+	number  int
+	indent  int
+	content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// cut comment, but not inside quotes
+func yamlStripComment(line string) string {
+	var quote rune
+	for index, char := range line {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '#' && (index == 0 || line[index-1] == ' ' || line[index-1] == '\t'):
+			return line[:index]
+		}
+	}
+	return line
+}
+
+func newYamlParser(content string) (*yamlParser, error) {
+	parser := yamlParser{}
+	for index, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(yamlStripComment(strings.TrimRight(line, "\r")), " \t")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" {
+			continue
+		}
+		if trimmed == "---" || trimmed == "..." {
+			// start marker of the only document
+			if trimmed == "---" && len(parser.lines) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("yaml line %d: multiple documents are not supported", index+1)
+		}
+		parser.lines = append(parser.lines, yamlLine{
+			number:  index + 1,
+			indent:  len(line) - len(trimmed),
+			content: trimmed})
+	}
+	return &parser, nil
+}
+
+func (parser *yamlParser) errorf(line yamlLine, format string, a ...interface{}) error {
+	return fmt.Errorf("yaml line %d: %s", line.number, fmt.Sprintf(format, a...))
+}
+
+func isListItem(content string) bool {
+	return content == "-" || strings.HasPrefix(content, "- ")
+}
+
+// split "key: value" (value can be empty)
+func yamlSplitKey(content string) (string, string, bool) {
+	var quote rune
+	for index, char := range content {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == ':' && (index+1 == len(content) || content[index+1] == ' '):
+			key, err := yamlScalar(strings.TrimSpace(content[:index]))
+			if err != nil {
+				return "", "", false
+			}
+			return fmt.Sprint(key), strings.TrimSpace(content[index+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func (parser *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if parser.pos >= len(parser.lines) {
+		return nil, nil
+	}
+	if isListItem(parser.lines[parser.pos].content) {
+		return parser.parseList(indent)
+	}
+	return parser.parseMap(indent)
+}
+
+// nested value after "key:" or "-"
+func (parser *yamlParser) parseNested(indent int, listAllowed bool) (interface{}, error) {
+	if parser.pos >= len(parser.lines) {
+		return nil, nil
+	}
+	next := parser.lines[parser.pos]
+	if next.indent > indent || (listAllowed && next.indent == indent && isListItem(next.content)) {
+		return parser.parseBlock(next.indent)
+	}
+	return nil, nil
+}
+
+func (parser *yamlParser) parseMap(indent int) (interface{}, error) {
+	result := make(map[string]interface{})
+	for parser.pos < len(parser.lines) {
+		line := parser.lines[parser.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, parser.errorf(line, "unexpected indent")
+		}
+		if isListItem(line.content) {
+			break
+		}
+		key, value, ok := yamlSplitKey(line.content)
+		if !ok {
+			return nil, parser.errorf(line, "expected 'key: value'")
+		}
+		if _, exists := result[key]; exists {
+			return nil, parser.errorf(line, "duplicate key %s", key)
+		}
+		parser.pos++
+		if value == "" {
+			nested, err := parser.parseNested(indent, true)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = nested
+		} else {
+			scalar, err := yamlScalar(value)
+			if err != nil {
+				return nil, parser.errorf(line, "%s", err)
+			}
+			result[key] = scalar
+		}
+	}
+	return result, nil
+}
+
+func (parser *yamlParser) parseList(indent int) (interface{}, error) {
+	result := make([]interface{}, 0)
+	for parser.pos < len(parser.lines) {
+		line := parser.lines[parser.pos]
+		if line.indent < indent || !isListItem(line.content) {
+			break
+		}
+		if line.indent > indent {
+			return nil, parser.errorf(line, "unexpected indent")
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line.content, "-"))
+		if rest == "" {
+			parser.pos++
+			nested, err := parser.parseNested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, nested)
+			continue
+		}
+		if _, _, isKey := yamlSplitKey(rest); isKey || isListItem(rest) {
+			// item content starts at the dash line
+			itemIndent := indent + len(line.content) - len(rest)
+			parser.lines[parser.pos] = yamlLine{
+				number: line.number, indent: itemIndent, content: rest}
+			item, err := parser.parseBlock(itemIndent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, item)
+			continue
+		}
+		parser.pos++
+		scalar, err := yamlScalar(rest)
+		if err != nil {
+			return nil, parser.errorf(line, "%s", err)
+		}
+		result = append(result, scalar)
+	}
+	return result, nil
+}
+
+// split flow list content by commas outside of quotes and brackets
+func splitFlow(content string) []string {
+	var parts []string
+	var quote rune
+	depth := 0
+	start := 0
+	for index, char := range content {
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '[' || char == '{':
+			depth++
+		case char == ']' || char == '}':
+			depth--
+		case char == ',' && depth == 0:
+			parts = append(parts, content[start:index])
+			start = index + 1
+		}
+	}
+	if last := strings.TrimSpace(content[start:]); last != "" {
+		parts = append(parts, last)
+	}
+	return parts
+}
+
+// integer in decimal, octal (0o) or hex (0x) form, leading zero isn't octal
+func yamlInt(value string) (int64, bool) {
+	var number int64
+	var err error
+	switch {
+	case strings.HasPrefix(value, "0o"):
+		number, err = strconv.ParseInt(value[2:], 8, 64)
+	case strings.HasPrefix(value, "0x"):
+		number, err = strconv.ParseInt(value[2:], 16, 64)
+	default:
+		number, err = strconv.ParseInt(value, 10, 64)
+	}
+	return number, err == nil
+}
+
+func yamlScalar(value string) (interface{}, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case value == "" || value == "~" || value == "null":
+		return nil, nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	case strings.HasPrefix(value, "\""):
+		{
+			var result string
+			err := json.Unmarshal([]byte(value), &result)
+			return result, err
+		}
+	case strings.HasPrefix(value, "'"):
+		{
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("unclosed string %s", value)
+			}
+			return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+		}
+	case strings.HasPrefix(value, "["):
+		{
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("unclosed list %s", value)
+			}
+			result := make([]interface{}, 0)
+			for _, part := range splitFlow(value[1 : len(value)-1]) {
+				item, err := yamlScalar(part)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, item)
+			}
+			return result, nil
+		}
+	case value == "{}":
+		return make(map[string]interface{}), nil
+	case strings.HasPrefix(value, "{"):
+		return nil, fmt.Errorf("flow map %s is not supported", value)
+	case strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">"):
+		return nil, fmt.Errorf("multi-line scalar %s is not supported", value)
+	case strings.HasPrefix(value, "&"):
+		return nil, fmt.Errorf("anchor %s is not supported", value)
+	case strings.HasPrefix(value, "*"):
+		return nil, fmt.Errorf("alias %s is not supported", value)
+	case strings.HasPrefix(value, "!"):
+		return nil, fmt.Errorf("tag %s is not supported", value)
+	}
+	if number, ok := yamlInt(value); ok {
+		return number, nil
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number, nil
+	}
+	return value, nil
+}
+
+// Decode YAML content to maps, lists and scalars
+func ParseYaml(content []byte) (interface{}, error) {
+	parser, err := newYamlParser(string(content))
+	if err != nil {
+		return nil, err
+	}
+	if len(parser.lines) == 0 {
+		return make(map[string]interface{}), nil
+	}
+	result, err := parser.parseBlock(parser.lines[0].indent)
+	if err == nil && parser.pos < len(parser.lines) {
+		err = parser.errorf(parser.lines[parser.pos], "unexpected content")
+	}
+	return result, err
+}
@@ -0,0 +1,251 @@
+package spillqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	DefaultSegmentSize = 64 * 1024 * 1024
+	DefaultFileMode    = 0640
+	DefaultDirMode     = 0750
+	// segment files are "segment-<number>.q"
+	segmentPrefix = "segment-"
+	segmentSuffix = ".q"
+	// record is length (uint32, big endian) and data
+	recordHeaderSize = 4
+	maxRecordSize    = 1<<32 - 1
+)
+
+var ErrRecordTooBig = errors.New("record too big")
+
+// Spill options in settings, disk is not used without path
+type Options struct {
+	// directory of segment files
+	Path string `json:"path"`
+	// limits of commands in memory, disk is used over any of them (0 - no limit)
+	MaxCount int   `json:"max_count"`
+	MaxBytes int64 `json:"max_bytes"`
+	// size of one segment file (bytes)
+	SegmentSize int64 `json:"segment_size"`
+}
+
+func (options Options) IsActive() bool {
+	return options.Path != ""
+}
+
+func (options Options) GetSegmentSize() int64 {
+	if options.SegmentSize <= 0 {
+		return DefaultSegmentSize
+	}
+	return options.SegmentSize
+}
+
+// Memory limits are exceeded for count and bytes
+func (options Options) IsOver(count int, size int64) bool {
+	return (options.MaxCount > 0 && count >= options.MaxCount) ||
+		(options.MaxBytes > 0 && size >= options.MaxBytes)
+}
+
+func (options Options) Validate() []string {
+	var problems []string
+	if options.MaxCount < 0 || options.MaxBytes < 0 || options.SegmentSize < 0 {
+		problems = append(problems, "negative limit")
+	}
+	if !options.IsActive() && (options.MaxCount > 0 || options.MaxBytes > 0) {
+		problems = append(problems, "limits without path")
+	}
+	return problems
+}
+
+// FIFO of records in segment files, it isn't safe for concurrent use.
+// Records of previous run are removed, empty queue has no files.
+type SegmentQueue struct {
+	dir         string
+	segmentSize int64
+	// numbers of segment files, oldest first
+	segments  []int64
+	writer    *os.File
+	writeSize int64
+	reader    *os.File
+	buffer    *bufio.Reader
+	count     int
+	size      int64
+}
+
+func NewSegmentQueue(dir string, segmentSize int64) (*SegmentQueue, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, DefaultDirMode); err != nil {
+		return nil, err
+	}
+	queue := SegmentQueue{dir: dir, segmentSize: segmentSize}
+	if err := queue.removeSegments(); err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+func (queue *SegmentQueue) segmentPath(number int64) string {
+	return filepath.Join(queue.dir, fmt.Sprintf("%s%016d%s", segmentPrefix, number, segmentSuffix))
+}
+
+// all segment files in directory
+func (queue *SegmentQueue) removeSegments() error {
+	names, err := filepath.Glob(filepath.Join(queue.dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// new segment for writing
+func (queue *SegmentQueue) rotate() error {
+	var number int64
+	if count := len(queue.segments); count > 0 {
+		number = queue.segments[count-1] + 1
+	}
+	file, err := os.OpenFile(
+		queue.segmentPath(number), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	if queue.writer != nil {
+		queue.writer.Close()
+	}
+	queue.writer = file
+	queue.writeSize = 0
+	queue.segments = append(queue.segments, number)
+	return nil
+}
+
+// Append record to the end
+func (queue *SegmentQueue) Push(data []byte) error {
+	if int64(len(data)) > maxRecordSize {
+		return ErrRecordTooBig
+	}
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[recordHeaderSize:], data)
+	if queue.writer == nil || queue.writeSize+int64(len(record)) > queue.segmentSize && queue.writeSize > 0 {
+		if err := queue.rotate(); err != nil {
+			return err
+		}
+	}
+	if written, err := queue.writer.Write(record); err != nil {
+		// incomplete record can't be read
+		if written > 0 {
+			queue.writer.Truncate(queue.writeSize)
+		}
+		return err
+	}
+	queue.writeSize += int64(len(record))
+	queue.count++
+	queue.size += int64(len(data))
+	return nil
+}
+
+// open oldest segment for reading
+func (queue *SegmentQueue) openReader() error {
+	file, err := os.Open(queue.segmentPath(queue.segments[0]))
+	if err != nil {
+		return err
+	}
+	queue.reader = file
+	queue.buffer = bufio.NewReader(file)
+	return nil
+}
+
+// remove oldest segment after reading
+func (queue *SegmentQueue) nextSegment() error {
+	queue.reader.Close()
+	queue.reader = nil
+	if err := os.Remove(queue.segmentPath(queue.segments[0])); err != nil {
+		return err
+	}
+	queue.segments = queue.segments[1:]
+	return queue.openReader()
+}
+
+// Take record from the beginning, "false" if queue is empty
+func (queue *SegmentQueue) Pop() ([]byte, bool, error) {
+	if queue.count == 0 {
+		return nil, false, nil
+	}
+	if queue.reader == nil {
+		if err := queue.openReader(); err != nil {
+			return nil, false, err
+		}
+	}
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(queue.buffer, header); err == io.EOF && len(queue.segments) > 1 {
+		if err = queue.nextSegment(); err != nil {
+			return nil, false, err
+		}
+		if _, err = io.ReadFull(queue.buffer, header); err != nil {
+			return nil, false, err
+		}
+	} else if err != nil {
+		return nil, false, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(queue.buffer, data); err != nil {
+		return nil, false, err
+	}
+	queue.count--
+	queue.size -= int64(len(data))
+	if queue.count == 0 {
+		// files aren't needed for empty queue
+		return data, true, queue.reset()
+	}
+	return data, true, nil
+}
+
+// close and remove all segments
+func (queue *SegmentQueue) reset() error {
+	if queue.reader != nil {
+		queue.reader.Close()
+		queue.reader = nil
+	}
+	if queue.writer != nil {
+		queue.writer.Close()
+		queue.writer = nil
+	}
+	queue.segments = nil
+	queue.count = 0
+	queue.size = 0
+	return queue.removeSegments()
+}
+
+// Count of records
+func (queue *SegmentQueue) Len() int {
+	return queue.count
+}
+
+// Size of records data (bytes)
+func (queue *SegmentQueue) Size() int64 {
+	return queue.size
+}
+
+// Count of segment files
+func (queue *SegmentQueue) Segments() int {
+	return len(queue.segments)
+}
+
+// Close files, records are removed
+func (queue *SegmentQueue) Close() error {
+	return queue.reset()
+}
@@ -0,0 +1,68 @@
+package spillqueue_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"squ/spillqueue"
+	"testing"
+)
+
+func TestSegmentQueueOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "squ-spill")
+	defer os.RemoveAll(dir)
+	// stale segment of previous run
+	ioutil.WriteFile(filepath.Join(dir, "segment-0000000000000007.q"), []byte("old"), 0640)
+	queue, err := spillqueue.NewSegmentQueue(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	if _, exists, _ := queue.Pop(); exists {
+		t.Fatal("queue must be empty")
+	}
+	next := 0
+	check := func(count int) {
+		for index := 0; index < count; index++ {
+			data, exists, err := queue.Pop()
+			if err != nil || !exists || string(data) != fmt.Sprintf("record %d", next) {
+				t.Fatalf("incorrect record %d: %s %v", next, data, err)
+			}
+			next++
+		}
+	}
+	for index := 0; index < 20; index++ {
+		if err := queue.Push([]byte(fmt.Sprintf("record %d", index))); err != nil {
+			t.Fatal(err)
+		}
+		// reading and writing of the same segment
+		if index%7 == 6 {
+			check(2)
+		}
+	}
+	if queue.Segments() < 3 || queue.Len() != 16 {
+		t.Errorf("incorrect queue %d records in %d segments", queue.Len(), queue.Segments())
+	}
+	check(16)
+	if _, exists, _ := queue.Pop(); exists {
+		t.Fatal("queue must be empty")
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(names) != 0 {
+		t.Errorf("files of empty queue %v", names)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	options := spillqueue.Options{MaxCount: 2, MaxBytes: 100}
+	if len(options.Validate()) != 1 {
+		t.Error("path expected for limits")
+	}
+	if !options.IsOver(2, 0) || !options.IsOver(0, 100) || options.IsOver(1, 99) {
+		t.Error("incorrect limits")
+	}
+	if (spillqueue.Options{Path: "/tmp"}).IsOver(1000000, 1000000) {
+		t.Error("no limits by default")
+	}
+}
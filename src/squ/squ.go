@@ -1,40 +1,107 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"squ/logger"
 	"squ/netserver"
 	"squ/settings"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
-func main() {
+// exit codes
+const (
+	ExitOk            = 0
+	ExitSettingsError = 2
+	ExitStartError    = 3
+	ExitServeError    = 4
+)
+
+// options from environment
+func getOptions() netserver.Options {
+	options := netserver.Options{
+		Debug: strings.ToUpper(os.Getenv("DEBUG")) == "TRUE"}
+	if val, err := strconv.Atoi(os.Getenv("STORAGE_ITER_TIME")); err == nil && val > 0 {
+		options.StorageIterTime = val
+	}
+	return options
+}
+
+// exit code for start error
+func startErrorCode(err error) int {
+	var validationErr *settings.ValidationError
+	if errors.As(err, &validationErr) || errors.Is(err, netserver.ErrNoSettings) {
+		return ExitSettingsError
+	}
+	return ExitStartError
+}
+
+func run() int {
+	logger.SetLevel(logger.ParseLevel(os.Getenv("LOGLEVEL")))
 	path := os.Getenv("CONF")
-	var squSettings settings.SettingsProvider = settings.NewJsonSettings(path)
-	if squSettings.IsActive() {
-		logger.Info("Starting SQU-server.")
-		signalChannel := make(chan os.Signal, 1)
-		signal.Notify(signalChannel, os.Interrupt)
-		signal.Notify(signalChannel, syscall.SIGTERM)
-		server := netserver.NewServer(squSettings)
-		server.Start()
+	squSettings, err := settings.LoadSettings(path, os.Environ())
+	if err != nil {
+		logger.Error("Settings error: %s", err)
+		return ExitSettingsError
+	}
+	if !squSettings.IsActive() {
+		return ExitOk
+	}
+	if err = settings.ApplyLogSettings(squSettings); err != nil {
+		logger.Error("Settings error: %s", err)
+		return ExitSettingsError
+	}
+	defer logger.Close()
+	logger.Info("Starting SQU-server.")
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, os.Interrupt)
+	signal.Notify(signalChannel, syscall.SIGTERM)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	options := getOptions()
+	options.Settings = squSettings
+	server, err := netserver.New(context.Background(), options)
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		logger.Error("Server start error: %s", err)
+		return startErrorCode(err)
+	}
 
-		alive := true
-		for alive {
-			select {
-			case newSig := <-signalChannel:
-				{
-					if newSig != nil {
-						logger.Info("Signal of termination.")
-						alive = false
-					}
+	code := ExitOk
+	alive := true
+	for alive {
+		select {
+		case newSig := <-signalChannel:
+			{
+				if newSig == syscall.SIGHUP {
+					logger.Info("Signal of settings reload.")
+					server.Reload(settings.FileLoader(path))
+				} else if newSig != nil {
+					logger.Info("Signal of termination.")
+					alive = false
 				}
 			}
+		case err := <-server.Errors():
+			{
+				logger.Error("Server error: %s", err)
+				code = ExitServeError
+				alive = false
+			}
 		}
-		close(signalChannel)
-		for !server.Stop() {
-			logger.Warn("server stopping, wait..")
-		}
 	}
+	signal.Stop(signalChannel)
+	close(signalChannel)
+	for !server.Stop() {
+		logger.Warn("server stopping, wait..")
+	}
+	return code
+}
+
+func main() {
+	os.Exit(run())
 }
@@ -0,0 +1,403 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of latency buckets (ms.), last bucket is +Inf
+var LatencyBuckets = []float64{
+	1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000}
+
+// window of throughput (sec.)
+const ThroughputWindow = 60
+
+// task state is removed without result after this time
+const DefaultMaxTaskAge = time.Hour
+
+// Latency distribution with cumulative buckets
+type Histogram struct {
+	// count of values <= bound, for every bound of LatencyBuckets and +Inf
+	Buckets []int64 `json:"buckets"`
+	Count   int64   `json:"count"`
+	Sum     float64 `json:"sum_ms"`
+}
+
+func newHistogram() Histogram {
+	return Histogram{Buckets: make([]int64, len(LatencyBuckets)+1)}
+}
+
+func (histogram *Histogram) observe(duration time.Duration) {
+	value := float64(duration) / float64(time.Millisecond)
+	index := sort.SearchFloat64s(LatencyBuckets, value)
+	histogram.Buckets[index]++
+	histogram.Count++
+	histogram.Sum += value
+}
+
+// copy with cumulative buckets
+func (histogram *Histogram) cumulative() Histogram {
+	result := Histogram{
+		Buckets: make([]int64, len(histogram.Buckets)),
+		Count:   histogram.Count,
+		Sum:     histogram.Sum}
+	var total int64
+	for index, count := range histogram.Buckets {
+		total += count
+		result.Buckets[index] = total
+	}
+	return result
+}
+
+// Approximate quantile (ms.) by upper bound of bucket
+func (histogram Histogram) Quantile(quantile float64) float64 {
+	if histogram.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(quantile * float64(histogram.Count)))
+	for index, count := range histogram.Buckets {
+		if count >= rank {
+			if index < len(LatencyBuckets) {
+				return LatencyBuckets[index]
+			}
+			return math.Inf(1)
+		}
+	}
+	return math.Inf(1)
+}
+
+// results per second for last ThroughputWindow seconds
+type throughput struct {
+	counts [ThroughputWindow]int64
+	times  [ThroughputWindow]int64
+}
+
+func (meter *throughput) add(now time.Time) {
+	second := now.Unix()
+	index := second % ThroughputWindow
+	if meter.times[index] != second {
+		meter.times[index] = second
+		meter.counts[index] = 0
+	}
+	meter.counts[index]++
+}
+
+func (meter *throughput) rate(now time.Time) float64 {
+	second := now.Unix()
+	var total int64
+	for index := range meter.counts {
+		if second-meter.times[index] < ThroughputWindow {
+			total += meter.counts[index]
+		}
+	}
+	return float64(total) / ThroughputWindow
+}
+
+type methodStats struct {
+	enqueued   int64
+	dispatched int64
+	results    int64
+	errors     int64
+	returned   int64
+	queueFull  int64
+	rejected   int64
+	dropped    int64
+	spilled    int64
+	duplicates int64
+	queueWait  Histogram
+	execution  Histogram
+	throughput throughput
+}
+
+// Statistics of method for admin socket and metrics
+type MethodStats struct {
+	Method     string `json:"method"`
+	Enqueued   int64  `json:"enqueued"`
+	Dispatched int64  `json:"dispatched"`
+	Results    int64  `json:"results"`
+	Errors     int64  `json:"errors"`
+	// returns to queue after timeout of executer
+	Returned     int64   `json:"returned"`
+	TimeoutRatio float64 `json:"timeout_ratio"`
+	// new tasks over queue size and results of overflow policies,
+	// rejected tasks are counted in enqueued too
+	QueueFull int64 `json:"queue_full"`
+	Rejected  int64 `json:"rejected"`
+	Dropped   int64 `json:"dropped"`
+	Spilled   int64 `json:"spilled"`
+	// submissions with idempotency key of existing task
+	Duplicates int64 `json:"duplicates"`
+	// results per second for last minute
+	Throughput float64 `json:"throughput"`
+	// from enqueue (or return) to dispatch
+	QueueWait Histogram `json:"queue_wait"`
+	// from dispatch to result
+	Execution Histogram `json:"execution"`
+}
+
+// time marks of task in progress
+type taskState struct {
+	method   string
+	enqueued time.Time
+	// last dispatch or return to queue
+	mark time.Time
+}
+
+// Collector of method statistics, nil collector does nothing
+type Collector struct {
+	methods   map[string]*methodStats
+	tasks     map[string]*taskState
+	lock      sync.Mutex
+	maxAge    time.Duration
+	lastSweep time.Time
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		methods:   make(map[string]*methodStats),
+		tasks:     make(map[string]*taskState),
+		maxAge:    DefaultMaxTaskAge,
+		lastSweep: time.Now()}
+}
+
+// lock must be taken
+func (collector *Collector) method(name string) *methodStats {
+	stats, exists := collector.methods[name]
+	if !exists {
+		stats = &methodStats{queueWait: newHistogram(), execution: newHistogram()}
+		collector.methods[name] = stats
+	}
+	return stats
+}
+
+// lost tasks (without result) are removed, lock must be taken
+func (collector *Collector) sweep(now time.Time) {
+	if now.Sub(collector.lastSweep) < collector.maxAge/10 {
+		return
+	}
+	collector.lastSweep = now
+	for task, state := range collector.tasks {
+		if now.Sub(state.enqueued) > collector.maxAge {
+			delete(collector.tasks, task)
+		}
+	}
+}
+
+// New task in queue
+func (collector *Collector) TaskEnqueued(task string, method string) {
+	if collector == nil {
+		return
+	}
+	now := time.Now()
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	collector.sweep(now)
+	collector.tasks[task] = &taskState{method: method, enqueued: now, mark: now}
+	collector.method(method).enqueued++
+}
+
+// Task is sent to executer
+func (collector *Collector) TaskDispatched(task string) {
+	if collector == nil {
+		return
+	}
+	now := time.Now()
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if state, exists := collector.tasks[task]; exists {
+		stats := collector.method(state.method)
+		stats.dispatched++
+		stats.queueWait.observe(now.Sub(state.mark))
+		state.mark = now
+	}
+}
+
+// Task is returned to queue after timeout of executer
+func (collector *Collector) TaskReturned(task string) {
+	if collector == nil {
+		return
+	}
+	now := time.Now()
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if state, exists := collector.tasks[task]; exists {
+		collector.method(state.method).returned++
+		state.mark = now
+	}
+}
+
+// New task of method is over queue size
+func (collector *Collector) QueueFull(method string) {
+	if collector == nil {
+		return
+	}
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	collector.method(method).queueFull++
+}
+
+// Submission of method with idempotency key of existing task
+func (collector *Collector) TaskDuplicate(method string) {
+	if collector == nil {
+		return
+	}
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	collector.method(method).duplicates++
+}
+
+// count task of overflow policy, finished tasks are removed
+func (collector *Collector) overflow(task string, finished bool, counter func(*methodStats) *int64) {
+	if collector == nil {
+		return
+	}
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	if state, exists := collector.tasks[task]; exists {
+		*counter(collector.method(state.method))++
+		if finished {
+			delete(collector.tasks, task)
+		}
+	}
+}
+
+// Task isn't added to full queue
+func (collector *Collector) TaskRejected(task string) {
+	collector.overflow(task, true, func(stats *methodStats) *int64 { return &stats.rejected })
+}
+
+// Task is removed from full queue for new one
+func (collector *Collector) TaskDropped(task string) {
+	collector.overflow(task, true, func(stats *methodStats) *int64 { return &stats.dropped })
+}
+
+// Task is moved to overflow queue
+func (collector *Collector) TaskSpilled(task string) {
+	collector.overflow(task, false, func(stats *methodStats) *int64 { return &stats.spilled })
+}
+
+// Result of task from executer
+func (collector *Collector) TaskResult(task string, failed bool) {
+	if collector == nil {
+		return
+	}
+	now := time.Now()
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	state, exists := collector.tasks[task]
+	if !exists {
+		return
+	}
+	delete(collector.tasks, task)
+	stats := collector.method(state.method)
+	stats.results++
+	if failed {
+		stats.errors++
+	}
+	stats.execution.observe(now.Sub(state.mark))
+	stats.throughput.add(now)
+}
+
+// Statistics of all methods sorted by name
+func (collector *Collector) Snapshot() []MethodStats {
+	result := make([]MethodStats, 0)
+	if collector == nil {
+		return result
+	}
+	now := time.Now()
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	for name, stats := range collector.methods {
+		item := MethodStats{
+			Method:     name,
+			Enqueued:   stats.enqueued,
+			Dispatched: stats.dispatched,
+			Results:    stats.results,
+			Errors:     stats.errors,
+			Returned:   stats.returned,
+			QueueFull:  stats.queueFull,
+			Rejected:   stats.rejected,
+			Dropped:    stats.dropped,
+			Spilled:    stats.spilled,
+			Duplicates: stats.duplicates,
+			Throughput: stats.throughput.rate(now),
+			QueueWait:  stats.queueWait.cumulative(),
+			Execution:  stats.execution.cumulative()}
+		if stats.dispatched > 0 {
+			item.TimeoutRatio = float64(stats.returned) / float64(stats.dispatched)
+		}
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Method < result[j].Method })
+	return result
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeHistogram(writer io.Writer, name string, method string, histogram Histogram) {
+	label := escapeLabel(method)
+	for index, count := range histogram.Buckets {
+		bound := "+Inf"
+		if index < len(LatencyBuckets) {
+			bound = fmt.Sprint(LatencyBuckets[index])
+		}
+		fmt.Fprintf(writer, "%s_bucket{method=\"%s\",le=\"%s\"} %d\n", name, label, bound, count)
+	}
+	fmt.Fprintf(writer, "%s_sum{method=\"%s\"} %g\n", name, label, histogram.Sum)
+	fmt.Fprintf(writer, "%s_count{method=\"%s\"} %d\n", name, label, histogram.Count)
+}
+
+// Statistics in Prometheus text format
+func WritePrometheus(writer io.Writer, snapshot []MethodStats) {
+	counters := []struct {
+		name  string
+		help  string
+		value func(*MethodStats) int64
+	}{
+		{"squ_tasks_enqueued_total", "Tasks added to queue.",
+			func(stats *MethodStats) int64 { return stats.Enqueued }},
+		{"squ_tasks_dispatched_total", "Tasks sent to executers.",
+			func(stats *MethodStats) int64 { return stats.Dispatched }},
+		{"squ_tasks_results_total", "Results from executers.",
+			func(stats *MethodStats) int64 { return stats.Results }},
+		{"squ_tasks_errors_total", "Results with error.",
+			func(stats *MethodStats) int64 { return stats.Errors }},
+		{"squ_tasks_returned_total", "Tasks returned to queue after executer timeout.",
+			func(stats *MethodStats) int64 { return stats.Returned }}}
+	for _, counter := range counters {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for index := range snapshot {
+			fmt.Fprintf(
+				writer, "%s{method=\"%s\"} %d\n",
+				counter.name, escapeLabel(snapshot[index].Method), counter.value(&snapshot[index]))
+		}
+	}
+	fmt.Fprintf(writer, "# HELP squ_tasks_throughput Results per second for last minute.\n")
+	fmt.Fprintf(writer, "# TYPE squ_tasks_throughput gauge\n")
+	for _, stats := range snapshot {
+		fmt.Fprintf(
+			writer, "squ_tasks_throughput{method=\"%s\"} %g\n", escapeLabel(stats.Method), stats.Throughput)
+	}
+	histograms := []struct {
+		name  string
+		help  string
+		value func(*MethodStats) Histogram
+	}{
+		{"squ_queue_wait_ms", "Time from enqueue to dispatch.",
+			func(stats *MethodStats) Histogram { return stats.QueueWait }},
+		{"squ_execution_ms", "Time from dispatch to result.",
+			func(stats *MethodStats) Histogram { return stats.Execution }}}
+	for _, histogram := range histograms {
+		fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+		for index := range snapshot {
+			writeHistogram(writer, histogram.name, snapshot[index].Method, histogram.value(&snapshot[index]))
+		}
+	}
+}
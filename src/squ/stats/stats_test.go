@@ -0,0 +1,58 @@
+package stats_test
+
+import (
+	"bytes"
+	"squ/stats"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	collector := stats.NewCollector()
+	collector.TaskEnqueued("t1", "sum")
+	collector.TaskDispatched("t1")
+	collector.TaskReturned("t1")
+	collector.TaskDispatched("t1")
+	collector.TaskResult("t1", false)
+	collector.TaskEnqueued("t2", "sum")
+	collector.TaskDispatched("t2")
+	time.Sleep(3 * time.Millisecond)
+	collector.TaskResult("t2", true)
+	// unknown task is ignored
+	collector.TaskResult("t3", false)
+	snapshot := collector.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("incorrect snapshot %+v", snapshot)
+	}
+	sum := snapshot[0]
+	if sum.Enqueued != 2 || sum.Dispatched != 3 || sum.Returned != 1 ||
+		sum.Results != 2 || sum.Errors != 1 || sum.TimeoutRatio != 1.0/3 {
+		//
+		t.Errorf("incorrect counters %+v", sum)
+	}
+	if sum.QueueWait.Count != 3 || sum.Execution.Count != 2 || sum.Throughput <= 0 {
+		t.Errorf("incorrect histograms %+v", sum)
+	}
+	// cumulative buckets
+	last := sum.Execution.Buckets[len(sum.Execution.Buckets)-1]
+	if last != 2 || sum.Execution.Buckets[0] != 1 || sum.Execution.Quantile(1) != 5 {
+		t.Errorf("incorrect buckets %v", sum.Execution.Buckets)
+	}
+	buffer := bytes.Buffer{}
+	stats.WritePrometheus(&buffer, snapshot)
+	for _, line := range []string{
+		`squ_tasks_returned_total{method="sum"} 1`,
+		`squ_execution_ms_bucket{method="sum",le="+Inf"} 2`,
+		`# TYPE squ_queue_wait_ms histogram`} {
+		//
+		if !strings.Contains(buffer.String(), line) {
+			t.Errorf("no line %s in metrics", line)
+		}
+	}
+	var nilCollector *stats.Collector
+	nilCollector.TaskEnqueued("t4", "sum")
+	if len(nilCollector.Snapshot()) != 0 {
+		t.Error("nil collector must be empty")
+	}
+}
@@ -9,6 +9,9 @@ const (
 	SubSystemCommandNone = iota
 	SubSystemCommandStorage
 	SubSystemStatistic
+	SubSystemScheduler
+	SubSystemCron
+	SubSystemResultStore
 )
 
 const (
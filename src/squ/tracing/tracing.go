@@ -0,0 +1,408 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceparentVersion = "00"
+	// trace flags
+	FlagSampled = "01"
+	// header of HTTP requests
+	TraceparentHeader = "traceparent"
+)
+
+// span names of task stages
+const (
+	SpanTask      = "task"
+	SpanEnqueue   = "enqueue"
+	SpanQueueWait = "queue_wait"
+	SpanDispatch  = "dispatch"
+	SpanProcess   = "process"
+	SpanDeliver   = "deliver"
+)
+
+// exporter types in settings
+const (
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+)
+
+// task state is removed without result after this time
+const DefaultMaxTaskAge = time.Hour
+
+var ErrTraceparentFormat = errors.New("incorrect traceparent")
+
+// Trace and span ids of W3C traceparent
+type TraceContext struct {
+	TraceId string
+	SpanId  string
+	Flags   string
+}
+
+func isHex(value string, size int) bool {
+	if len(value) != size || strings.Trim(value, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil && strings.ToLower(value) == value
+}
+
+// Parse "00-<trace id>-<span id>-<flags>"
+func ParseTraceparent(value string) (TraceContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		!isHex(parts[1], 32) || !isHex(parts[2], 16) || len(parts[3]) != 2 {
+		//
+		return TraceContext{}, ErrTraceparentFormat
+	}
+	if parts[0] == TraceparentVersion && len(parts) != 4 {
+		return TraceContext{}, ErrTraceparentFormat
+	}
+	return TraceContext{TraceId: parts[1], SpanId: parts[2], Flags: parts[3]}, nil
+}
+
+func (traceContext TraceContext) IsValid() bool {
+	return traceContext.TraceId != "" && traceContext.SpanId != ""
+}
+
+func (traceContext TraceContext) String() string {
+	if !traceContext.IsValid() {
+		return ""
+	}
+	flags := traceContext.Flags
+	if flags == "" {
+		flags = FlagSampled
+	}
+	return fmt.Sprintf(
+		"%s-%s-%s-%s", TraceparentVersion, traceContext.TraceId, traceContext.SpanId, flags)
+}
+
+type contextKey struct{}
+
+// Context with trace for calls and handlers
+func NewContext(ctx context.Context, traceContext TraceContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, traceContext)
+}
+
+func FromContext(ctx context.Context) (TraceContext, bool) {
+	traceContext, ok := ctx.Value(contextKey{}).(TraceContext)
+	return traceContext, ok && traceContext.IsValid()
+}
+
+func newId(size int) string {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		// time based id is better than nothing
+		copy(data, fmt.Sprintf("%0*x", size, time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(data)
+}
+
+// Finished span for exporters
+type Span struct {
+	TraceId    string            `json:"trace_id"`
+	SpanId     string            `json:"span_id"`
+	ParentId   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Task       string            `json:"task,omitempty"`
+	Method     string            `json:"method,omitempty"`
+	Start      time.Time         `json:"start"`
+	Duration   int64             `json:"duration_us"`
+	Error      string            `json:"error,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	end        time.Time
+}
+
+func (span *Span) Context() TraceContext {
+	return TraceContext{TraceId: span.TraceId, SpanId: span.SpanId, Flags: FlagSampled}
+}
+
+func (span *Span) SetAttribute(key, value string) {
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]string)
+	}
+	span.Attributes[key] = value
+}
+
+// Destination of finished spans
+type Exporter interface {
+	Export(span *Span) error
+	Close() error
+}
+
+// Spans as JSON lines
+type WriterExporter struct {
+	writer io.Writer
+	closer io.Closer
+	lock   sync.Mutex
+}
+
+func NewWriterExporter(writer io.Writer) *WriterExporter {
+	return &WriterExporter{writer: writer}
+}
+
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+// Spans are appended to file
+func NewFileExporter(path string) (*WriterExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{writer: file, closer: file}, nil
+}
+
+func (exporter *WriterExporter) Export(span *Span) error {
+	data, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	_, err = exporter.writer.Write(append(data, '\n'))
+	return err
+}
+
+func (exporter *WriterExporter) Close() error {
+	if exporter.closer != nil {
+		return exporter.closer.Close()
+	}
+	return nil
+}
+
+// Tracing options in settings, tracing is off without exporter
+type Options struct {
+	Exporter string `json:"exporter"`
+	// file of spans for "file" exporter
+	Path string `json:"path"`
+}
+
+func (options Options) Validate() []string {
+	var problems []string
+	switch options.Exporter {
+	case "", ExporterStdout:
+	case ExporterFile:
+		if options.Path == "" {
+			problems = append(problems, "file exporter without path")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown exporter '%s'", options.Exporter))
+	}
+	return problems
+}
+
+// Exporter for options, nil if tracing is off
+func NewExporter(options Options) (Exporter, error) {
+	switch options.Exporter {
+	case "":
+		return nil, nil
+	case ExporterStdout:
+		return NewStdoutExporter(), nil
+	case ExporterFile:
+		return NewFileExporter(options.Path)
+	default:
+		return nil, fmt.Errorf("unknown exporter '%s'", options.Exporter)
+	}
+}
+
+// spans of task in progress
+type taskTrace struct {
+	root    *Span
+	current *Span
+	// waiting in queue after timeout of executer
+	returned int
+}
+
+// Tracer of task stages, nil tracer does nothing
+type Tracer struct {
+	exporter  Exporter
+	tasks     map[string]*taskTrace
+	lock      sync.Mutex
+	maxAge    time.Duration
+	lastSweep time.Time
+	OnError   func(err error)
+}
+
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{
+		exporter:  exporter,
+		tasks:     make(map[string]*taskTrace),
+		maxAge:    DefaultMaxTaskAge,
+		lastSweep: time.Now()}
+}
+
+func (tracer *Tracer) export(span *Span) {
+	span.Duration = int64(span.end.Sub(span.Start) / time.Microsecond)
+	if err := tracer.exporter.Export(span); err != nil && tracer.OnError != nil {
+		tracer.OnError(err)
+	}
+}
+
+func (tracer *Tracer) newSpan(name string, parent *Span) *Span {
+	span := Span{
+		TraceId:  parent.TraceId,
+		SpanId:   newId(8),
+		ParentId: parent.SpanId,
+		Name:     name,
+		Task:     parent.Task,
+		Method:   parent.Method,
+		Start:    time.Now()}
+	return &span
+}
+
+// finish current stage and start next one, lock must be taken
+func (tracer *Tracer) next(trace *taskTrace, name string, errMsg string) *Span {
+	now := time.Now()
+	if trace.current != nil {
+		trace.current.end = now
+		trace.current.Error = errMsg
+		tracer.export(trace.current)
+	}
+	if name == "" {
+		trace.current = nil
+	} else {
+		trace.current = tracer.newSpan(name, trace.root)
+		trace.current.Start = now
+	}
+	return trace.current
+}
+
+// lost tasks (without result) are removed
+func (tracer *Tracer) sweep(now time.Time) {
+	if now.Sub(tracer.lastSweep) < tracer.maxAge/10 {
+		return
+	}
+	tracer.lastSweep = now
+	for task, trace := range tracer.tasks {
+		if now.Sub(trace.root.Start) > tracer.maxAge {
+			delete(tracer.tasks, task)
+		}
+	}
+}
+
+func (tracer *Tracer) stage(task string, name string, errMsg string) *Span {
+	if tracer == nil {
+		return nil
+	}
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	if trace, exists := tracer.tasks[task]; exists {
+		return tracer.next(trace, name, errMsg)
+	}
+	return nil
+}
+
+// New task in server, parent is traceparent from client (can be empty)
+func (tracer *Tracer) TaskEnqueue(task string, method string, traceparent string) {
+	if tracer == nil {
+		return
+	}
+	root := Span{
+		SpanId: newId(8),
+		Name:   SpanTask,
+		Task:   task,
+		Method: method,
+		Start:  time.Now()}
+	if parent, err := ParseTraceparent(traceparent); err == nil {
+		root.TraceId = parent.TraceId
+		root.ParentId = parent.SpanId
+	} else {
+		root.TraceId = newId(16)
+	}
+	trace := taskTrace{root: &root}
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	tracer.sweep(root.Start)
+	tracer.tasks[task] = &trace
+	tracer.next(&trace, SpanEnqueue, "")
+}
+
+// Task is in queue
+func (tracer *Tracer) TaskEnqueued(task string) {
+	tracer.stage(task, SpanQueueWait, "")
+}
+
+// Task is taken from queue by executer
+func (tracer *Tracer) TaskDequeued(task string) {
+	tracer.stage(task, SpanDispatch, "")
+}
+
+// Task is sent to executer, result is traceparent for executer
+func (tracer *Tracer) TaskDispatched(task string) string {
+	if span := tracer.stage(task, SpanProcess, ""); span != nil {
+		return span.Context().String()
+	}
+	return ""
+}
+
+// Task is returned to queue after timeout of executer
+func (tracer *Tracer) TaskReturned(task string) {
+	if tracer == nil {
+		return
+	}
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	if trace, exists := tracer.tasks[task]; exists {
+		trace.returned++
+		span := tracer.next(trace, SpanQueueWait, "executer timeout")
+		span.SetAttribute("returned", fmt.Sprint(trace.returned))
+	}
+}
+
+// Result from executer
+func (tracer *Tracer) TaskResult(task string, errMsg string) {
+	tracer.stage(task, SpanDeliver, errMsg)
+}
+
+// Result is delivered (or nobody waits it), all spans of task are finished
+func (tracer *Tracer) TaskDone(task string, delivered bool) {
+	if tracer == nil {
+		return
+	}
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	trace, exists := tracer.tasks[task]
+	if !exists {
+		return
+	}
+	delete(tracer.tasks, task)
+	if !delivered && trace.current != nil {
+		trace.current.SetAttribute("delivered", "false")
+	}
+	tracer.next(trace, "", "")
+	trace.root.end = time.Now()
+	if trace.returned > 0 {
+		trace.root.SetAttribute("returned", fmt.Sprint(trace.returned))
+	}
+	tracer.export(trace.root)
+}
+
+// Count of traced tasks in progress
+func (tracer *Tracer) Active() int {
+	if tracer == nil {
+		return 0
+	}
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+	return len(tracer.tasks)
+}
+
+func (tracer *Tracer) Close() error {
+	if tracer == nil {
+		return nil
+	}
+	return tracer.exporter.Close()
+}
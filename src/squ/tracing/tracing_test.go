@@ -0,0 +1,80 @@
+package tracing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"squ/tracing"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceContext, err := tracing.ParseTraceparent(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traceContext.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || traceContext.String() != value {
+		t.Errorf("incorrect context %+v", traceContext)
+	}
+	wrong := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	for _, item := range wrong {
+		if _, err = tracing.ParseTraceparent(item); err == nil {
+			t.Errorf("error expected for '%s'", item)
+		}
+	}
+	ctx := tracing.NewContext(context.Background(), traceContext)
+	if fromCtx, ok := tracing.FromContext(ctx); !ok || fromCtx != traceContext {
+		t.Error("no trace in context")
+	}
+}
+
+func TestTaskSpans(t *testing.T) {
+	buffer := bytes.Buffer{}
+	tracer := tracing.NewTracer(tracing.NewWriterExporter(&buffer))
+	parent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tracer.TaskEnqueue("t1", "sum", parent)
+	tracer.TaskEnqueued("t1")
+	tracer.TaskDequeued("t1")
+	tracer.TaskDispatched("t1")
+	tracer.TaskReturned("t1")
+	tracer.TaskDequeued("t1")
+	executerParent := tracer.TaskDispatched("t1")
+	tracer.TaskResult("t1", "")
+	tracer.TaskDone("t1", true)
+	if tracer.Active() != 0 {
+		t.Error("task trace is not removed")
+	}
+	var names []string
+	spans := make(map[string]tracing.Span)
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		span := tracing.Span{}
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatal(err)
+		}
+		if span.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || span.Task != "t1" {
+			t.Errorf("incorrect span %s", line)
+		}
+		names = append(names, span.Name)
+		spans[span.SpanId] = span
+	}
+	expected := "enqueue queue_wait dispatch process queue_wait dispatch process deliver task"
+	if strings.Join(names, " ") != expected {
+		t.Fatalf("incorrect spans %v", names)
+	}
+	executerContext, _ := tracing.ParseTraceparent(executerParent)
+	if span := spans[executerContext.SpanId]; span.Name != tracing.SpanProcess {
+		t.Errorf("executer parent is not process span: %+v", span)
+	}
+	var nilTracer *tracing.Tracer
+	nilTracer.TaskEnqueue("t2", "sum", "")
+	if nilTracer.TaskDispatched("t2") != "" {
+		t.Error("nil tracer must do nothing")
+	}
+}
@@ -1,9 +1,12 @@
 package transport
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"squ/logger"
+	"time"
 )
 
 const (
@@ -36,6 +39,67 @@ type Command struct {
 	// used
 	Method string `json:"method"`
 	Params string `json:"params"`
+	// W3C trace context of caller, optional
+	Traceparent string `json:"traceparent,omitempty"`
+	// execution not before delay (sec.) or time (RFC 3339), optional
+	Delay     float64 `json:"delay,omitempty"`
+	NotBefore string  `json:"not_before,omitempty"`
+	// duplicates with the same key in window aren't executed, optional
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// delivery to every executer of method, optional
+	Broadcast bool `json:"broadcast,omitempty"`
+	// delivery to N executers, result after K successful answers
+	// or error after timeout (sec., timeout of params by default), optional
+	Scatter       int     `json:"scatter,omitempty"`
+	Quorum        int     `json:"quorum,omitempty"`
+	QuorumTimeout float64 `json:"quorum_timeout,omitempty"`
+	// commands with the same key go to the same executer of method, optional
+	RoutingKey string `json:"routing_key,omitempty"`
+	// only executers with these labels, optional
+	Selector map[string]string `json:"selector,omitempty"`
+}
+
+var (
+	ErrNegativeDelay   = errors.New("negative delay")
+	ErrNotBeforeFormat = errors.New("incorrect not_before time")
+	ErrQuorum          = errors.New("incorrect scatter or quorum")
+)
+
+// Due time of delayed command, zero time if it can be executed now
+func (cmd *Command) GetNotBefore(now time.Time) (time.Time, error) {
+	var due time.Time
+	if cmd.Delay < 0 {
+		return due, ErrNegativeDelay
+	}
+	if cmd.NotBefore != "" {
+		value, err := time.Parse(time.RFC3339, cmd.NotBefore)
+		if err != nil {
+			return due, ErrNotBeforeFormat
+		}
+		due = value
+	}
+	if delayed := now.Add(time.Duration(cmd.Delay * float64(time.Second))); delayed.After(due) {
+		due = delayed
+	}
+	if !due.After(now) {
+		return time.Time{}, nil
+	}
+	return due, nil
+}
+
+// Command for several executers: broadcast or scatter-gather
+func (cmd *Command) IsFanout() bool {
+	return cmd.Broadcast || cmd.Scatter != 0 || cmd.Quorum != 0
+}
+
+// Check of scatter-gather values, quorum can't be over scatter
+func (cmd *Command) ValidateQuorum() error {
+	if cmd.Scatter < 0 || cmd.Quorum < 0 || cmd.QuorumTimeout < 0 ||
+		(cmd.Scatter > 0 && cmd.Quorum > cmd.Scatter) {
+		//
+		return ErrQuorum
+	}
+	return nil
 }
 
 func NewCommand(method string) *Command {
@@ -73,8 +137,15 @@ func (cmd *Command) Load(data *[]byte) error {
 }
 
 type ErrorDescription struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *ErrorData `json:"data,omitempty"`
+}
+
+// Details of error
+type ErrorData struct {
+	// task which is not done in time, its result can be queried later
+	Task string `json:"task,omitempty"`
 }
 
 func (description *ErrorDescription) Exists() bool {
@@ -126,6 +197,13 @@ func NewErrorAnswer(id, code int, msg string) *Answer {
 	return &result
 }
 
+// Error answer with task of command
+func NewTaskErrorAnswer(id, code int, msg string, task string) *Answer {
+	result := NewErrorAnswer(id, code, msg)
+	result.Error.Data = &ErrorData{Task: task}
+	return result
+}
+
 func NewAnswer(id int, res string) *Answer {
 	result := Answer{baseAnswer: baseAnswer{Result: res, Jsonrpc: JSONRpcVersion}}
 	result.Id = id
@@ -148,11 +226,19 @@ func PackCmd(cmd *Command, uid string) *Answer {
 	} else {
 		result.Error = ErrorDescription{
 			Code:    ErrCodeProblemDumpJson,
-			Message: fmt.Sprint("Problem with task command: %s", err)}
+			Message: fmt.Sprintf("Problem with task command: %s", err)}
 	}
 	return &result
 }
 
+func ParseAnswer(content *[]byte) (*Answer, error) {
+	answer := Answer{}
+	if err := json.Unmarshal(*content, &answer); err != nil {
+		return nil, err
+	}
+	return &answer, nil
+}
+
 func ParseCommand(content *[]byte) (*Command, error) {
 	cmd := Command{}
 	err := cmd.Load(content)
@@ -162,3 +248,77 @@ func ParseCommand(content *[]byte) (*Command, error) {
 		return nil, err
 	}
 }
+
+// Result of task from executer (params of "result" method)
+type TaskResult struct {
+	Task   string            `json:"task"`
+	Result string            `json:"result"`
+	Error  *ErrorDescription `json:"error,omitempty"`
+}
+
+// Answer for receiver from task result
+func (result *TaskResult) Answer(id int) *Answer {
+	if result.Error != nil && result.Error.Exists() {
+		return NewErrorAnswer(id, result.Error.Code, result.Error.Message)
+	}
+	return NewAnswer(id, result.Result)
+}
+
+// Answer with task id, when result is not ready
+type TaskAnswer struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Id      int    `json:"id"`
+	Task    string `json:"task"`
+}
+
+func NewTaskAnswer(id int, task string) *TaskAnswer {
+	return &TaskAnswer{Jsonrpc: JSONRpcVersion, Id: id, Task: task}
+}
+
+// fields of Command without its methods
+type commandFields Command
+
+// request with params as json object or as string
+type rawCommand struct {
+	commandFields
+	Params json.RawMessage `json:"params"`
+}
+
+func (raw *rawCommand) command() *Command {
+	cmd := Command(raw.commandFields)
+	cmd.Jsonrpc = JSONRpcVersion
+	cmd.Params = "{}"
+	params := bytes.TrimSpace(raw.Params)
+	if len(params) > 0 && string(params) != "null" {
+		if params[0] == '"' {
+			var value string
+			if json.Unmarshal(params, &value) == nil {
+				cmd.Params = value
+			}
+		} else {
+			cmd.Params = string(params)
+		}
+	}
+	return &cmd
+}
+
+// Parse single request or batch (second result is "true" for batch)
+func ParseRequest(content *[]byte) ([]*Command, bool, error) {
+	data := bytes.TrimSpace(*content)
+	if len(data) > 0 && data[0] == '[' {
+		var rawList []rawCommand
+		if err := json.Unmarshal(data, &rawList); err != nil {
+			return nil, true, err
+		}
+		result := make([]*Command, len(rawList))
+		for index := range rawList {
+			result[index] = rawList[index].command()
+		}
+		return result, true, nil
+	}
+	raw := rawCommand{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, false, err
+	}
+	return []*Command{raw.command()}, false, nil
+}
@@ -0,0 +1,288 @@
+package websocket
+
+import (
+	"bufio"
+	sha "crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Minimal server side of RFC 6455, only what squ needs:
+// one JSON-RPC message per text (or binary) frame.
+
+const (
+	acceptGuid     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	DefaultMaxSize = 1024 * 1024 * 16
+	// payload of control frame (RFC 6455 5.5)
+	maxControlSize = 125
+)
+
+// opcodes
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// close codes
+const (
+	CloseNormal        = 1000
+	CloseProtocolError = 1002
+	CloseTooBig        = 1009
+)
+
+var (
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+	ErrBadOrigin    = errors.New("websocket: origin is not allowed")
+	ErrNotMasked    = errors.New("websocket: client frame is not masked")
+	ErrTooBig       = errors.New("websocket: message too big")
+	ErrProtocol     = errors.New("websocket: protocol error")
+	ErrClosed       = errors.New("websocket: connection closed")
+)
+
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock *sync.Mutex
+	MaxSize   int
+	closed    bool
+}
+
+func acceptKey(key string) string {
+	hash := sha.Sum([]byte(key + acceptGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContains(header http.Header, name, value string) bool {
+	for _, line := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Origin of browser is in list ("*" for any) or has the same host without list,
+// request without origin isn't from browser
+func originAllowed(request *http.Request, allowedOrigins []string) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(allowedOrigins) == 0 {
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, request.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check handshake request and origin, hijack connection and send switching answer
+func Upgrade(writer http.ResponseWriter, request *http.Request, allowedOrigins []string) (*Conn, error) {
+	key := request.Header.Get("Sec-Websocket-Key")
+	if request.Method != http.MethodGet ||
+		!headerContains(request.Header, "Connection", "upgrade") ||
+		!headerContains(request.Header, "Upgrade", "websocket") ||
+		request.Header.Get("Sec-Websocket-Version") != "13" ||
+		key == "" {
+		//
+		http.Error(writer, "Expected websocket handshake.", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if !originAllowed(request, allowedOrigins) {
+		http.Error(writer, "Origin is not allowed.", http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "Websocket is not supported.", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+	netConn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	answer := fmt.Sprintf(
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if _, err = netConn.Write([]byte(answer)); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	conn := Conn{
+		conn:      netConn,
+		reader:    buffer.Reader,
+		writeLock: new(sync.Mutex),
+		MaxSize:   DefaultMaxSize}
+	return &conn, nil
+}
+
+func (conn *Conn) NetConn() net.Conn {
+	return conn.conn
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.conn.RemoteAddr()
+}
+
+// read one frame: fin flag, opcode and unmasked payload
+func (conn *Conn) readFrame() (bool, int, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := int(head[0] & 0x0f)
+	if head[0]&0x70 != 0 {
+		// no extensions negotiated
+		return fin, opcode, nil, ErrProtocol
+	}
+	if head[1]&0x80 == 0 {
+		return fin, opcode, nil, ErrNotMasked
+	}
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(conn.reader, ext[:]); err != nil {
+			return fin, opcode, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(conn.reader, ext[:]); err != nil {
+			return fin, opcode, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode&0x8 != 0 && (!fin || size > maxControlSize) {
+		// control frame isn't fragmented and has short payload
+		return fin, opcode, nil, ErrProtocol
+	}
+	if size > uint64(conn.MaxSize) {
+		return fin, opcode, nil, ErrTooBig
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(conn.reader, mask[:]); err != nil {
+		return fin, opcode, nil, err
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn.reader, payload); err != nil {
+		return fin, opcode, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (conn *Conn) writeFrame(opcode int, payload []byte) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	if conn.closed {
+		return ErrClosed
+	}
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, byte(0x80|opcode))
+	size := len(payload)
+	switch {
+	case size < 126:
+		frame = append(frame, byte(size))
+	case size <= 0xffff:
+		frame = append(frame, 126, byte(size>>8), byte(size))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(size))
+		frame = append(frame, 127)
+		frame = append(frame, ext[:]...)
+	}
+	frame = append(frame, payload...)
+	_, err := conn.conn.Write(frame)
+	if opcode == OpClose {
+		conn.closed = true
+	}
+	return err
+}
+
+func (conn *Conn) closeWith(code int) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	conn.writeFrame(OpClose, payload)
+}
+
+// Read next data message (fragments are collected),
+// control frames are processed here, io.EOF after close frame.
+func (conn *Conn) ReadMessage() (int, []byte, error) {
+	var message []byte
+	messageType := -1
+	for {
+		fin, opcode, payload, err := conn.readFrame()
+		if err != nil {
+			switch err {
+			case ErrTooBig:
+				conn.closeWith(CloseTooBig)
+			case ErrProtocol, ErrNotMasked:
+				conn.closeWith(CloseProtocolError)
+			}
+			return messageType, nil, err
+		}
+		switch opcode {
+		case OpPing:
+			conn.writeFrame(OpPong, payload)
+		case OpPong:
+			// skip
+		case OpClose:
+			conn.closeWith(CloseNormal)
+			return messageType, nil, io.EOF
+		case OpText, OpBinary, OpContinuation:
+			{
+				if (opcode == OpContinuation) == (messageType < 0) {
+					conn.closeWith(CloseProtocolError)
+					return messageType, nil, ErrProtocol
+				}
+				if messageType < 0 {
+					messageType = opcode
+				}
+				if len(message)+len(payload) > conn.MaxSize {
+					conn.closeWith(CloseTooBig)
+					return messageType, nil, ErrTooBig
+				}
+				message = append(message, payload...)
+				if fin {
+					return messageType, message, nil
+				}
+			}
+		default:
+			conn.closeWith(CloseProtocolError)
+			return messageType, nil, ErrProtocol
+		}
+	}
+}
+
+// Send message in one frame
+func (conn *Conn) WriteMessage(messageType int, data []byte) error {
+	return conn.writeFrame(messageType, data)
+}
+
+func (conn *Conn) Close() error {
+	return conn.conn.Close()
+}
@@ -0,0 +1,223 @@
+package websocket_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"squ/websocket"
+	"strings"
+	"testing"
+)
+
+// client side frame (always masked)
+func clientFrame(opcode int, fin bool, payload []byte) []byte {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	size := len(payload)
+	switch {
+	case size < 126:
+		frame = append(frame, 0x80|byte(size))
+	default:
+		frame = append(frame, 0x80|126, byte(size>>8), byte(size))
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func readServerFrame(reader *bufio.Reader) (int, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return 0, nil, err
+	}
+	size := int(head[1] & 0x7f)
+	if size == 126 {
+		var ext [2]byte
+		io.ReadFull(reader, ext[:])
+		size = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, size)
+	_, err := io.ReadFull(reader, payload)
+	return int(head[0] & 0x0f), payload, err
+}
+
+func dial(t *testing.T, url string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn,
+		"GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\n"+
+			"Connection: keep-alive, Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Version: 13\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", response.StatusCode)
+	}
+	// example from RFC 6455
+	if response.Header.Get("Sec-Websocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("wrong accept key %s", response.Header.Get("Sec-Websocket-Accept"))
+	}
+	return conn, reader
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			conn, err := websocket.Upgrade(writer, request, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				messageType, message, err := conn.ReadMessage()
+				if err != nil {
+					return
+				}
+				conn.WriteMessage(messageType, message)
+			}
+		}))
+	defer server.Close()
+
+	conn, reader := dial(t, server.URL)
+	defer conn.Close()
+	// simple and fragmented messages
+	long := strings.Repeat("x", 300)
+	conn.Write(clientFrame(websocket.OpText, true, []byte(`{"id": 1}`)))
+	conn.Write(clientFrame(websocket.OpText, false, []byte(`{"id": `)))
+	conn.Write(clientFrame(websocket.OpPing, true, []byte("ping")))
+	conn.Write(clientFrame(websocket.OpContinuation, true, []byte(`2}`)))
+	conn.Write(clientFrame(websocket.OpText, true, []byte(long)))
+
+	expected := []struct {
+		opcode  int
+		payload string
+	}{
+		{websocket.OpText, `{"id": 1}`},
+		{websocket.OpPong, "ping"},
+		{websocket.OpText, `{"id": 2}`},
+		{websocket.OpText, long},
+	}
+	for _, exp := range expected {
+		opcode, payload, err := readServerFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != exp.opcode || string(payload) != exp.payload {
+			t.Errorf("got %d '%s' expected %d '%s'", opcode, payload, exp.opcode, exp.payload)
+		}
+	}
+	conn.Write(clientFrame(websocket.OpClose, true, []byte{0x03, 0xe8}))
+	if opcode, _, err := readServerFrame(reader); err != nil || opcode != websocket.OpClose {
+		t.Errorf("close frame expected, got %d %v", opcode, err)
+	}
+}
+
+func TestWebSocketBadControlFrame(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			conn, err := websocket.Upgrade(writer, request, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, _, err = conn.ReadMessage(); err != websocket.ErrProtocol {
+				t.Errorf("expected protocol error, got %v", err)
+			}
+		}))
+	defer server.Close()
+
+	for _, frame := range [][]byte{
+		clientFrame(websocket.OpPing, true, []byte(strings.Repeat("x", 126))),
+		clientFrame(websocket.OpPing, false, []byte("ping")),
+		clientFrame(websocket.OpClose, false, []byte{0x03, 0xe8})} {
+		//
+		conn, reader := dial(t, server.URL)
+		conn.Write(frame)
+		opcode, payload, err := readServerFrame(reader)
+		if err != nil || opcode != websocket.OpClose || len(payload) != 2 ||
+			binary.BigEndian.Uint16(payload) != websocket.CloseProtocolError {
+			//
+			t.Errorf("close frame with protocol error expected, got %d %v %v", opcode, payload, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebSocketBadHandshake(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			if _, err := websocket.Upgrade(writer, request, nil); err != websocket.ErrBadHandshake {
+				t.Errorf("expected bad handshake, got %v", err)
+			}
+		}))
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d", response.StatusCode)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	allowed := []string{"https://dash.example"}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			origins := allowed
+			if request.URL.Path == "/same" {
+				origins = nil
+			}
+			if conn, err := websocket.Upgrade(writer, request, origins); err == nil {
+				conn.Close()
+			}
+		}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tests := []struct {
+		path   string
+		origin string
+		status int
+	}{
+		{"/", "", http.StatusSwitchingProtocols},
+		{"/", "https://dash.example", http.StatusSwitchingProtocols},
+		{"/", "https://evil.example", http.StatusForbidden},
+		{"/same", "http://" + host, http.StatusSwitchingProtocols},
+		{"/same", "https://evil.example", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+test.path, nil)
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		request.Header.Set("Sec-WebSocket-Version", "13")
+		if test.origin != "" {
+			request.Header.Set("Origin", test.origin)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.status {
+			t.Errorf("origin '%s' of %s: status %d, expected %d",
+				test.origin, test.path, response.StatusCode, test.status)
+		}
+	}
+}